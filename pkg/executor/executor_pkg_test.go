@@ -25,6 +25,7 @@ import (
 	"github.com/pingcap/tidb/pkg/domain"
 	"github.com/pingcap/tidb/pkg/errctx"
 	"github.com/pingcap/tidb/pkg/executor/aggfuncs"
+	"github.com/pingcap/tidb/pkg/executor/mpperr"
 	"github.com/pingcap/tidb/pkg/kv"
 	"github.com/pingcap/tidb/pkg/parser/ast"
 	"github.com/pingcap/tidb/pkg/parser/mysql"
@@ -358,3 +359,15 @@ func TestErrLevelsForResetStmtContext(t *testing.T) {
 		}
 	}
 }
+
+func TestMPPGatherCloseDetachesRecoveryTracker(t *testing.T) {
+	memTracker := memory.NewTracker(-1, -1)
+	e := &MPPGather{memTracker: memTracker}
+	for i := 0; i < 3; i++ {
+		// Each Open creates a new recovery handler attached to the same tracker.
+		e.mppErrRecovery = mpperr.NewRecoveryHandler(false, 32, true, memTracker)
+		require.NotEmpty(t, memTracker.GetChildrenForTest())
+		require.NoError(t, e.Close())
+		require.Empty(t, memTracker.GetChildrenForTest())
+	}
+}
@@ -189,6 +189,7 @@ func (e *MPPGather) Open(ctx context.Context) (err error) {
 	})
 
 	e.mppErrRecovery = mpperr.NewRecoveryHandler(disaggTiFlashWithAutoScaler, uint64(holdCap), enableMPPRecovery, e.memTracker)
+	e.mppErrRecovery.SetKiller(&e.Ctx().GetSessionVars().SQLKiller)
 	return nil
 }
 
@@ -216,7 +217,7 @@ func (e *MPPGather) nextWithRecovery(ctx context.Context) error {
 		})
 
 		if mppErr != nil {
-			recoveryErr := e.mppErrRecovery.Recovery(&mpperr.RecoveryInfo{
+			recoveryRes, recoveryErr := e.mppErrRecovery.Recovery(ctx, &mpperr.RecoveryInfo{
 				MPPErr:  mppErr,
 				NodeCnt: e.nodeCnt,
 			})
@@ -237,8 +238,10 @@ func (e *MPPGather) nextWithRecovery(ctx context.Context) error {
 				return mppErr
 			}
 
+			// Both rescale and redispatch need to dispatch mpp tasks again.
 			logutil.BgLogger().Info("recovery mpp error succeed, begin next retry",
-				zap.Any("mppErr", mppErr), zap.Any("recoveryCnt", e.mppErrRecovery.RecoveryCnt()))
+				zap.Any("mppErr", mppErr), zap.Any("recoveryCnt", e.mppErrRecovery.RecoveryCnt()),
+				zap.Stringer("action", recoveryRes.Action))
 
 			if err := e.setupRespIter(ctx, true); err != nil {
 				logutil.BgLogger().Error("setup resp iter when recovery mpp err failed", zap.Any("err", err))
@@ -312,11 +315,11 @@ func (e *MPPGather) Close() error {
 		err = e.respIter.Close()
 	}
 	mppcoordmanager.InstanceMPPCoordinatorManager.Unregister(mppcoordmanager.CoordinatorUniqueID{MPPQueryID: e.mppQueryID, GatherID: e.gatherID})
-	if err != nil {
-		return err
+	// e.memTracker is reused when the executor is reopened, so detach the trackers of recovery handler from it.
+	if e.mppErrRecovery != nil {
+		e.mppErrRecovery.Close()
 	}
-	e.mppErrRecovery.ResetHolder()
-	return nil
+	return err
 }
 
 // Table implements the dataSourceExecutor interface.
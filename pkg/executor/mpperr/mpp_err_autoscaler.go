@@ -0,0 +1,327 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/util/logutil"
+	"github.com/pingcap/tidb/pkg/util/tiflashcompute"
+	"go.uber.org/zap"
+)
+
+// ErrNodeGroupThrottled is returned when AutoScaler calls of the node group are throttled.
+var ErrNodeGroupThrottled = errors.New("AutoScaler call of the node group is throttled")
+
+// NodeGroupThrottlePolicy decides how to handle a throttled AutoScaler call.
+type NodeGroupThrottlePolicy int
+
+const (
+	// NodeGroupThrottleReject fails the recovery with ErrNodeGroupThrottled.
+	NodeGroupThrottleReject NodeGroupThrottlePolicy = iota
+	// NodeGroupThrottleCoalesce skips the AutoScaler call and treats the recovery as succeed,
+	// because a recent call of the same node group is still in effect.
+	NodeGroupThrottleCoalesce
+)
+
+// NodeGroupThrottler limits AutoScaler calls per node group, at most one call per interval for each group.
+// It's safe for concurrent use, so it can be shared by RecoveryHandlers of different queries.
+type NodeGroupThrottler struct {
+	interval time.Duration
+	policy   NodeGroupThrottlePolicy
+	// nowFunc is used to get current time, can be replaced in test.
+	nowFunc func() time.Time
+
+	mu struct {
+		sync.Mutex
+		lastCallTime map[string]time.Time
+	}
+}
+
+// NewNodeGroupThrottler returns new instance of NodeGroupThrottler.
+func NewNodeGroupThrottler(interval time.Duration, policy NodeGroupThrottlePolicy) *NodeGroupThrottler {
+	t := &NodeGroupThrottler{
+		interval: interval,
+		policy:   policy,
+		nowFunc:  time.Now,
+	}
+	t.mu.lastCallTime = make(map[string]time.Time)
+	return t
+}
+
+// allow returns true and records the call if an AutoScaler call for group is allowed now.
+func (t *NodeGroupThrottler) allow(group string) bool {
+	now := t.nowFunc()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.mu.lastCallTime[group]; ok && now.Sub(last) < t.interval {
+		return false
+	}
+	t.mu.lastCallTime[group] = now
+	return true
+}
+
+// AutoScalerRateGate enforces a min interval between any two AutoScaler calls, which protects AutoScaler from bursty
+// recovery traffic. Unlike NodeGroupThrottler, calls are delayed instead of rejected.
+// It's safe for concurrent use, so it can be shared by RecoveryHandlers of different queries.
+type AutoScalerRateGate struct {
+	interval time.Duration
+	// nowFunc is used to get current time, can be replaced in test.
+	nowFunc func() time.Time
+
+	mu struct {
+		sync.Mutex
+		// nextCallTime is the earliest time of the next call.
+		nextCallTime time.Time
+	}
+}
+
+// NewAutoScalerRateGate returns new instance of AutoScalerRateGate.
+func NewAutoScalerRateGate(interval time.Duration) *AutoScalerRateGate {
+	return &AutoScalerRateGate{
+		interval: interval,
+		nowFunc:  time.Now,
+	}
+}
+
+// reserve reserves the next call, and returns the duration to wait before calling AutoScaler.
+func (g *AutoScalerRateGate) reserve() time.Duration {
+	now := g.nowFunc()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	callTime := now
+	if g.mu.nextCallTime.After(now) {
+		callTime = g.mu.nextCallTime
+	}
+	g.mu.nextCallTime = callTime.Add(g.interval)
+	return callTime.Sub(now)
+}
+
+// autoScalerCaller wraps AutoScaler calls for all handlers that rely on AutoScaler.
+type autoScalerCaller struct {
+	// fetcher is used to call AutoScaler, GetGlobalTopoFetcher() is used if it's nil.
+	fetcher tiflashcompute.TopoFetcher
+	// failoverFetchers are tried in order when fetcher cannot provide topo, like secondary AutoScaler endpoints.
+	failoverFetchers []tiflashcompute.TopoFetcher
+	throttler        *NodeGroupThrottler
+	// rateGate delays AutoScaler calls to keep the min interval between them if it's not nil.
+	rateGate *AutoScalerRateGate
+	// abandoned receives the result of the AutoScaler call abandoned because ctx is done, nil if there is none.
+	// The next call waits for it, so AutoScaler calls never overlap.
+	abandoned <-chan fetchResult
+	// recoveryTypes overrides the recovery type that handlers pass to AutoScaler for each category.
+	recoveryTypes map[RecoveryErrorCategory]tiflashcompute.RecoveryType
+	// maxRetries is the max times to retry a failed AutoScaler call in one recovery, 0 means no retry.
+	maxRetries   int
+	retryBackoff time.Duration
+	// retries is the number of retried AutoScaler calls of the running recovery.
+	retries int
+	// afterFunc waits retryBackoff, it's the afterFunc of RecoveryHandler.
+	afterFunc func(d time.Duration) <-chan time.Time
+	// correlationID is passed to AutoScaler if fetcher implements CorrelatedTopoFetcher.
+	correlationID string
+	// supportedTypes are the recovery types that AutoScaler supports, nil means asking fetcher by
+	// RecoveryTypeCapability or all types are supported.
+	supportedTypes []tiflashcompute.RecoveryType
+	// rescaleFragmentRatio is the min failed fragment ratio to call AutoScaler, failed fragments are re-dispatched
+	// without rescale below it. 0 means always rescale.
+	rescaleFragmentRatio float64
+
+	// unavailableThreshold is the number of consecutive failed AutoScaler calls to treat AutoScaler as unavailable
+	// for the rest of the statement. 0 means never.
+	unavailableThreshold int
+	consecutiveFailures  int
+	unavailable          bool
+}
+
+// onFetched records the result of AutoScaler call.
+func (c *autoScalerCaller) onFetched(err error) {
+	if err == nil {
+		c.consecutiveFailures = 0
+		return
+	}
+	c.consecutiveFailures++
+	if c.unavailableThreshold > 0 && c.consecutiveFailures >= c.unavailableThreshold {
+		c.unavailable = true
+	}
+}
+
+// resetAvailability forgets previous failures, so AutoScaler is tried again.
+func (c *autoScalerCaller) resetAvailability() {
+	c.consecutiveFailures = 0
+	c.unavailable = false
+}
+
+// shouldRescale returns false if only a small fraction of fragments failed, then re-dispatch is enough.
+func (c *autoScalerCaller) shouldRescale(info *RecoveryInfo) bool {
+	// Unknown ratio is treated as widespread failure.
+	return info.FailedFragmentRatio <= 0 || info.FailedFragmentRatio >= c.rescaleFragmentRatio
+}
+
+// rescale calls AutoScaler to rescale TiFlash by recoveryType and nodeCnt.
+func (c *autoScalerCaller) rescale(ctx context.Context, info *RecoveryInfo, recoveryType tiflashcompute.RecoveryType, nodeCnt int) (RecoveryResult, error) {
+	res := RecoveryResult{Action: RecoveryActionRescale}
+	// Only check fetched topo is not empty, because AutoScaler will keep the topo for a while.
+	// And the new topo will be fetched when dispatch mpp task again.
+	topo, skipped, err := c.recoveryAndGetTopo(ctx, info, recoveryType, nodeCnt)
+	for retry := 0; retry < c.maxRetries && c.shouldRetry(ctx, err); retry++ {
+		select {
+		case <-c.afterFunc(c.retryBackoff):
+		case <-ctx.Done():
+			return res, errors.Annotate(ctx.Err(), "wait backoff to retry AutoScaler")
+		}
+		c.retries++
+		topo, skipped, err = c.recoveryAndGetTopo(ctx, info, recoveryType, nodeCnt)
+	}
+	if !skipped && errors.Cause(err) != ErrNodeGroupThrottled {
+		res.RequestedNodeCnt = nodeCnt
+	}
+	if err != nil {
+		return res, err
+	}
+	if !skipped && len(topo) == 0 {
+		// Dispatch mpp task again will fail anyway.
+		return res, errors.Annotatef(ErrEmptyTopo, "recovery type: %v, node cnt: %v", recoveryType, nodeCnt)
+	}
+	return res, nil
+}
+
+// shouldRetry returns true if the AutoScaler call fails by err and may succeed by retry.
+func (c *autoScalerCaller) shouldRetry(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == nil && !c.unavailable && errors.Cause(err) != ErrNodeGroupThrottled
+}
+
+// recoveryTypeOf returns the recovery type of category, defaultType is returned if it's not overridden.
+func (c *autoScalerCaller) recoveryTypeOf(category RecoveryErrorCategory, defaultType tiflashcompute.RecoveryType) tiflashcompute.RecoveryType {
+	if recoveryType, ok := c.recoveryTypes[category]; ok {
+		return recoveryType
+	}
+	return defaultType
+}
+
+// RecoveryTypeCapability is optionally implemented by tiflashcompute.TopoFetcher to report the recovery types that
+// AutoScaler supports, since not all versions of AutoScaler support every recovery type.
+type RecoveryTypeCapability interface {
+	SupportedRecoveryTypes() []tiflashcompute.RecoveryType
+}
+
+// supports returns whether AutoScaler supports recoveryType, see SetSupportedRecoveryTypes().
+func (c *autoScalerCaller) supports(recoveryType tiflashcompute.RecoveryType) bool {
+	supportedTypes := c.supportedTypes
+	if supportedTypes == nil {
+		capability, ok := c.getTopoFetcher().(RecoveryTypeCapability)
+		if !ok {
+			return true
+		}
+		supportedTypes = capability.SupportedRecoveryTypes()
+	}
+	return slices.Contains(supportedTypes, recoveryType)
+}
+
+// CorrelatedTopoFetcher is optionally implemented by tiflashcompute.TopoFetcher to receive the correlation ID of
+// recovery, so AutoScaler calls can be correlated with distributed traces. See SetCorrelationID().
+type CorrelatedTopoFetcher interface {
+	RecoveryAndGetTopoWithCorrelationID(recovery tiflashcompute.RecoveryType, oriCNCnt int, correlationID string) ([]string, error)
+}
+
+// callFetcher calls RecoveryAndGetTopo of fetcher, with correlationID if it's supported.
+func callFetcher(fetcher tiflashcompute.TopoFetcher, recoveryType tiflashcompute.RecoveryType, nodeCnt int, correlationID string) ([]string, error) {
+	if f, ok := fetcher.(CorrelatedTopoFetcher); ok && len(correlationID) != 0 {
+		return f.RecoveryAndGetTopoWithCorrelationID(recoveryType, nodeCnt, correlationID)
+	}
+	return fetcher.RecoveryAndGetTopo(recoveryType, nodeCnt)
+}
+
+func (c *autoScalerCaller) getTopoFetcher() tiflashcompute.TopoFetcher {
+	if c.fetcher != nil {
+		return c.fetcher
+	}
+	return tiflashcompute.GetGlobalTopoFetcher()
+}
+
+// recoveryAndGetTopo calls AutoScaler to recovery. skipped is true when the call is coalesced by throttler.
+// It returns the error caused by ctx.Err() when ctx is done before AutoScaler responds, which isn't counted as
+// AutoScaler failure.
+func (c *autoScalerCaller) recoveryAndGetTopo(ctx context.Context, info *RecoveryInfo, recoveryType tiflashcompute.RecoveryType, nodeCnt int) (topo []string, skipped bool, err error) {
+	if c.throttler != nil && len(info.NodeGroup) != 0 && !c.throttler.allow(info.NodeGroup) {
+		if c.throttler.policy == NodeGroupThrottleCoalesce {
+			return nil, true, nil
+		}
+		return nil, false, errors.Annotatef(ErrNodeGroupThrottled, "node group: %s", info.NodeGroup)
+	}
+	topo, err = c.fetchTopo(ctx, c.getTopoFetcher(), recoveryType, nodeCnt)
+	for i := 0; i < len(c.failoverFetchers) && (err != nil || len(topo) == 0) && ctx.Err() == nil; i++ {
+		logutil.BgLogger().Warn("AutoScaler cannot provide topo, try the next topo fetcher",
+			zap.Int("failoverIdx", i), zap.Int("topoLen", len(topo)), zap.Error(err))
+		topo, err = c.fetchTopo(ctx, c.failoverFetchers[i], recoveryType, nodeCnt)
+	}
+	// err may be annotated by fetchTopo, like waiting for the abandoned call.
+	if ctx.Err() != nil && isContextDoneErr(err) {
+		return nil, false, err
+	}
+	c.onFetched(err)
+	return topo, false, err
+}
+
+// fetchTopo calls fetcher to recovery, it returns the error caused by ctx.Err() when ctx is done before fetcher responds.
+func (c *autoScalerCaller) fetchTopo(ctx context.Context, fetcher tiflashcompute.TopoFetcher, recoveryType tiflashcompute.RecoveryType, nodeCnt int) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.abandoned != nil {
+		select {
+		case <-c.abandoned:
+			c.abandoned = nil
+		case <-ctx.Done():
+			return nil, errors.Annotate(ctx.Err(), "wait for the abandoned AutoScaler call")
+		}
+	}
+	if c.rateGate != nil {
+		if wait := c.rateGate.reserve(); wait > 0 {
+			select {
+			case <-c.afterFunc(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	if ctx.Done() == nil {
+		return callFetcher(fetcher, recoveryType, nodeCnt, c.correlationID)
+	}
+
+	// TopoFetcher doesn't support context, so call it in another goroutine.
+	resCh := make(chan fetchResult, 1)
+	correlationID := c.correlationID
+	go func() {
+		topo, err := callFetcher(fetcher, recoveryType, nodeCnt, correlationID)
+		resCh <- fetchResult{topo: topo, err: err}
+	}()
+	select {
+	case res := <-resCh:
+		return res.topo, res.err
+	case <-ctx.Done():
+		c.abandoned = resCh
+		return nil, ctx.Err()
+	}
+}
+
+type fetchResult struct {
+	topo []string
+	err  error
+}
@@ -0,0 +1,323 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import (
+	"context"
+	goerrors "errors"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+)
+
+// RecoveryErrorCategory is the category of mpp err.
+type RecoveryErrorCategory uint32
+
+const (
+	// CategoryUnknown means the mpp err cannot be classified.
+	CategoryUnknown RecoveryErrorCategory = iota
+	// CategoryNetwork means the mpp err is caused by network problem.
+	CategoryNetwork
+	// CategoryMemLimit means the mpp err is caused by exceeding memory limit of TiFlash.
+	CategoryMemLimit
+	// CategoryExchangeReceiver means the data stream between MPP tasks is broken.
+	CategoryExchangeReceiver
+	// CategoryReplicaUnavailable means the TiFlash replica of the table isn't ready or available.
+	CategoryReplicaUnavailable
+	// CategoryStaleSnapshot means the read TS of the statement is stale, like it's older than GC safe point.
+	CategoryStaleSnapshot
+)
+
+// String implements fmt.Stringer interface.
+func (c RecoveryErrorCategory) String() string {
+	switch c {
+	case CategoryNetwork:
+		return "Network"
+	case CategoryMemLimit:
+		return "MemLimit"
+	case CategoryExchangeReceiver:
+		return "ExchangeReceiver"
+	case CategoryReplicaUnavailable:
+		return "ReplicaUnavailable"
+	case CategoryStaleSnapshot:
+		return "StaleSnapshot"
+	default:
+		return "Unknown"
+	}
+}
+
+// memLimitFatalErrPatterns are in lower case. They are the mem limit errs that rescale cannot help,
+// like a single row exceeds memory limit of any node.
+var memLimitFatalErrPatterns = []string{
+	"single row",
+	"row is too large",
+	"row size is too large",
+}
+
+// replicaUnavailableErrPatterns are in lower case.
+var replicaUnavailableErrPatterns = []string{
+	"tiflash replica is not available",
+	"tiflash replica unavailable",
+	"tiflash replica is not ready",
+}
+
+// staleSnapshotErrPatterns are in lower case.
+var staleSnapshotErrPatterns = []string{
+	"gc safe point",
+	"gc safepoint",
+	"gc life time is shorter than transaction duration",
+	"read ts is stale",
+}
+
+// exchangeReceiverErrPatterns are in lower case.
+var exchangeReceiverErrPatterns = []string{
+	"exchange receiver",
+	"exchangereceiver",
+}
+
+var networkErrPatterns = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"transport is closing",
+}
+
+// defaultCategorySeverity is used to decide the dominant cause of a multi-error.
+// The bigger the value, the more severe the category.
+// Exchange receiver err is usually caused by the failure of other MPP tasks, so it's less severe than memory limit.
+var defaultCategorySeverity = map[RecoveryErrorCategory]int{
+	CategoryUnknown:            0,
+	CategoryNetwork:            1,
+	CategoryExchangeReceiver:   2,
+	CategoryReplicaUnavailable: 3,
+	CategoryStaleSnapshot:      4,
+	CategoryMemLimit:           5,
+}
+
+// isContextDoneErr returns true if context.Canceled or context.DeadlineExceeded is in the chain of err.
+func isContextDoneErr(err error) bool {
+	return goerrors.Is(err, context.Canceled) || goerrors.Is(err, context.DeadlineExceeded)
+}
+
+// ClassifierPlugin contributes error-to-category mappings, like a catalog of TiFlash error signatures maintained
+// by operators, so classification can be updated without recompiling TiDB.
+type ClassifierPlugin interface {
+	// Classify returns the category of a single (not joined) error, ok is false if the plugin doesn't know err.
+	// It's called on hot path of recovery, and must be safe for concurrent use.
+	Classify(err error) (category RecoveryErrorCategory, ok bool)
+}
+
+var classifierPlugins struct {
+	sync.RWMutex
+	plugins []ClassifierPlugin
+}
+
+// RegisterClassifier registers plugin for all RecoveryHandlers. Plugins are consulted in registration order before
+// the built-in matchers, and the first plugin that knows the error decides its category.
+func RegisterClassifier(plugin ClassifierPlugin) {
+	classifierPlugins.Lock()
+	defer classifierPlugins.Unlock()
+	classifierPlugins.plugins = append(classifierPlugins.plugins, plugin)
+}
+
+// UnregisterClassifier removes plugin registered by RegisterClassifier(), like when the catalog is reloaded.
+// It does nothing if plugin isn't registered.
+func UnregisterClassifier(plugin ClassifierPlugin) {
+	classifierPlugins.Lock()
+	defer classifierPlugins.Unlock()
+	if i := slices.Index(classifierPlugins.plugins, plugin); i >= 0 {
+		classifierPlugins.plugins = slices.Delete(classifierPlugins.plugins, i, i+1)
+	}
+}
+
+// classifyByPlugins returns the category decided by registered plugins, ok is false if no plugin knows err.
+func classifyByPlugins(err error) (category RecoveryErrorCategory, ok bool) {
+	classifierPlugins.RLock()
+	defer classifierPlugins.RUnlock()
+	for _, plugin := range classifierPlugins.plugins {
+		if category, ok = plugin.Classify(err); ok {
+			return category, true
+		}
+	}
+	return CategoryUnknown, false
+}
+
+// classifyLeafErr returns the category of a single (not joined) error.
+func classifyLeafErr(err error) RecoveryErrorCategory {
+	if category, ok := classifyByPlugins(err); ok {
+		return category
+	}
+	for _, matcher := range categoryMatchers {
+		if searchCauseChain(err, matcher.match) {
+			return matcher.category
+		}
+	}
+	return CategoryUnknown
+}
+
+// categoryMatchers are checked in order, and the first category that matches any layer of the cause chain wins.
+var categoryMatchers = []struct {
+	category RecoveryErrorCategory
+	match    func(msg string) bool
+}{
+	{CategoryMemLimit, func(msg string) bool { return strings.Contains(msg, memLimitErrPattern) }},
+	// Check it before exchange receiver, because it may be reported by exchange receiver of other MPP tasks.
+	{CategoryReplicaUnavailable, func(msg string) bool { return containsAnyFold(msg, replicaUnavailableErrPatterns) }},
+	{CategoryStaleSnapshot, func(msg string) bool { return containsAnyFold(msg, staleSnapshotErrPatterns) }},
+	{CategoryExchangeReceiver, func(msg string) bool { return containsAnyFold(msg, exchangeReceiverErrPatterns) }},
+	{CategoryNetwork, func(msg string) bool { return containsAny(msg, networkErrPatterns) }},
+}
+
+// maxCauseChainDepth bounds the walk of cause chain, in case of a cyclic chain.
+const maxCauseChainDepth = 64
+
+// searchCauseChain reports whether the message of any layer in the cause chain of err matches. Errors are often
+// wrapped by several distsql and executor layers, and a layer may replace the message of its cause, so matching
+// only the top-level message is not enough. Both Unwrap() of standard errors and Cause() of pingcap/errors are
+// followed, Unwrap() takes precedence if an error implements both.
+func searchCauseChain(err error, match func(msg string) bool) bool {
+	for depth := 0; err != nil && depth < maxCauseChainDepth; depth++ {
+		if match(err.Error()) {
+			return true
+		}
+		if next := goerrors.Unwrap(err); next != nil {
+			err = next
+		} else if next := errors.Unwrap(err); next != nil && next != err {
+			err = next
+		} else {
+			return false
+		}
+	}
+	return false
+}
+
+// containsAny reports whether any of patterns is within msg.
+func containsAny(msg string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAnyFold is like containsAny, but ignores ASCII case of msg. patterns must be in lower case.
+func containsAnyFold(msg string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if containsFold(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMemLimitFatalErr returns true if err is a mem limit err that rescale cannot help.
+func isMemLimitFatalErr(err error) bool {
+	if classifyLeafErr(err) != CategoryMemLimit {
+		return false
+	}
+	return searchCauseChain(err, func(msg string) bool { return containsAnyFold(msg, memLimitFatalErrPatterns) })
+}
+
+// containsFold reports whether lowerSubstr is within s, ignoring ASCII case of s. lowerSubstr must be in lower case.
+// Unlike strings.ToLower, it doesn't allocate.
+func containsFold(s, lowerSubstr string) bool {
+	n := len(lowerSubstr)
+	for i := 0; i+n <= len(s); i++ {
+		j := 0
+		for ; j < n; j++ {
+			c := s[i+j]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c != lowerSubstr[j] {
+				break
+			}
+		}
+		if j == n {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeErrMsg returns the error message with consecutive white spaces collapsed.
+func normalizeErrMsg(err error) string {
+	return strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// appendLeafErrs expands err into its leaf errors, and appends them with their categories to dst.
+// Errors joined by errors.Join() or multierr are expanded recursively, even if they
+// are wrapped by other errors. Otherwise err itself is the only leaf, so is a multi-error without non-nil errors.
+func appendLeafErrs(dst []classifiedErr, err error) []classifiedErr {
+	for e := err; e != nil; e = goerrors.Unwrap(e) {
+		multi, ok := e.(interface{ Unwrap() []error })
+		if !ok {
+			continue
+		}
+		start := len(dst)
+		for _, sub := range multi.Unwrap() {
+			if sub != nil {
+				dst = appendLeafErrs(dst, sub)
+			}
+		}
+		if len(dst) > start {
+			return dst
+		}
+		break
+	}
+	return append(dst, classifiedErr{err: err, category: classifyLeafErr(err)})
+}
+
+type classifiedErr struct {
+	err      error
+	category RecoveryErrorCategory
+}
+
+// classifyErr expands mppErr into leaf errors and orders them by precedence:
+//  1. The leaf whose category is more severe comes first, see defaultCategorySeverity and SetCategorySeverity().
+//  2. Leaves of the same severity keep their original order in mppErr.
+//
+// Recovery tries leaves in this order and uses the first handler that accepts a leaf,
+// so the most severe cause decides how to recovery a multi-error.
+func classifyErr(mppErr error, severity map[RecoveryErrorCategory]int) []classifiedErr {
+	return appendClassifiedErrs(nil, mppErr, severity)
+}
+
+// Classify returns the category of the most severe cause of err with default severity, without a RecoveryHandler.
+// It's what LastClassification() of RecoveryHandler reports for err, unless the handler changes the precedence of
+// causes by SetCategorySeverity() or SetCategoryEnabled(), or the handler of the most severe cause declines, like
+// AutoScaler is unavailable. So external logging code can classify an already returned err consistently.
+func Classify(err error) RecoveryErrorCategory {
+	if err == nil {
+		return CategoryUnknown
+	}
+	return classifyErr(err, defaultCategorySeverity)[0].category
+}
+
+// appendClassifiedErrs is like classifyErr, but appends the result to dst, so the caller can reuse the buffer.
+func appendClassifiedErrs(dst []classifiedErr, mppErr error, severity map[RecoveryErrorCategory]int) []classifiedErr {
+	start := len(dst)
+	dst = appendLeafErrs(dst, mppErr)
+	if res := dst[start:]; len(res) > 1 {
+		sort.SliceStable(res, func(i, j int) bool {
+			return severity[res[i].category] > severity[res[j].category]
+		})
+	}
+	return dst
+}
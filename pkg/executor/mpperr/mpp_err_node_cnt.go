@@ -0,0 +1,155 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import (
+	"math"
+	"math/rand"
+)
+
+// HoldProgress describes how many results are held when the mpp err occurs.
+type HoldProgress struct {
+	HeldRows  uint64
+	HeldBytes int64
+	// Capacity is the max rows the holder can hold.
+	Capacity uint64
+}
+
+// NodeCntPolicy computes the node count requested from AutoScaler when recovery.
+type NodeCntPolicy func(info *RecoveryInfo, progress HoldProgress) int
+
+// DefaultNodeCntPolicy requests the same node count as the original dispatch.
+func DefaultNodeCntPolicy(info *RecoveryInfo, _ HoldProgress) int {
+	return info.NodeCnt
+}
+
+// NewProgressWeightedNodeCntPolicy returns a NodeCntPolicy that reduces the requested node count
+// proportional to the progress made, which is held rows divided by capacity of holder.
+// Because the more results are held, the less work remains.
+// minRatio is the lower bound of the reduced ratio, and at least 1 node is requested.
+func NewProgressWeightedNodeCntPolicy(minRatio float64) NodeCntPolicy {
+	return func(info *RecoveryInfo, progress HoldProgress) int {
+		if info.NodeCnt <= 0 || progress.Capacity == 0 {
+			return info.NodeCnt
+		}
+		ratio := 1 - float64(progress.HeldRows)/float64(progress.Capacity)
+		ratio = math.Min(1, math.Max(ratio, minRatio))
+		nodeCnt := int(math.Ceil(float64(info.NodeCnt) * ratio))
+		if nodeCnt < 1 {
+			nodeCnt = 1
+		}
+		return nodeCnt
+	}
+}
+
+// SetNodeCntPolicy sets the policy to compute the node count requested from AutoScaler.
+func (m *RecoveryHandler) SetNodeCntPolicy(policy NodeCntPolicy) {
+	m.nodeCntPolicy = policy
+}
+
+func (m *RecoveryHandler) holdProgress() HoldProgress {
+	stats := m.resultHolder.Stats()
+	return HoldProgress{
+		HeldRows:  stats.NumRows,
+		HeldBytes: stats.MemUsage,
+		Capacity:  stats.Capacity,
+	}
+}
+
+// SetDefaultNodeCnt sets the node cnt used when RecoveryInfo.NodeCnt is unknown(<= 0), like a configured constant
+// or the last known topo size. Recovery fails with ErrUnknownNodeCnt if NodeCnt is unknown and no default is set,
+// unless the chosen handler doesn't call AutoScaler, like re-dispatching for exchange receiver errs.
+func (m *RecoveryHandler) SetDefaultNodeCnt(nodeCnt int) {
+	m.defaultNodeCnt = nodeCnt
+}
+
+// SetMaxCumulativeNodeCnt sets the budget of total node cnt requested by recoveries in a statement, which bounds
+// the blast radius of repeated rescales. The node cnt requested from AutoScaler is counted, recoveries that only
+// re-dispatch MPP tasks are not limited by it. 0 means no limit.
+func (m *RecoveryHandler) SetMaxCumulativeNodeCnt(maxNodeCnt int) {
+	m.maxCumulativeNodeCnt = maxNodeCnt
+}
+
+// SetNodeCntJitter adds a random jitter in [0, maxJitter] to the node count computed by NodeCntPolicy,
+// which avoids many queries requesting the same node count at the same time.
+// The jitter is drawn from the rand source of RecoveryHandler, see SetRandSource().
+func (m *RecoveryHandler) SetNodeCntJitter(maxJitter int) {
+	m.nodeCntJitter = maxJitter
+}
+
+// SetRandSource sets the rand source used by all randomized behaviors of RecoveryHandler.
+// A time seeded source is used by default.
+func (m *RecoveryHandler) SetRandSource(src rand.Source) {
+	m.rand = rand.New(src)
+}
+
+// withDefaultNodeCnt returns info with the default node cnt if RecoveryInfo.NodeCnt is unknown, info of caller is not
+// modified. ok is false if NodeCnt is unknown and no default is set.
+func (m *RecoveryHandler) withDefaultNodeCnt(info *RecoveryInfo) (_ *RecoveryInfo, ok bool) {
+	if info.NodeCnt > 0 {
+		return info, true
+	}
+	if m.defaultNodeCnt <= 0 {
+		return info, false
+	}
+	infoWithNodeCnt := *info
+	infoWithNodeCnt.NodeCnt = m.defaultNodeCnt
+	return &infoWithNodeCnt, true
+}
+
+func (m *RecoveryHandler) computeNodeCnt(info *RecoveryInfo) int {
+	nodeCnt := m.nodeCntPolicy(info, m.holdProgress())
+	if m.nodeCntJitter > 0 && nodeCnt > 0 {
+		nodeCnt += m.rand.Intn(m.nodeCntJitter + 1)
+	}
+	return nodeCnt
+}
+
+// RecoveryCostEstimate is the estimated cost of recovery.
+type RecoveryCostEstimate struct {
+	// NodeCnt is the node count that would be requested from AutoScaler, computed by NodeCntPolicy like Recovery,
+	// with the default node cnt if RecoveryInfo.NodeCnt is unknown. The max jitter is added if SetNodeCntJitter()
+	// is set, because the jitter isn't drawn to keep the estimate free of side effect.
+	NodeCnt int
+	// Attempt is the recovery count if recovery is attempted.
+	Attempt uint32
+	// Exhausted is true when no more recovery can be attempted, by maxRecoveryCnt or the shared budget.
+	Exhausted bool
+	// Score is a heuristic cost, the bigger the more expensive:
+	//   NodeCnt * Attempt * (1 + HeldRows / Capacity)
+	// Because held results are discarded and computed again after recovery.
+	Score float64
+}
+
+// EstimateRecoveryCost estimates the cost of recovery without any side effect.
+func (m *RecoveryHandler) EstimateRecoveryCost(info *RecoveryInfo) RecoveryCostEstimate {
+	progress := m.holdProgress()
+	info, _ = m.withDefaultNodeCnt(info)
+	nodeCnt := m.nodeCntPolicy(info, progress)
+	if m.nodeCntJitter > 0 && nodeCnt > 0 {
+		nodeCnt += m.nodeCntJitter
+	}
+	estimate := RecoveryCostEstimate{
+		NodeCnt:   nodeCnt,
+		Attempt:   m.curRecoveryCnt + 1,
+		Exhausted: m.curRecoveryCnt >= m.maxRecoveryCnt || (m.sharedBudget != nil && m.sharedBudget.Load() == 0),
+	}
+	heldRatio := float64(0)
+	if progress.Capacity > 0 {
+		heldRatio = float64(progress.HeldRows) / float64(progress.Capacity)
+	}
+	estimate.Score = float64(nodeCnt) * float64(estimate.Attempt) * (1 + heldRatio)
+	return estimate
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// ErrCategoryRateLimited is returned when recoveries of the mpp err category are rate limited.
+var ErrCategoryRateLimited = errors.New("mpp err recovery of the category is rate limited")
+
+// ErrTooFrequent is returned when the mpp err category occurs too frequently within the sliding window,
+// which is likely unrecoverable.
+var ErrTooFrequent = errors.New("mpp err of the category is too frequent to recovery")
+
+// CategoryRateLimiter limits recoveries per error category with token buckets, which suppresses recovery storms
+// when a category fires across many queries, like a cluster-wide incident.
+// It's safe for concurrent use, so it can be shared by RecoveryHandlers of different queries.
+type CategoryRateLimiter struct {
+	// ratePerSec is the number of tokens refilled per second for each category.
+	ratePerSec float64
+	burst      float64
+	// nowFunc is used to get current time, can be replaced in test.
+	nowFunc func() time.Time
+
+	mu struct {
+		sync.Mutex
+		buckets map[RecoveryErrorCategory]*tokenBucket
+	}
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewCategoryRateLimiter returns new instance of CategoryRateLimiter.
+// Each category allows burst recoveries at most, and refills ratePerSec tokens per second.
+func NewCategoryRateLimiter(ratePerSec float64, burst int) *CategoryRateLimiter {
+	l := &CategoryRateLimiter{
+		ratePerSec: ratePerSec,
+		burst:      float64(burst),
+		nowFunc:    time.Now,
+	}
+	l.mu.buckets = make(map[RecoveryErrorCategory]*tokenBucket)
+	return l
+}
+
+// allow returns true and takes a token if a recovery of category is allowed now.
+func (l *CategoryRateLimiter) allow(category RecoveryErrorCategory) bool {
+	now := l.nowFunc()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.mu.buckets[category]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, lastRefill: now}
+		l.mu.buckets[category] = b
+	} else if elapsed := now.Sub(b.lastRefill); elapsed > 0 {
+		b.tokens = min(l.burst, b.tokens+elapsed.Seconds()*l.ratePerSec)
+		b.lastRefill = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// errFrequencyTracker tracks occurrences of each error category within a sliding window.
+// Unlike CategoryRateLimiter, it belongs to one RecoveryHandler, so it's not protected by mutex.
+type errFrequencyTracker struct {
+	window    time.Duration
+	threshold int
+	// occurrences are the times of occurrences within window in ascending order, at most threshold+1 are kept.
+	occurrences map[RecoveryErrorCategory][]time.Time
+}
+
+func newErrFrequencyTracker(window time.Duration, threshold int) *errFrequencyTracker {
+	return &errFrequencyTracker{
+		window:      window,
+		threshold:   threshold,
+		occurrences: make(map[RecoveryErrorCategory][]time.Time),
+	}
+}
+
+// record records an occurrence of category at now, returns false if occurrences within window exceed threshold.
+func (t *errFrequencyTracker) record(category RecoveryErrorCategory, now time.Time) bool {
+	occurrences := t.occurrences[category]
+	expired := 0
+	for expired < len(occurrences) && now.Sub(occurrences[expired]) >= t.window {
+		expired++
+	}
+	occurrences = append(occurrences[expired:], now)
+	if len(occurrences) > t.threshold+1 {
+		occurrences = occurrences[len(occurrences)-t.threshold-1:]
+	}
+	t.occurrences[category] = occurrences
+	return len(occurrences) <= t.threshold
+}
+
+// exceeded returns whether recording an occurrence of category at now would exceed threshold, it records nothing.
+func (t *errFrequencyTracker) exceeded(category RecoveryErrorCategory, now time.Time) bool {
+	inWindow := 0
+	for _, occurrence := range t.occurrences[category] {
+		if now.Sub(occurrence) < t.window {
+			inWindow++
+		}
+	}
+	return inWindow >= t.threshold
+}
+
+func (t *errFrequencyTracker) reset() {
+	t.occurrences = make(map[RecoveryErrorCategory][]time.Time)
+}
@@ -15,22 +15,307 @@
 package mpperr
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"maps"
+	"math/rand"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util"
 	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/logutil"
 	"github.com/pingcap/tidb/pkg/util/memory"
+	"github.com/pingcap/tidb/pkg/util/sqlkiller"
 	"github.com/pingcap/tidb/pkg/util/tiflashcompute"
+	"go.uber.org/zap"
 )
 
 // RecoveryHandler tries to recovery mpp error.
 type RecoveryHandler struct {
-	enable   bool
-	handlers []handlerImpl
-	holder   *mppResultHolder
+	enable        bool
+	useAutoScaler bool
+	handlers      []handlerImpl
+	fallback      handlerImpl
+	// decider overrides handler selection if it's not nil.
+	decider RecoveryDecider
+	// holder is the default ResultHolder. Features that inspect held chunks, like spilling, only work with it.
+	holder *mppResultHolder
+	// resultHolder is the holder that core methods delegate to, it's holder unless a custom one is set.
+	resultHolder ResultHolder
+	// chkPool is nil if popped chunks are not returned to pool.
+	chkPool     ChunkPool
+	chkPoolFTps []*types.FieldType
+
+	autoScaler    *autoScalerCaller
+	nodeCntPolicy NodeCntPolicy
+	nodeCntJitter int
+	// innerRetryCnt is the number of AutoScaler calls retried inside recoveries in this statement, which are not
+	// counted by curRecoveryCnt.
+	innerRetryCnt uint64
+	// cumulativeNodeCnt is the total node cnt requested by recoveries in this statement.
+	cumulativeNodeCnt    int
+	maxCumulativeNodeCnt int
+	// defaultNodeCnt is used when RecoveryInfo.NodeCnt is unknown, 0 means no default.
+	defaultNodeCnt int
+	// rand is used by all randomized behaviors, can be replaced by SetRandSource().
+	rand *rand.Rand
 
 	curRecoveryCnt uint32
 	maxRecoveryCnt uint32
+	// lifetimeRecoveryCnt is the recovery count across statements, only reset by ResetAll() or Close().
+	lifetimeRecoveryCnt uint64
+	// aggregator accumulates the activity of handlers cloned from the same template, nil if not set.
+	aggregator *RecoveryMetricsAggregator
+
+	// mu protects cumulative counters, which can be drained by metrics exporters in another goroutine.
+	mu struct {
+		sync.Mutex
+		// exhaustedCnt is the number of recoveries refused because maxRecoveryCnt is reached.
+		exhaustedCnt uint64
+		// wouldHaveRecoveredCnt is the number of mpp errs that have a handler to recovery when recovery is disabled.
+		wouldHaveRecoveredCnt uint64
+		// droppedChkCnt is the number of chunks that are not held because holder cannot hold anymore.
+		droppedChkCnt uint64
+		// skippedChkCnt is the number of chunks that are not held because of minChunkRowsToHold or shouldStartHolding.
+		skippedChkCnt uint64
+		// handlerRecoveryCnt is the recovery count of each handler.
+		handlerRecoveryCnt map[string]uint32
+		// storeRecoveryCnt is the recovery count of each TiFlash store.
+		storeRecoveryCnt map[string]uint32
+		// fragmentRecoveryCnt is the recovery count of each plan fragment.
+		fragmentRecoveryCnt map[uint64]uint32
+		// countersMemUsage is the memory of counter maps consumed by obsMemTracker.
+		countersMemUsage int64
+	}
+	// published is the snapshot of states owned by the executor goroutine, like recovery count and held chunks,
+	// which is refreshed by publishStats() after they are changed. Stats() only reads it, so it's safe to call
+	// Stats() from another goroutine while the executor is holding results or recovering.
+	published struct {
+		recoveryCnt         atomic.Uint32
+		innerRetryCnt       atomic.Uint64
+		lifetimeRecoveryCnt atomic.Uint64
+		heldChunks          atomic.Int64
+		heldRows            atomic.Uint64
+		offeredRows         atomic.Uint64
+		spilledChunks       atomic.Int64
+	}
+
+	// contextErrRecoverable is true when the mpp err caused by context.Canceled or context.DeadlineExceeded
+	// is still tried to recovery.
+	contextErrRecoverable bool
+	// staleSnapshotRecovery is true when errs caused by stale read TS are recovered by refreshing the snapshot.
+	staleSnapshotRecovery bool
+
+	// minChunkRowsToHold is the min rows of chunk to hold, chunks with less rows are skipped. 0 means no limit.
+	minChunkRowsToHold int
+	// skipLogRate is the sample rate of logging chunks not held by HoldResult(), 0 means no log.
+	skipLogRate float64
+	// logSkip logs why chk is not held, can be replaced in test.
+	logSkip func(reason cannotHoldReason, chk *chunk.Chunk)
+	// fieldTypes is the schema of held chunks, used to serialize them.
+	fieldTypes []*types.FieldType
+	// onHoldChunk is called for each held chunk, see OnHoldChunk().
+	onHoldChunk func(chk *chunk.Chunk)
+
+	disabledCategories map[RecoveryErrorCategory]struct{}
+	// failureThresholds are the consecutive failed statements to disable each category, see
+	// SetConsecutiveFailureThreshold(). consecutiveFailures, stmtFailedCategories and autoDisabledCategories are
+	// only allocated if it's set.
+	failureThresholds      map[RecoveryErrorCategory]int
+	consecutiveFailures    map[RecoveryErrorCategory]int
+	stmtFailedCategories   map[RecoveryErrorCategory]struct{}
+	autoDisabledCategories map[RecoveryErrorCategory]struct{}
+	// categorySeverity decides the dominant cause of a multi-error, see SetCategorySeverity().
+	categorySeverity map[RecoveryErrorCategory]int
+	// causesBuf is reused by chooseHandler to avoid allocation.
+	causesBuf []classifiedErr
+	// recoveredCategories is the set of categories recovered in this statement.
+	recoveredCategories   map[RecoveryErrorCategory]struct{}
+	maxDistinctCategories int
+	rateLimiter           *CategoryRateLimiter
+	// errFrequency is nil if frequency of mpp err is not limited.
+	errFrequency *errFrequencyTracker
+	quota        Quota
+	// sharedBudget is the recovery budget shared with other handlers or statement retries, nil if not set.
+	sharedBudget *atomic.Uint32
+
+	handlerTimeout time.Duration
+	// categoryTimeouts override handlerTimeout for each category, see SetCategoryTimeouts().
+	categoryTimeouts map[RecoveryErrorCategory]time.Duration
+	// replicaWait is the duration to wait before re-dispatch when TiFlash replica is unavailable.
+	replicaWait time.Duration
+	// autoResetOnRecovery is true if the holder is reset automatically after a successful recovery.
+	autoResetOnRecovery bool
+
+	// exhaustCooldown is the duration that holding is suppressed after recovery is exhausted, 0 means no cooldown.
+	exhaustCooldown time.Duration
+	// exhaustedTime is the last time that recovery is exhausted.
+	exhaustedTime time.Time
+	// stmtExhausted is true if recovery is exhausted in this statement.
+	stmtExhausted bool
+	// stmtStartTime is the time of the first HoldResult or Recovery call of this statement.
+	stmtStartTime time.Time
+	// firstRecoveryTime is the time of the first recovery attempt of this statement.
+	firstRecoveryTime time.Time
+	// maxHoldAge is the max age of the oldest held chunk, holding stops once it's exceeded. 0 means no limit.
+	maxHoldAge time.Duration
+
+	// resultsStreamed is true when the caller has begun streaming final results to the client.
+	// Holding and recovery are disabled until the next statement, unless in streaming window mode.
+	resultsStreamed bool
+	// streamingWindow is the max rows held after results begin streaming, 0 if streaming window mode is disabled.
+	streamingWindow uint64
+	// streamedRows is the rows streamed to client in streaming window mode in this statement.
+	streamedRows uint64
+	// orderSensitive is true if the results must be re-streamed in the original order after recovery, see
+	// SetOrderSensitive(). It's true by default.
+	orderSensitive bool
+
+	// capacityTuning is nil if holder capacity is not tuned across statements, see SetCapacityTuning().
+	capacityTuning *CapacityTuning
+	// stmtCapacityShort is true if recovery is called after holder stopped holding due to capacity in this statement.
+	stmtCapacityShort bool
+	// stmtMemPressure is true if memory of parent tracker is under pressure while holding in this statement.
+	stmtMemPressure bool
+
+	// partialOnDisabled is true if held rows are returned as partial results when recovery is disabled.
+	partialOnDisabled bool
+	// partialReturned is true if held rows are returned as partial results in this statement.
+	partialReturned bool
+
+	// shouldStartHolding decides when holding begins in a statement, see SetShouldStartHolding().
+	shouldStartHolding func(stats RecoveryStats) bool
+	// holdingStarted is true once shouldStartHolding returns true in this statement.
+	holdingStarted bool
+	// offeredRows is the rows passed to HoldResult() in this statement.
+	offeredRows uint64
+	// estimatedRows is the estimated total rows of results in this statement, 0 if unknown.
+	estimatedRows uint64
+	// maxEstimateRatio is the max ratio of estimatedRows to capacity, holding is skipped if it's exceeded.
+	// 0 means no limit.
+	maxEstimateRatio float64
+
+	// inRecovery is true when Recovery is running, it's only modified with flight locked.
+	inRecovery atomic.Bool
+	// inUserCallback is true when the user defined handler or decider is called by the running Recovery.
+	// Calls during it are refused as reentrant, even with another ctx, because waiting for the running Recovery
+	// would deadlock if the call comes from the callback.
+	inUserCallback atomic.Bool
+	// concurrentPolicy decides how concurrent Recovery calls are handled, see SetConcurrentRecoveryPolicy().
+	concurrentPolicy ConcurrentRecoveryPolicy
+	// flight is the outcome of the last finished Recovery, which is observed by coalesced calls.
+	flight struct {
+		sync.Mutex
+		cond *sync.Cond
+		// gen is increased when a Recovery finishes.
+		gen uint64
+		// waiters is the number of calls waiting for the running Recovery.
+		waiters int
+		res     RecoveryResult
+		err     error
+	}
+	// asyncInFlight is true when the recovery started by RecoveryAsync() hasn't delivered the result.
+	asyncInFlight atomic.Bool
+
+	events []RecoveryEvent
+	// eventsMemUsage is the memory of events consumed by obsMemTracker.
+	eventsMemUsage int64
+	// obsMemTracker tracks the memory of observability structures like events and counters, it's a child of parent.
+	obsMemTracker *memory.Tracker
+	// maxEvents and evictionPolicy decide how events are dropped, see SetEventRetention().
+	maxEvents      int
+	evictionPolicy EvictionPolicy
+	// lastClassification is the decision of the most recent Recovery call.
+	lastClassification recoveryClassification
+	// eventLabels are attached to each recorded event, it's never modified after set.
+	eventLabels map[string]string
+	// correlationID is attached to events, logs and decisions, see SetCorrelationID().
+	correlationID string
+	// observabilityDisabled is true if events, counters and decision sink are disabled.
+	observabilityDisabled bool
+	// decisionSink is written a JSON line for each Recovery call if it's not nil.
+	decisionSink io.Writer
+	// maxStateSize is the max bytes of MarshalState() output, 0 means no limit.
+	maxStateSize int
+
+	// firstRecoveryGrace is the delay before the first recovery attempt, 0 means no delay.
+	firstRecoveryGrace time.Duration
+
+	// simulationEnabled is true if SimulateRecovery() is allowed, see WithRecoverySimulation().
+	simulationEnabled bool
+
+	// nowFunc is used to get current time, can be replaced in test.
+	nowFunc func() time.Time
+	// afterFunc is used to wait for a duration, can be replaced in test.
+	afterFunc func(d time.Duration) <-chan time.Time
+}
+
+// RecoveryAction tells the caller what to do after recovery succeeds.
+type RecoveryAction int
+
+const (
+	// RecoveryActionRescale means AutoScaler has rescaled TiFlash, re-dispatch MPP tasks to the new topo.
+	RecoveryActionRescale RecoveryAction = iota
+	// RecoveryActionRedispatch means re-dispatch MPP tasks without rescale.
+	RecoveryActionRedispatch
+	// RecoveryActionFlushPrefixThenResume means the re-dispatched MPP tasks resume from RecoveryInfo.ResumeOffset,
+	// so the held rows before it, whose count is RecoveryResult.PrefixRows, must be flushed to client first.
+	// Held chunks are truncated to the prefix, the caller should pop all of them by PopFrontChk() and then resume.
+	// TiFlash may have been rescaled before, which is told by RecoveryResult.RequestedNodeCnt.
+	RecoveryActionFlushPrefixThenResume
+	// RecoveryActionReturnPartialWithWarning means recovery is disabled, but held rows, whose count is
+	// RecoveryResult.PartialRows, are returned as best-effort results instead of failing the query. The caller should
+	// pop all of them by PopFrontChk(), append RecoveryResult.Warning to the warnings of statement and then finish.
+	// See SetPartialResultsOnDisabled().
+	RecoveryActionReturnPartialWithWarning
+	// RecoveryActionRefreshSnapshotAndRetry means the read TS of the statement is stale, the caller should refresh
+	// the read TS and then re-dispatch MPP tasks without rescale. Held rows are read with the stale snapshot, so
+	// they should be dropped by ResetHolder() before re-dispatching.
+	RecoveryActionRefreshSnapshotAndRetry
+)
+
+// String implements fmt.Stringer interface.
+func (a RecoveryAction) String() string {
+	switch a {
+	case RecoveryActionRescale:
+		return "Rescale"
+	case RecoveryActionRedispatch:
+		return "Redispatch"
+	case RecoveryActionFlushPrefixThenResume:
+		return "FlushPrefixThenResume"
+	case RecoveryActionReturnPartialWithWarning:
+		return "ReturnPartialWithWarning"
+	case RecoveryActionRefreshSnapshotAndRetry:
+		return "RefreshSnapshotAndRetry"
+	default:
+		return "Unknown"
+	}
+}
+
+// RecoveryResult is the result of a succeeded recovery.
+type RecoveryResult struct {
+	Action RecoveryAction
+	// RequestedNodeCnt is the node cnt requested from AutoScaler, 0 if AutoScaler isn't called.
+	RequestedNodeCnt int
+	// StreamedRows is the rows already streamed to client in streaming window mode, which the caller must skip
+	// from the re-dispatched results. See SetStreamingWindow().
+	StreamedRows uint64
+	// PrefixRows is the held rows that must be flushed to client before resuming,
+	// only set for RecoveryActionFlushPrefixThenResume.
+	PrefixRows uint64
+	// PartialRows is the held rows returned as partial results, only set for RecoveryActionReturnPartialWithWarning.
+	PartialRows uint64
+	// Warning wraps the mpp err and tells results are partial, only set for RecoveryActionReturnPartialWithWarning.
+	Warning error
 }
 
 // RecoveryInfo contains info that can help recovery error.
@@ -39,21 +324,250 @@ type RecoveryInfo struct {
 
 	// Nodes that involved into MPP computation.
 	NodeCnt int
+
+	// NodeGroup identifies the TiFlash node group that runs the MPP tasks.
+	// AutoScaler calls are throttled per node group if NodeGroupThrottler is set.
+	NodeGroup string
+
+	// StoreAddr is the address of TiFlash store that fails, empty if unknown.
+	// Recoveries are counted per store, which helps to spot a misbehaving TiFlash instance.
+	StoreAddr string
+
+	// FailedFragmentRatio is the ratio of failed MPP fragments in (0, 1], 0 if unknown.
+	FailedFragmentRatio float64
+
+	// ResumeOffset is the offset of result rows from which the re-dispatched MPP tasks resume, 0 means they resume
+	// from scratch. The offset counts rows streamed to client and then rows held. Held rows before it won't be
+	// produced again, so they are flushed by RecoveryActionFlushPrefixThenResume.
+	// It's ignored if the handler is not order sensitive, see SetOrderSensitive().
+	ResumeOffset uint64
+
+	// FragmentID is the ID of plan fragment that fails, 0 if unknown.
+	// Recoveries are counted per fragment, which helps to correlate recovery with EXPLAIN ANALYZE output.
+	FragmentID uint64
 }
 
 const (
 	memLimitErrPattern = "Memory limit"
 )
 
+// ErrNonRecoverable is returned when the mpp err is not recoverable, recovery count is not consumed.
+var ErrNonRecoverable = errors.New("mpp err is not recoverable")
+
+// ErrTooManyCategories is returned when too many distinct error categories are recovered in one statement.
+var ErrTooManyCategories = errors.New("too many distinct mpp err categories are recovered")
+
+// ErrHandlerTimeout is returned when the handler doesn't finish recovery in time.
+var ErrHandlerTimeout = errors.New("mpp err recovery handler timeout")
+
+// ErrRecoveryReentered is returned when Recovery is called again during recovery, like by a handler.
+var ErrRecoveryReentered = errors.New("mpp err recovery is reentered")
+
+// ErrRecoveryDisabled is returned when recovery is not enabled.
+var ErrRecoveryDisabled = errors.New("mpp err recovery is not enabled")
+
+// ErrRecoveryExhausted is returned when maxRecoveryCnt is reached.
+var ErrRecoveryExhausted = errors.New("exceeds max recovery cnt")
+
+// ErrResultsAlreadyStreamed is returned when the results have been streamed to the client, so re-dispatching
+// MPP tasks would produce duplicated results.
+var ErrResultsAlreadyStreamed = errors.New("mpp results have already been streamed")
+
+// ErrRecoveryInFlight is returned by Recovery and RecoveryAsync when an async recovery is in flight.
+var ErrRecoveryInFlight = errors.New("another async mpp err recovery is in flight")
+
+// ErrNodeCntBudgetExceeded is returned when the total node cnt requested by recoveries in a statement exceeds the budget.
+var ErrNodeCntBudgetExceeded = errors.New("total node cnt requested by mpp err recovery exceeds budget")
+
+// ErrResumeOffsetOutOfRange is returned when RecoveryInfo.ResumeOffset is beyond the held rows, so the rows in between
+// are lost. Recovery count is not consumed.
+var ErrResumeOffsetOutOfRange = errors.New("resume offset is beyond held rows")
+
+// ErrUnknownNodeCnt is returned when RecoveryInfo.NodeCnt is unknown and no default node cnt is configured,
+// but the chosen handler calls AutoScaler with it.
+var ErrUnknownNodeCnt = errors.New("node cnt of mpp err recovery is unknown")
+
+// ErrSpilledChunksHeld is returned when the spill backend is changed while held chunks are spilled to it.
+var ErrSpilledChunksHeld = errors.New("held chunks are spilled to the current spill backend")
+
+// ErrEmptyTopo is returned when AutoScaler recovery succeeds but returns empty topo.
+var ErrEmptyTopo = errors.New("AutoScaler returns empty topo after recovery")
+
+// Quota is a budget of recoveries provided by the caller, like a session-wide budget shared by multiple RecoveryHandlers.
+type Quota interface {
+	// Acquire takes a unit of quota before a recovery attempt. The implementation decides whether to block
+	// or to return an error when quota is exhausted.
+	Acquire(ctx context.Context) error
+	// Release returns the unit of quota after the recovery attempt.
+	Release()
+}
+
+// RecoveryHandlerOption is the optional config of NewRecoveryHandler.
+type RecoveryHandlerOption func(m *RecoveryHandler)
+
+// WithResultHolder replaces the default holder by a custom implementation, like an arena-backed one.
+// Features that inspect held chunks, like spilling, DumpHeldRows() and HeldRowsDigest(), only work with the default holder.
+func WithResultHolder(holder ResultHolder) RecoveryHandlerOption {
+	return func(m *RecoveryHandler) {
+		m.resultHolder = holder
+	}
+}
+
+// WithMaintenancePool makes the default holder spill chunks in background by pool, so HoldResult() isn't blocked by
+// the spill backend. The pool can be shared by handlers and is closed by its owner, the backend set by
+// SetSpillBackend() must be safe for concurrent use. Spills run synchronously when all goroutines of pool are busy.
+func WithMaintenancePool(pool *MaintenancePool) RecoveryHandlerOption {
+	return func(m *RecoveryHandler) {
+		m.holder.pool = pool
+	}
+}
+
+// ChunkPool is the pool that popped chunks are returned to, *chunk.Pool implements it.
+type ChunkPool interface {
+	PutChunk(fields []*types.FieldType, chk *chunk.Chunk)
+}
+
+var _ ChunkPool = &chunk.Pool{}
+
+// WithChunkPool makes chunks popped by PopFrontChkWithRelease() returned to pool when released.
+// fieldTypes are the types of held chunks, chunks with different number of columns are not returned.
+func WithChunkPool(pool ChunkPool, fieldTypes []*types.FieldType) RecoveryHandlerOption {
+	return func(m *RecoveryHandler) {
+		m.chkPool = pool
+		m.chkPoolFTps = fieldTypes
+	}
+}
+
+// WithQuota bounds recoveries by quota, which is acquired before each recovery attempt and released after.
+func WithQuota(quota Quota) RecoveryHandlerOption {
+	return func(m *RecoveryHandler) {
+		m.quota = quota
+	}
+}
+
+// WithSharedBudget makes each recovery consume one from budget, which can be shared with other handlers and
+// statement retries, so they jointly respect one overall budget. Recovery is exhausted when budget reaches zero,
+// in addition to maxRecoveryCnt. Budget is owned by caller, it's not refilled by ResetAll().
+func WithSharedBudget(budget *atomic.Uint32) RecoveryHandlerOption {
+	return func(m *RecoveryHandler) {
+		m.sharedBudget = budget
+	}
+}
+
 // NewRecoveryHandler returns new instance of RecoveryHandler.
-func NewRecoveryHandler(useAutoScaler bool, holderCap uint64, enable bool, parent *memory.Tracker) *RecoveryHandler {
-	return &RecoveryHandler{
-		enable:   enable,
-		handlers: []handlerImpl{newMemLimitHandlerImpl(useAutoScaler)},
-		holder:   newMPPResultHolder(holderCap, parent),
+func NewRecoveryHandler(useAutoScaler bool, holderCap uint64, enable bool, parent *memory.Tracker, opts ...RecoveryHandlerOption) *RecoveryHandler {
+	autoScaler := &autoScalerCaller{}
+	m := &RecoveryHandler{
+		enable:        enable,
+		useAutoScaler: useAutoScaler,
+		handlers: []handlerImpl{
+			newMemLimitHandlerImpl(useAutoScaler, autoScaler),
+			&exchangeReceiverHandlerImpl{},
+		},
+		holder:        newMPPResultHolder(holderCap, parent),
+		obsMemTracker: memory.NewTracker(parent.Label(), -1),
+		autoScaler:    autoScaler,
+		nodeCntPolicy: DefaultNodeCntPolicy,
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
 		// Default recovery 3 time.
-		maxRecoveryCnt: 3,
+		maxRecoveryCnt:      3,
+		recoveredCategories: make(map[RecoveryErrorCategory]struct{}),
+		disabledCategories:  make(map[RecoveryErrorCategory]struct{}),
+		categorySeverity:    defaultCategorySeverity,
+		nowFunc:             time.Now,
+		afterFunc:           time.After,
+		replicaWait:         defaultReplicaWait,
+		maxEvents:           defaultMaxRecoveryEvents,
+		orderSensitive:      true,
+		logSkip:             logSkippedChk,
+	}
+	m.resultHolder = m.holder
+	m.autoScaler.afterFunc = func(d time.Duration) <-chan time.Time {
+		// afterFunc of handler may be replaced after created.
+		return m.afterFunc(d)
+	}
+	m.flight.cond = sync.NewCond(&m.flight.Mutex)
+	m.obsMemTracker.AttachTo(parent)
+	m.handlers = append(m.handlers, &staleSnapshotHandlerImpl{m: m}, &replicaUnavailableHandlerImpl{m: m})
+	m.mu.handlerRecoveryCnt = make(map[string]uint32)
+	m.mu.storeRecoveryCnt = make(map[string]uint32)
+	m.mu.fragmentRecoveryCnt = make(map[uint64]uint32)
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// CloneForNewStmt creates a handler for a new statement with the configs of m, so m can be used as a template.
+// The clone tracks memory under parent, and shares the stateless or concurrency-safe components of m, like the
+// fallback handler, quota, rate limiter and metrics aggregator. States like held chunks, recovery counts, events
+// and counters are not copied. The custom holder set by WithResultHolder() and the spill backend are not copied
+// either, because they hold states of m. opts are applied after the configs are copied.
+func (m *RecoveryHandler) CloneForNewStmt(parent *memory.Tracker, opts ...RecoveryHandlerOption) *RecoveryHandler {
+	c := NewRecoveryHandler(m.useAutoScaler, m.holder.maxCapacity, m.enable, parent)
+	c.fallback, c.decider = m.fallback, m.decider
+	c.chkPool, c.chkPoolFTps = m.chkPool, m.chkPoolFTps
+	c.autoScaler.fetcher, c.autoScaler.failoverFetchers = m.autoScaler.fetcher, m.autoScaler.failoverFetchers
+	c.autoScaler.throttler, c.autoScaler.rateGate = m.autoScaler.throttler, m.autoScaler.rateGate
+	c.autoScaler.recoveryTypes = m.autoScaler.recoveryTypes
+	c.autoScaler.supportedTypes = m.autoScaler.supportedTypes
+	c.autoScaler.maxRetries, c.autoScaler.retryBackoff = m.autoScaler.maxRetries, m.autoScaler.retryBackoff
+	c.autoScaler.rescaleFragmentRatio = m.autoScaler.rescaleFragmentRatio
+	c.autoScaler.unavailableThreshold = m.autoScaler.unavailableThreshold
+	c.nodeCntPolicy, c.nodeCntJitter = m.nodeCntPolicy, m.nodeCntJitter
+	c.maxCumulativeNodeCnt, c.defaultNodeCnt = m.maxCumulativeNodeCnt, m.defaultNodeCnt
+	c.maxRecoveryCnt = m.maxRecoveryCnt
+	c.aggregator = m.aggregator
+	c.contextErrRecoverable, c.staleSnapshotRecovery = m.contextErrRecoverable, m.staleSnapshotRecovery
+	c.minChunkRowsToHold, c.fieldTypes, c.onHoldChunk = m.minChunkRowsToHold, m.fieldTypes, m.onHoldChunk
+	c.skipLogRate, c.logSkip = m.skipLogRate, m.logSkip
+	// Categories disabled by consecutive failures are states of m, only the manually disabled ones are copied.
+	for category := range m.disabledCategories {
+		if _, auto := m.autoDisabledCategories[category]; !auto {
+			c.disabledCategories[category] = struct{}{}
+		}
+	}
+	for category, threshold := range m.failureThresholds {
+		c.SetConsecutiveFailureThreshold(category, threshold)
 	}
+	c.categorySeverity = m.categorySeverity
+	c.maxDistinctCategories, c.rateLimiter = m.maxDistinctCategories, m.rateLimiter
+	if m.errFrequency != nil {
+		c.errFrequency = newErrFrequencyTracker(m.errFrequency.window, m.errFrequency.threshold)
+	}
+	c.quota, c.sharedBudget = m.quota, m.sharedBudget
+	c.handlerTimeout, c.replicaWait, c.autoResetOnRecovery = m.handlerTimeout, m.replicaWait, m.autoResetOnRecovery
+	c.categoryTimeouts = m.categoryTimeouts
+	c.exhaustCooldown, c.maxHoldAge = m.exhaustCooldown, m.maxHoldAge
+	c.streamingWindow, c.shouldStartHolding = m.streamingWindow, m.shouldStartHolding
+	c.orderSensitive, c.maxEstimateRatio = m.orderSensitive, m.maxEstimateRatio
+	c.partialOnDisabled = m.partialOnDisabled
+	c.capacityTuning = m.capacityTuning
+	c.concurrentPolicy = m.concurrentPolicy
+	c.maxEvents, c.evictionPolicy, c.eventLabels = m.maxEvents, m.evictionPolicy, m.eventLabels
+	c.observabilityDisabled, c.decisionSink, c.maxStateSize = m.observabilityDisabled, m.decisionSink, m.maxStateSize
+	c.firstRecoveryGrace, c.simulationEnabled = m.firstRecoveryGrace, m.simulationEnabled
+	c.nowFunc, c.afterFunc = m.nowFunc, m.afterFunc
+	c.holder.pool = m.holder.pool
+	c.holder.checkAccounting, c.holder.checkDuplicate = m.holder.checkAccounting, m.holder.checkDuplicate
+	c.holder.maxBytesPerRow, c.holder.adaptive = m.holder.maxBytesPerRow, m.holder.adaptive
+	c.holder.killer, c.holder.sizer = m.holder.killer, m.holder.sizer
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// SetNodeGroupThrottler sets the throttler of AutoScaler calls. The throttler can be shared by multiple RecoveryHandlers.
+func (m *RecoveryHandler) SetNodeGroupThrottler(throttler *NodeGroupThrottler) {
+	m.autoScaler.throttler = throttler
+}
+
+// SetAutoScalerRateGate sets the gate that keeps the min interval between AutoScaler calls, recovery waits until the
+// interval elapses or ctx is done. The gate can be shared by multiple RecoveryHandlers to limit AutoScaler calls
+// globally. nil means no limit, which is the default.
+func (m *RecoveryHandler) SetAutoScalerRateGate(gate *AutoScalerRateGate) {
+	m.autoScaler.rateGate = gate
 }
 
 // Enabled return true when mpp err recovery enabled.
@@ -61,139 +575,1787 @@ func (m *RecoveryHandler) Enabled() bool {
 	return m.enable
 }
 
+// UsesAutoScaler return true when the handler is built with AutoScaler support.
+func (m *RecoveryHandler) UsesAutoScaler() bool {
+	return m.useAutoScaler
+}
+
+// SetAutoScalerUnavailableThreshold sets the number of consecutive failed AutoScaler calls, after which AutoScaler
+// is treated as unavailable and handlers depending on it decline for the rest of the statement.
+// Handlers that don't depend on AutoScaler, like re-dispatch, can still run. 0 means never.
+func (m *RecoveryHandler) SetAutoScalerUnavailableThreshold(threshold int) {
+	m.autoScaler.unavailableThreshold = threshold
+}
+
+// AutoScalerUnavailable returns true if AutoScaler is treated as unavailable in this statement.
+func (m *RecoveryHandler) AutoScalerUnavailable() bool {
+	return m.autoScaler.unavailable
+}
+
+// SetRecoveryTypeMapping overrides the recovery type passed to AutoScaler for each error category,
+// so AutoScaler behavior can be tuned per category. Categories not in mapping use the default recovery type of handler.
+func (m *RecoveryHandler) SetRecoveryTypeMapping(mapping map[RecoveryErrorCategory]tiflashcompute.RecoveryType) {
+	recoveryTypes := make(map[RecoveryErrorCategory]tiflashcompute.RecoveryType, len(mapping))
+	for category, recoveryType := range mapping {
+		recoveryTypes[category] = recoveryType
+	}
+	m.autoScaler.recoveryTypes = recoveryTypes
+}
+
+// SetTopoFetchers sets the ordered fetchers to call AutoScaler, like the endpoints of primary and secondary regions.
+// They are tried in turn within a single recovery until one provides a non-empty topo. Empty fetchers means
+// tiflashcompute.GetGlobalTopoFetcher(), which is the default.
+func (m *RecoveryHandler) SetTopoFetchers(fetchers ...tiflashcompute.TopoFetcher) {
+	if len(fetchers) == 0 {
+		m.autoScaler.fetcher, m.autoScaler.failoverFetchers = nil, nil
+		return
+	}
+	m.autoScaler.fetcher, m.autoScaler.failoverFetchers = fetchers[0], slices.Clone(fetchers[1:])
+}
+
+// SetSupportedRecoveryTypes sets the recovery types that AutoScaler supports, handlers decline to recovery if their
+// required recovery type is not supported, which doesn't consume recovery count. nil means the types reported by
+// the fetcher if it implements RecoveryTypeCapability, otherwise all types are supported, which is the default.
+func (m *RecoveryHandler) SetSupportedRecoveryTypes(recoveryTypes []tiflashcompute.RecoveryType) {
+	if recoveryTypes == nil {
+		m.autoScaler.supportedTypes = nil
+		return
+	}
+	m.autoScaler.supportedTypes = slices.Clone(recoveryTypes)
+}
+
+// SetAutoScalerRetry sets the max times to retry a failed AutoScaler call inside one recovery, waiting backoff before
+// each retry. Inner retries don't consume recovery count, they are counted by InnerRetryCnt() and
+// RecoveryEvent.InnerRetries instead. 0 means no retry, which is the default.
+func (m *RecoveryHandler) SetAutoScalerRetry(maxRetries int, backoff time.Duration) {
+	m.autoScaler.maxRetries = maxRetries
+	m.autoScaler.retryBackoff = backoff
+}
+
+// InnerRetryCnt returns the number of AutoScaler calls retried inside recoveries in this statement.
+// RecoveryCnt() counts each Recovery call once regardless of inner retries.
+func (m *RecoveryHandler) InnerRetryCnt() uint64 {
+	return m.innerRetryCnt
+}
+
+// SetRescaleFragmentRatio sets the min RecoveryInfo.FailedFragmentRatio to rescale by AutoScaler. If fewer fragments
+// failed, they are re-dispatched without rescale, because a full rescale is overkill. 0 means always rescale.
+func (m *RecoveryHandler) SetRescaleFragmentRatio(ratio float64) {
+	m.autoScaler.rescaleFragmentRatio = ratio
+}
+
+// SetContextErrRecoverable sets whether to recovery the mpp err caused by context.Canceled or context.DeadlineExceeded.
+// These errors are not recoverable by default, because the query is cancelled or timeout.
+func (m *RecoveryHandler) SetContextErrRecoverable(recoverable bool) {
+	m.contextErrRecoverable = recoverable
+}
+
+// SetStaleSnapshotRecovery sets whether to recovery the mpp err caused by stale read TS, which returns
+// RecoveryActionRefreshSnapshotAndRetry. It's disabled by default, only enable it if the caller refreshes the read TS
+// before re-dispatching MPP tasks, otherwise the re-dispatched tasks fail with the same err.
+func (m *RecoveryHandler) SetStaleSnapshotRecovery(enabled bool) {
+	m.staleSnapshotRecovery = enabled
+}
+
+// MarkResultsStreamed tells the handler that the results have begun streaming to the client, which is the point of
+// no return. Holding and recovery are disabled until ResetRecoveryCnt() is called for the next statement,
+// unless in streaming window mode, see SetStreamingWindow().
+func (m *RecoveryHandler) MarkResultsStreamed() {
+	m.resultsStreamed = true
+	if m.windowStreaming() {
+		m.holder.startStreaming()
+		return
+	}
+	m.stopHolding(cannotHoldReasonResultsStreamed)
+}
+
+// SetStreamingWindow enables streaming window mode, which streams results to client while still holding a bounded
+// window of the most recent rows, so a large result can be partially recovered. The semantics are:
+//  1. Before MarkResultsStreamed(), results are held as usual.
+//  2. After MarkResultsStreamed(), HoldResult() keeps holding regardless of capacity. The caller streams the results
+//     popped by PopStreamableChk(), which pops the oldest held chunks until at most window rows are held.
+//     So held chunks are always the un-streamed tail of results.
+//  3. Recovery is still allowed after results begin streaming. Held chunks are dropped on success because MPP tasks
+//     are re-dispatched from scratch, and RecoveryResult.StreamedRows tells how many rows of the re-dispatched
+//     results have been streamed and must be skipped. It's only correct if the re-dispatched results come in the
+//     same order, like results of ORDER BY, which must be guaranteed by the caller. So recovery is refused once
+//     any row is streamed if the handler is not order sensitive, see SetOrderSensitive().
+//  4. PopFrontChk() drains all held chunks at the end of results.
+//
+// It only works with the default holder. 0 disables the mode, which is the default.
+func (m *RecoveryHandler) SetStreamingWindow(rows uint64) {
+	m.streamingWindow = rows
+}
+
+// windowStreaming returns true if results are streaming in streaming window mode.
+func (m *RecoveryHandler) windowStreaming() bool {
+	return m.resultsStreamed && m.streamingWindow > 0 && m.resultHolder == ResultHolder(m.holder)
+}
+
+// streamingRefused returns true if holding and recovery are refused because results have been streamed.
+func (m *RecoveryHandler) streamingRefused() bool {
+	return m.resultsStreamed && !m.windowStreaming()
+}
+
+// PopStreamableChk pops the oldest held chunk if held rows exceed the streaming window, which should be streamed
+// to client. It returns nil if not in streaming window mode or held rows are within the window.
+func (m *RecoveryHandler) PopStreamableChk() *chunk.Chunk {
+	if !m.windowStreaming() || m.holder.numChks() == 0 || m.holder.heldRows() <= m.streamingWindow {
+		return nil
+	}
+	return m.PopFrontChk()
+}
+
+// HeldSchemaInfo returns the schema of held chunks, so the caller can validate the output schema of re-dispatched
+// MPP tasks. Chunks with different column count are rejected by HoldResult.
+func (m *RecoveryHandler) HeldSchemaInfo() HeldSchemaInfo {
+	return m.holder.schema
+}
+
+// SetExhaustCooldown sets the duration that holding is suppressed after recovery is exhausted. So for a reused
+// handler, a quick retry of the same statement doesn't re-buffer immediately if the cluster hasn't recovered.
+func (m *RecoveryHandler) SetExhaustCooldown(cooldown time.Duration) {
+	m.exhaustCooldown = cooldown
+}
+
+func (m *RecoveryHandler) inExhaustCooldown() bool {
+	return m.exhaustCooldown > 0 && !m.exhaustedTime.IsZero() && m.nowFunc().Sub(m.exhaustedTime) < m.exhaustCooldown
+}
+
+// SetMinChunkRowsToHold sets the min rows of chunk to hold. HoldResult skips chunks with less rows,
+// which provide little recovery value per byte of memory. The caller should consume the skipped chunks by itself.
+func (m *RecoveryHandler) SetMinChunkRowsToHold(rows int) {
+	m.minChunkRowsToHold = rows
+}
+
+// SetShouldStartHolding sets the predicate to decide when holding begins in a statement, like only after the query
+// has run for a while or produced some rows, to avoid the overhead on trivially small queries. It's consulted by
+// CanHoldResult() and HoldResult() until it returns true, then holding keeps started until ResetRecoveryCnt().
+// Chunks refused before holding starts are counted as skipped, the caller should consume them by itself.
+// nil means holding starts from the first chunk, which is the default.
+func (m *RecoveryHandler) SetShouldStartHolding(pred func(stats RecoveryStats) bool) {
+	m.shouldStartHolding = pred
+}
+
+// holdingNotStarted returns true if shouldStartHolding refuses to start holding yet.
+func (m *RecoveryHandler) holdingNotStarted() bool {
+	if m.shouldStartHolding == nil || m.holdingStarted {
+		return false
+	}
+	m.publishStats()
+	m.holdingStarted = m.shouldStartHolding(m.Stats())
+	return !m.holdingStarted
+}
+
+// SetEstimatedResultRows sets the estimated total rows of results in this statement, like the row count estimated
+// by optimizer. If it vastly exceeds capacity of holder, see SetMaxEstimateRatio(), buffering is futile because
+// holding stops long before the results end, so holding is skipped to save the overhead. It takes effect only if
+// SetMaxEstimateRatio() is set. 0 means unknown.
+// It's reset by ResetRecoveryCnt().
+func (m *RecoveryHandler) SetEstimatedResultRows(rows uint64) {
+	m.estimatedRows = rows
+}
+
+// SetMaxEstimateRatio sets the max ratio of estimated result rows to capacity of holder, holding is skipped if
+// it's exceeded. 0 means no limit, which is the default.
+func (m *RecoveryHandler) SetMaxEstimateRatio(ratio float64) {
+	m.maxEstimateRatio = ratio
+}
+
+// estimateTooLarge returns true if estimated result rows exceed maxEstimateRatio times the configured capacity.
+func (m *RecoveryHandler) estimateTooLarge() bool {
+	if m.estimatedRows == 0 || m.maxEstimateRatio <= 0 {
+		return false
+	}
+	capacity := m.holder.maxCapacity
+	if m.resultHolder != ResultHolder(m.holder) {
+		capacity = m.resultHolder.Stats().Capacity
+	}
+	return float64(m.estimatedRows) > float64(capacity)*m.maxEstimateRatio
+}
+
 // CanHoldResult tells whether we can insert intermediate results.
 func (m *RecoveryHandler) CanHoldResult() bool {
-	return m.holder.capacity > 0 && !m.holder.cannotHold
+	m.checkHoldAge()
+	return !m.streamingRefused() && !m.inExhaustCooldown() && !m.estimateTooLarge() && !m.holdingNotStarted() &&
+		m.resultHolder.CanHold()
+}
+
+// HoldingStatus returns whether holder can hold results, and the reason if it cannot.
+func (m *RecoveryHandler) HoldingStatus() (canHold bool, reason string) {
+	if m.streamingRefused() {
+		return false, cannotHoldReasonResultsStreamed.String()
+	}
+	if m.inExhaustCooldown() {
+		return false, cannotHoldReasonExhaustCooldown.String()
+	}
+	if m.estimateTooLarge() {
+		return false, cannotHoldReasonEstimateTooLarge.String()
+	}
+	if m.holdingNotStarted() {
+		return false, cannotHoldReasonNotStarted.String()
+	}
+	m.checkHoldAge()
+	if m.resultHolder != ResultHolder(m.holder) {
+		if m.resultHolder.CanHold() {
+			return true, ""
+		}
+		return false, cannotHoldReasonCustomHolder.String()
+	}
+	r := m.holder.status()
+	return r == cannotHoldReasonNone, r.String()
+}
+
+// DisableHolding stops holding results until ResetHolder() is called.
+func (m *RecoveryHandler) DisableHolding() {
+	m.stopHolding(cannotHoldReasonDisabled)
+}
+
+// stopHolding stops holding with reason, which is only recorded by the default holder.
+func (m *RecoveryHandler) stopHolding(reason cannotHoldReason) {
+	if m.resultHolder == ResultHolder(m.holder) {
+		m.holder.stopHolding(reason)
+		return
+	}
+	m.resultHolder.StopHolding()
+}
+
+// WouldExceedCapacity returns true if holding chk would exceed the budget of holder, like the capacity in rows under
+// the active capacity mode or the max bytes per row, so the executor can decide to stream chk instead of holding it.
+// It's true if chk would be refused, or holder would stop holding after chk is held. State is not modified.
+// Only the default holder is predicted precisely, a custom holder is only asked whether it can hold.
+func (m *RecoveryHandler) WouldExceedCapacity(chk *chunk.Chunk) bool {
+	if m.streamingRefused() || m.inExhaustCooldown() || m.estimateTooLarge() {
+		return true
+	}
+	if m.resultHolder != ResultHolder(m.holder) {
+		return !m.resultHolder.CanHold()
+	}
+	return m.holder.wouldExceedCapacity(chk)
 }
 
 // HoldResult tries to hold mpp result. You should call Enabled() and CanHoldResult() to check first.
-func (m *RecoveryHandler) HoldResult(chk *chunk.Chunk) {
-	m.holder.insert(chk)
+// Returns false if the chunk is not held because holder cannot hold anymore.
+func (m *RecoveryHandler) HoldResult(chk *chunk.Chunk) bool {
+	defer m.publishStats()
+	m.markStmtStart()
+	// The predicate sees the rows offered before this chunk.
+	notStarted := m.holdingNotStarted()
+	m.offeredRows += uint64(chk.NumRows())
+	if m.streamingRefused() || m.inExhaustCooldown() {
+		m.incDroppedChkCnt()
+		m.sampleSkipLog(chk, notStarted)
+		return false
+	}
+	if m.holder.checkDuplicate && m.holder.isHeld(chk) {
+		// Holding the same chunk twice is a bug of caller, which double counts rows and memory.
+		logutil.BgLogger().Warn("chunk is already held by mpp result holder", zap.Int("numRows", chk.NumRows()))
+		return false
+	}
+	if schema := m.holder.schema; schema.Established && chk.NumCols() != schema.NumCols {
+		logutil.BgLogger().Warn("column count of chunk mismatches held chunks",
+			zap.Int("numCols", chk.NumCols()), zap.Int("heldNumCols", schema.NumCols))
+		return false
+	}
+	m.checkHoldAge()
+	if notStarted || m.estimateTooLarge() || (m.resultHolder.CanHold() && chk.NumRows() < m.minChunkRowsToHold) {
+		m.incSkippedChkCnt()
+		m.sampleSkipLog(chk, notStarted)
+		return false
+	}
+	if !m.resultHolder.Insert(chk, m.nowFunc()) {
+		m.incDroppedChkCnt()
+		m.sampleSkipLog(chk, notStarted)
+		return false
+	}
+	m.observeMemPressure()
+	if m.onHoldChunk != nil {
+		// Panic of hook should not break the query.
+		util.WithRecovery(func() { m.onHoldChunk(chk) }, nil)
+	}
+	return true
+}
+
+// SetSkipLogSampleRate sets the sample rate in [0, 1] of logging chunks not held by HoldResult() with the reason,
+// like chunk rows below min, capacity reached or estimated rows too large, which helps to debug buffering behavior.
+// 0 disables the log, which is the default, and costs nothing on the hot path.
+func (m *RecoveryHandler) SetSkipLogSampleRate(rate float64) {
+	m.skipLogRate = rate
+}
+
+// sampleSkipLog logs why chk is not held by HoldResult() if it's sampled by skipLogRate.
+func (m *RecoveryHandler) sampleSkipLog(chk *chunk.Chunk, notStarted bool) {
+	if m.skipLogRate <= 0 || (m.skipLogRate < 1 && m.rand.Float64() >= m.skipLogRate) {
+		return
+	}
+	m.logSkip(m.skipReason(chk, notStarted), chk)
+}
+
+// skipReason returns why chk is not held by HoldResult(), which is checked in the same order as HoldResult().
+func (m *RecoveryHandler) skipReason(chk *chunk.Chunk, notStarted bool) cannotHoldReason {
+	switch {
+	case m.streamingRefused():
+		return cannotHoldReasonResultsStreamed
+	case m.inExhaustCooldown():
+		return cannotHoldReasonExhaustCooldown
+	case notStarted:
+		return cannotHoldReasonNotStarted
+	case m.estimateTooLarge():
+		return cannotHoldReasonEstimateTooLarge
+	case m.resultHolder.CanHold() && chk.NumRows() < m.minChunkRowsToHold:
+		return cannotHoldReasonTooFewRows
+	case m.resultHolder != ResultHolder(m.holder):
+		return cannotHoldReasonCustomHolder
+	default:
+		return m.holder.status()
+	}
+}
+
+func logSkippedChk(reason cannotHoldReason, chk *chunk.Chunk) {
+	logutil.BgLogger().Info("chunk is not held by mpp result holder", zap.Stringer("reason", reason),
+		zap.Int("numRows", chk.NumRows()))
+}
+
+// OnHoldChunk sets the hook called for each held chunk after accounting, like tee-ing held results to a result cache.
+// The chunk must not be modified by hook. Panics of hook are recovered.
+func (m *RecoveryHandler) OnHoldChunk(hook func(chk *chunk.Chunk)) {
+	m.onHoldChunk = hook
 }
 
 // NumHoldChk returns the number of chunk holded.
 func (m *RecoveryHandler) NumHoldChk() int {
-	return len(m.holder.chks)
+	return m.resultHolder.Stats().NumChks
 }
 
 // NumHoldRows returns the number of chunk holded.
 func (m *RecoveryHandler) NumHoldRows() uint64 {
-	return m.holder.curRows
+	return m.resultHolder.Stats().NumRows
+}
+
+// NumHoldBytes returns the memory usage of chunks holded.
+func (m *RecoveryHandler) NumHoldBytes() int64 {
+	return m.resultHolder.Stats().MemUsage
 }
 
 // PopFrontChk pop one chunk.
 func (m *RecoveryHandler) PopFrontChk() *chunk.Chunk {
-	if !m.enable || len(m.holder.chks) == 0 {
+	if (!m.enable && !m.partialReturned) || m.resultHolder.Stats().NumChks == 0 {
 		return nil
 	}
-	chk := m.holder.chks[0]
-	m.holder.chks = m.holder.chks[1:]
-	m.holder.memTracker.Consume(-chk.MemoryUsage())
-	m.holder.cannotHold = true
+	chk, err := m.resultHolder.PopFront()
+	m.publishStats()
+	if err != nil {
+		logutil.BgLogger().Warn("pop chunk from mpp result holder failed", zap.Error(err))
+		return nil
+	}
+	if m.windowStreaming() {
+		m.streamedRows += uint64(chk.NumRows())
+	}
 	return chk
 }
 
-// ResetHolder reset the dynamic data, like chk and recovery cnt.
-// Will not touch other metadata, like enable.
-func (m *RecoveryHandler) ResetHolder() {
-	m.holder.reset()
+// PopFrontChkWithRelease pops one chunk like PopFrontChk(), the caller should call release when the chunk is
+// not used anymore, so it can be returned to the chunk pool set by WithChunkPool(). release is not nil and can be
+// called more than once, it does nothing if no chunk pool is set.
+func (m *RecoveryHandler) PopFrontChkWithRelease() (chk *chunk.Chunk, release func()) {
+	chk = m.PopFrontChk()
+	if chk == nil || m.chkPool == nil || chk.NumCols() != len(m.chkPoolFTps) {
+		return chk, func() {}
+	}
+	released := false
+	return chk, func() {
+		if released {
+			return
+		}
+		released = true
+		m.chkPool.PutChunk(m.chkPoolFTps, chk)
+	}
 }
 
-// RecoveryCnt returns the recovery count.
-func (m *RecoveryHandler) RecoveryCnt() uint32 {
-	return m.curRecoveryCnt
+// StreamHeldChunks emits held chunks in order through the returned channel, which is closed when all held chunks
+// are consumed or ctx is done. Chunks are consumed like PopFrontChk(), so holder cannot hold anymore.
+// The caller should not call other methods of RecoveryHandler until the channel is closed.
+func (m *RecoveryHandler) StreamHeldChunks(ctx context.Context) <-chan *chunk.Chunk {
+	ch := make(chan *chunk.Chunk)
+	go func() {
+		defer close(ch)
+		if !m.enable {
+			return
+		}
+		for m.holder.numChks() > 0 && ctx.Err() == nil {
+			chk, err := m.holder.peekFront()
+			if err != nil {
+				logutil.BgLogger().Warn("stream chunk from mpp result holder failed", zap.Error(err))
+				return
+			}
+			select {
+			case ch <- chk:
+			case <-ctx.Done():
+				// Chunk that is not received is still held.
+				return
+			}
+			err = m.holder.dropFront()
+			m.publishStats()
+			if err != nil {
+				logutil.BgLogger().Warn("stream chunk from mpp result holder failed", zap.Error(err))
+				return
+			}
+		}
+	}()
+	return ch
 }
 
-// Recovery tries to recovery error. Reasons that cannot recovery:
-//  1. Already return result to client because holder is full.
-//  2. Recovery method of this kind of error not implemented or error is not recoveryable.
-//  3. Retry time exceeds maxRecoveryCnt.
-func (m *RecoveryHandler) Recovery(info *RecoveryInfo) error {
-	if !m.enable {
-		return errors.New("mpp err recovery is not enabled")
-	}
+// RowWriter receives rows dumped by DumpHeldRows.
+type RowWriter interface {
+	WriteRow(row chunk.Row) error
+}
 
-	if info == nil || info.MPPErr == nil {
-		return errors.New("RecoveryInfo is nil or mppErr is nil")
+// DumpHeldRows writes all held rows to w in order, it will not consume held chunks.
+func (m *RecoveryHandler) DumpHeldRows(w RowWriter) error {
+	return m.holder.forEachChk(func(chk *chunk.Chunk) error {
+		for i := 0; i < chk.NumRows(); i++ {
+			if err := w.WriteRow(chk.GetRow(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ColumnStat is the approximate memory of a column across held chunks.
+type ColumnStat struct {
+	ColIdx int
+	Bytes  int64
+}
+
+// HeldColumnStats returns the approximate memory of each column across held chunks, which helps to find out why
+// held results are large. It's diagnostic-only and doesn't consume held chunks. Spilled chunks are not counted
+// since they don't consume memory. Returns nil if no chunk is in memory.
+func (m *RecoveryHandler) HeldColumnStats() []ColumnStat {
+	var stats []ColumnStat
+	for _, held := range m.holder.chks {
+		if held.chk == nil {
+			continue
+		}
+		if stats == nil {
+			stats = make([]ColumnStat, held.chk.NumCols())
+			for i := range stats {
+				stats[i].ColIdx = i
+			}
+		}
+		for i := 0; i < held.chk.NumCols() && i < len(stats); i++ {
+			stats[i].Bytes += held.chk.Column(i).MemoryUsage()
+		}
 	}
+	return stats
+}
 
-	if m.curRecoveryCnt >= m.maxRecoveryCnt {
-		return errors.Errorf("exceeds max recovery cnt: cur: %v, max: %v", m.curRecoveryCnt, m.maxRecoveryCnt)
+// HeldRowsDigest returns an order-sensitive hash over the contents of held rows, so the caller can check whether
+// the re-streamed results match the held ones. It returns 0 if the held rows cannot be read.
+func (m *RecoveryHandler) HeldRowsDigest() uint64 {
+	hasher := fnv.New64a()
+	var buf [binary.MaxVarintLen64 + 1]byte
+	err := m.holder.forEachChk(func(chk *chunk.Chunk) error {
+		for i := 0; i < chk.NumRows(); i++ {
+			row := chk.GetRow(i)
+			for colIdx := 0; colIdx < row.Len(); colIdx++ {
+				if row.IsNull(colIdx) {
+					_, _ = hasher.Write([]byte{0})
+					continue
+				}
+				raw := row.GetRaw(colIdx)
+				// Write null flag and length to make the encoding unambiguous.
+				buf[0] = 1
+				n := binary.PutUvarint(buf[1:], uint64(len(raw)))
+				_, _ = hasher.Write(buf[:n+1])
+				_, _ = hasher.Write(raw)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logutil.BgLogger().Warn("compute digest of held rows failed", zap.Error(err))
+		return 0
 	}
+	return hasher.Sum64()
+}
 
-	m.curRecoveryCnt++
+// SetMaxHoldAge sets the max age of the oldest held chunk to bound the latency of results. Holding stops once
+// it's exceeded even if capacity isn't reached, so the caller flushes held chunks. 0 means no limit.
+func (m *RecoveryHandler) SetMaxHoldAge(maxAge time.Duration) {
+	m.maxHoldAge = maxAge
+}
 
-	for _, h := range m.handlers {
-		if h.chooseHandlerImpl(info.MPPErr) {
-			return h.doRecovery(info)
-		}
+// checkHoldAge stops holding if the oldest held chunk exceeds maxHoldAge.
+func (m *RecoveryHandler) checkHoldAge() {
+	if m.maxHoldAge > 0 && m.OldestHeldAge() > m.maxHoldAge {
+		m.stopHolding(cannotHoldReasonHoldAgeExceeded)
 	}
-	return errors.New("no handler to recovery this type of mpp err")
 }
 
-type handlerImpl interface {
-	chooseHandlerImpl(mppErr error) bool
-	doRecovery(info *RecoveryInfo) error
+// OldestHeldAge returns how long the oldest held chunk has been held.
+// Returns 0 if no chunk is held.
+func (m *RecoveryHandler) OldestHeldAge() time.Duration {
+	if m.holder.numChks() == 0 {
+		return 0
+	}
+	return m.nowFunc().Sub(m.holder.chks[0].insertTime)
 }
 
-var _ handlerImpl = &memLimitHandlerImpl{}
+// NewestHeldAge returns how long the newest held chunk has been held.
+// Returns 0 if no chunk is held.
+func (m *RecoveryHandler) NewestHeldAge() time.Duration {
+	if m.holder.numChks() == 0 {
+		return 0
+	}
+	return m.nowFunc().Sub(m.holder.chks[m.holder.numChks()-1].insertTime)
+}
 
-type memLimitHandlerImpl struct {
-	useAutoScaler bool
+// SetSpillBackend sets the backend to spill held chunks when memory usage of holder exceeds threshold.
+// fieldTypes are the field types of held chunks, which are used to serialize chunks.
+// Held chunks are kept in memory if backend is nil, which is the default.
+// It returns ErrSpilledChunksHeld and keeps the current backend if any held chunk is spilled, because spilled
+// chunks can only be read back from the backend they are spilled to. Call it after ResetHolder() instead.
+func (m *RecoveryHandler) SetSpillBackend(backend SpillBackend, fieldTypes []*types.FieldType, threshold int64) error {
+	m.holder.waitSpills()
+	m.publishStats()
+	if m.holder.numSpilledChks > 0 {
+		return errors.Annotatef(ErrSpilledChunksHeld, "spilled chunks: %v", m.holder.numSpilledChks)
+	}
+	if backend == nil {
+		m.holder.spill = nil
+		return nil
+	}
+	m.holder.spill = &holderSpill{
+		backend:   backend,
+		codec:     chunk.NewCodec(fieldTypes),
+		threshold: threshold,
+	}
+	return nil
 }
 
-func newMemLimitHandlerImpl(useAutoScaler bool) *memLimitHandlerImpl {
-	return &memLimitHandlerImpl{
-		useAutoScaler: useAutoScaler,
+// DebugHeldChunks returns the held chunks for inspection, it's diagnostic-only and should not be used by executors.
+// In-memory chunks are returned as aliases, so they must not be modified. Spilled chunks are read back as copies.
+func (m *RecoveryHandler) DebugHeldChunks() []*chunk.Chunk {
+	chks := make([]*chunk.Chunk, 0, m.holder.numChks())
+	err := m.holder.forEachChk(func(chk *chunk.Chunk) error {
+		chks = append(chks, chk)
+		return nil
+	})
+	if err != nil {
+		logutil.BgLogger().Warn("read held chunks failed", zap.Error(err))
 	}
+	return chks
 }
 
-func (h *memLimitHandlerImpl) chooseHandlerImpl(mppErr error) bool {
-	if strings.Contains(mppErr.Error(), memLimitErrPattern) && h.useAutoScaler {
-		return true
+// DebugClearChunks removes the held chunks and releases their memory, but leaves other states like held rows and
+// whether holder can hold, which helps tests to simulate specific states. It's diagnostic-only.
+func (m *RecoveryHandler) DebugClearChunks() {
+	m.holder.releaseChks()
+	m.publishStats()
+}
+
+// SetFieldTypes sets field types of held chunks, which are required by WriteHeldChunks and ReadHeldChunks.
+func (m *RecoveryHandler) SetFieldTypes(fieldTypes []*types.FieldType) {
+	m.fieldTypes = fieldTypes
+}
+
+// WriteHeldChunks serializes held chunks to w by chunk codec, so they can be transferred to another node.
+// It returns the number of bytes written. Held chunks are not removed.
+func (m *RecoveryHandler) WriteHeldChunks(w io.Writer) (int64, error) {
+	if m.fieldTypes == nil {
+		return 0, errors.New("field types of held chunks are not set")
 	}
-	return false
+	return m.holder.writeChks(w, chunk.NewCodec(m.fieldTypes))
 }
 
-func (*memLimitHandlerImpl) doRecovery(info *RecoveryInfo) error {
-	// Ignore fetched topo, because AutoScaler will keep the topo for a while.
-	// And the new topo will be fetched when dispatch mpp task again.
-	if _, err := tiflashcompute.GetGlobalTopoFetcher().RecoveryAndGetTopo(tiflashcompute.RecoveryTypeMemLimit, info.NodeCnt); err != nil {
-		return err
+// ReadHeldChunks reads chunks serialized by WriteHeldChunks from r and holds them after the held ones by
+// HoldResult(), so they are checked like other results. It returns error if data is corrupted or any chunk is
+// not held, the chunks read before are still held.
+func (m *RecoveryHandler) ReadHeldChunks(r io.Reader) error {
+	if m.fieldTypes == nil {
+		return errors.New("field types of held chunks are not set")
+	}
+	codec := chunk.NewCodec(m.fieldTypes)
+	for {
+		chk, err := readChk(r, codec, m.fieldTypes)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !m.HoldResult(chk) {
+			canHold, reason := m.HoldingStatus()
+			return errors.Errorf("read chunk is not held, can hold: %v, reason: %s", canHold, reason)
+		}
 	}
-	return nil
 }
 
-type mppResultHolder struct {
-	capacity uint64
-	// True when holder is full or begin to return result.
-	cannotHold bool
-	curRows    uint64
-	chks       []*chunk.Chunk
-	memTracker *memory.Tracker
+// SpillStats returns the spill statistics since the holder is reset. It's empty if spill is not enabled.
+func (m *RecoveryHandler) SpillStats() SpillStat {
+	if m.holder.spill == nil {
+		return SpillStat{}
+	}
+	return m.holder.spill.stat
 }
 
-func newMPPResultHolder(holderCap uint64, parent *memory.Tracker) *mppResultHolder {
-	return &mppResultHolder{
-		capacity:   holderCap,
-		chks:       []*chunk.Chunk{},
-		memTracker: memory.NewTracker(parent.Label(), 0),
+// ResetHolder reset the dynamic data, like chk and recovery cnt.
+// Will not touch other metadata, like enable.
+func (m *RecoveryHandler) ResetHolder() {
+	if err := m.resultHolder.Reset(); err != nil {
+		logutil.BgLogger().Warn("reset mpp result holder failed", zap.Error(err))
 	}
+	m.publishStats()
+}
+
+// SetAccountingCheck sets whether to check memory accounting of holder when reset.
+// It's enabled in test by default.
+func (m *RecoveryHandler) SetAccountingCheck(check bool) {
+	m.holder.checkAccounting = check
 }
 
-func (h *mppResultHolder) insert(chk *chunk.Chunk) {
-	h.chks = append(h.chks, chk)
-	h.curRows += uint64(chk.NumRows())
+// SetAdaptiveCapacity sets whether holder capacity is recomputed on each insert from the memory headroom of parent
+// tracker, bounded by the configured capacity. So more rows are held when memory is plentiful and less under pressure.
+func (m *RecoveryHandler) SetAdaptiveCapacity(adaptive bool) {
+	m.holder.adaptive = adaptive
+	m.holder.capacity = m.holder.maxCapacity
+}
+
+// CapacityTuning configures how holder capacity is tuned across statements, see SetCapacityTuning().
+type CapacityTuning struct {
+	MinCapacity uint64
+	MaxCapacity uint64
+	// Step is the rows that capacity is nudged by after each statement.
+	Step uint64
+	// MemPressureRatio is the ratio of bytes consumed to the bytes limit of parent tracker, above which memory is
+	// under pressure. 0 means memory pressure is not considered.
+	MemPressureRatio float64
+}
 
-	if h.curRows >= h.capacity {
-		h.cannotHold = true
+// SetCapacityTuning makes a reused handler learn whether its holder capacity is sufficient. After each statement,
+// capacity is nudged up by Step if recovery is called after holder stopped holding due to capacity, so results may
+// have been flushed, and nudged down by Step if memory was under pressure while holding, which prevails.
+// Capacity is bounded by MinCapacity and MaxCapacity. nil stops tuning and keeps the current capacity.
+func (m *RecoveryHandler) SetCapacityTuning(tuning *CapacityTuning) {
+	if tuning == nil {
+		m.capacityTuning = nil
+		return
 	}
-	h.memTracker.Consume(chk.MemoryUsage())
+	t := *tuning
+	m.capacityTuning = &t
+	m.setCapacity(min(max(m.holder.maxCapacity, t.MinCapacity), t.MaxCapacity))
+}
+
+// EffectiveCapacity returns the capacity of holder in rows, which is tuned by SetCapacityTuning().
+func (m *RecoveryHandler) EffectiveCapacity() uint64 {
+	return m.holder.maxCapacity
+}
+
+// setCapacity takes effect at once if holder hasn't held anything, otherwise when holder is reset.
+func (m *RecoveryHandler) setCapacity(capacity uint64) {
+	m.holder.maxCapacity = capacity
+	if m.holder.numChks() == 0 && !m.holder.cannotHold {
+		m.holder.capacity = capacity
+	}
+}
+
+// observeCapacityShortage records the recovery called after holder stopped holding due to capacity.
+func (m *RecoveryHandler) observeCapacityShortage() {
+	if m.capacityTuning == nil || m.resultHolder != ResultHolder(m.holder) {
+		return
+	}
+	if r := m.holder.status(); m.streamingRefused() || r == cannotHoldReasonCapacityReached || r == cannotHoldReasonChunkPopped {
+		m.stmtCapacityShort = true
+	}
+}
+
+// observeMemPressure records whether memory of parent tracker is under pressure after a chunk is held.
+func (m *RecoveryHandler) observeMemPressure() {
+	if m.capacityTuning == nil || m.capacityTuning.MemPressureRatio <= 0 {
+		return
+	}
+	if limit := m.holder.parent.GetBytesLimit(); limit > 0 &&
+		float64(m.holder.parent.BytesConsumed()) > m.capacityTuning.MemPressureRatio*float64(limit) {
+		m.stmtMemPressure = true
+	}
+}
+
+// tuneCapacity nudges capacity by the observations of the finished statement.
+func (m *RecoveryHandler) tuneCapacity() {
+	t := m.capacityTuning
+	if t == nil {
+		return
+	}
+	capacity := m.holder.maxCapacity
+	switch {
+	case m.stmtMemPressure:
+		capacity -= min(t.Step, capacity)
+	case m.stmtCapacityShort:
+		capacity += t.Step
+	}
+	m.setCapacity(min(max(capacity, t.MinCapacity), t.MaxCapacity))
+	m.stmtCapacityShort = false
+	m.stmtMemPressure = false
+}
+
+// SetMaxBytesPerRow sets the sane max of accounted bytes per held row. Holding stops once it's exceeded,
+// to avoid OOM caused by accounting bug or chunks with huge hidden allocations. 0 means no check.
+func (m *RecoveryHandler) SetMaxBytesPerRow(maxBytes int64) {
+	m.holder.maxBytesPerRow = maxBytes
+}
+
+// SetChunkSizer sets the function to compute accounted bytes of held chunks instead of chk.MemoryUsage(), for
+// specialized chunk layouts that MemoryUsage() under- or over-counts. nil restores MemoryUsage(). The bytes accounted
+// on insert are released when the chunk is popped or dropped, so the accounting is balanced.
+func (m *RecoveryHandler) SetChunkSizer(sizer func(chk *chunk.Chunk) int64) {
+	m.holder.sizer = sizer
+}
+
+// SetKiller sets the killer of session. Once the session is killed, holder drops held chunks on the next
+// HoldResult() and cannot hold until the kill signal is cleared, and mpp errs are not recovered. nil means no check.
+func (m *RecoveryHandler) SetKiller(killer *sqlkiller.SQLKiller) {
+	m.holder.killer = killer
+}
+
+// SetDuplicateChunkCheck sets whether HoldResult checks the chunk is already held, which costs O(n) for each chunk.
+// It's a debug check and enabled in test by default.
+func (m *RecoveryHandler) SetDuplicateChunkCheck(check bool) {
+	m.holder.checkDuplicate = check
+}
+
+// SelfCheck validates the invariants of handler, like memory accounting of held chunks and bounds of counters,
+// which is safe to call when investigating accounting bugs. It returns a descriptive error on the first mismatch.
+// Invariants of held chunks are only checked for the default holder.
+func (m *RecoveryHandler) SelfCheck() error {
+	if m.resultHolder == ResultHolder(m.holder) {
+		if err := m.holder.selfCheck(); err != nil {
+			return err
+		}
+	}
+	if m.curRecoveryCnt > m.maxRecoveryCnt {
+		return errors.Errorf("recovery cnt exceeds max, cur: %v, max: %v", m.curRecoveryCnt, m.maxRecoveryCnt)
+	}
+	if uint64(m.curRecoveryCnt) > m.lifetimeRecoveryCnt {
+		return errors.Errorf("recovery cnt exceeds lifetime recovery cnt, cur: %v, lifetime: %v", m.curRecoveryCnt, m.lifetimeRecoveryCnt)
+	}
+	if len(m.events) > m.maxEvents {
+		return errors.Errorf("too many events, cnt: %v, max: %v", len(m.events), m.maxEvents)
+	}
+	return nil
+}
+
+// InRecovery returns true if Recovery is running, like blocked on AutoScaler. It's safe for concurrent use,
+// so a dashboard can observe whether the statement is mid-recovery.
+func (m *RecoveryHandler) InRecovery() bool {
+	return m.inRecovery.Load()
+}
+
+// RecoveryCnt returns the recovery count.
+func (m *RecoveryHandler) RecoveryCnt() uint32 {
+	return m.curRecoveryCnt
+}
+
+// LifetimeRecoveryCnt returns the recovery count since the handler is created or ResetAll() is called.
+func (m *RecoveryHandler) LifetimeRecoveryCnt() uint64 {
+	return m.lifetimeRecoveryCnt
+}
+
+// ResetRecoveryCnt resets the recovery count of current statement, so the handler can be reused by next statement.
+func (m *RecoveryHandler) ResetRecoveryCnt() {
+	m.tuneCapacity()
+	m.curRecoveryCnt = 0
+	m.innerRetryCnt = 0
+	m.cumulativeNodeCnt = 0
+	m.autoScaler.resetAvailability()
+	m.resultsStreamed = false
+	m.streamedRows = 0
+	m.holdingStarted = false
+	m.offeredRows = 0
+	m.estimatedRows = 0
+	m.partialReturned = false
+	m.stmtExhausted = false
+	m.stmtStartTime = time.Time{}
+	m.firstRecoveryTime = time.Time{}
+	clear(m.recoveredCategories)
+	clear(m.stmtFailedCategories)
+	m.publishStats()
+}
+
+// ResetAll resets the holder and all counters, including the lifetime recovery count.
+// Will not touch other metadata, like enable.
+func (m *RecoveryHandler) ResetAll() {
+	m.ResetHolder()
+	m.ResetRecoveryCnt()
+	m.lifetimeRecoveryCnt = 0
+	m.published.lifetimeRecoveryCnt.Store(0)
+	m.resetCounters()
+	m.events = nil
+	m.trackEventsMem()
+	m.lastClassification = recoveryClassification{}
+	m.exhaustedTime = time.Time{}
+	if m.errFrequency != nil {
+		m.errFrequency.reset()
+	}
+	m.ResetConsecutiveFailures()
+}
+
+// Close releases the held chunks and resets all counters, including the memory of observability structures,
+// then detaches the memory tracker of observability structures from parent, so parent doesn't keep it.
+func (m *RecoveryHandler) Close() {
+	m.ResetAll()
+	m.obsMemTracker.Detach()
+}
+
+// Recovery tries to recovery error. Reasons that cannot recovery:
+//  1. Already return result to client because holder is full.
+//  2. Recovery method of this kind of error not implemented or error is not recoveryable.
+//  3. Retry time exceeds maxRecoveryCnt, or the shared budget is used up.
+//  4. Recovery is reentered, like the user defined handler or decider calls Recovery again, with or without the
+//     ctx passed to it. Other concurrent calls are handled by ConcurrentRecoveryPolicy.
+//  5. The mpp err is caused by context.Canceled or context.DeadlineExceeded, which doesn't consume recovery count.
+//  6. Too many distinct categories are recovered in this statement, which doesn't consume recovery count.
+//  7. The category of mpp err occurs too frequently within the sliding window, which doesn't consume recovery count.
+//  8. The async recovery started by RecoveryAsync is in flight, which doesn't consume recovery count.
+func (m *RecoveryHandler) Recovery(ctx context.Context, info *RecoveryInfo) (RecoveryResult, error) {
+	if m.asyncInFlight.Load() && !m.reentered(ctx) {
+		return RecoveryResult{}, ErrRecoveryInFlight
+	}
+	return m.recovery(ctx, info)
+}
+
+// reentered returns true if the caller is the user defined handler or decider called by Recovery.
+func (m *RecoveryHandler) reentered(ctx context.Context) bool {
+	return m.inUserCallback.Load() || ctx.Value(recoveryCtxKey{}) == m
+}
+
+func (m *RecoveryHandler) recovery(ctx context.Context, info *RecoveryInfo) (res RecoveryResult, err error) {
+	if m.reentered(ctx) {
+		return res, ErrRecoveryReentered
+	}
+	run, res, err := m.beginRecovery()
+	if !run {
+		return res, err
+	}
+	defer func() {
+		m.publishStats()
+		m.endRecovery(res, err)
+	}()
+
+	var h handlerImpl
+	if m.decisionSink != nil && !m.observabilityDisabled {
+		start := m.nowFunc()
+		defer func() {
+			m.writeDecision(start, h, res, err)
+		}()
+	}
+	m.markStmtStart()
+	m.observeCapacityShortage()
+	m.lastClassification = m.classifyForRecovery(info)
+	h, cause, err := m.checkRecoverable(info, false)
+	if m.decider != nil {
+		m.lastClassification.recoverable = h != nil
+	}
+	if err != nil {
+		switch errors.Cause(err) {
+		case ErrRecoveryExhausted:
+			m.onRecoveryExhausted(info, err)
+		case ErrRecoveryDisabled:
+			m.onRecoveryDisabled(info)
+			if rows := m.resultHolder.Stats().NumRows; m.partialOnDisabled && rows > 0 && info != nil && info.MPPErr != nil {
+				return m.returnPartial(info, rows), nil
+			}
+		}
+		return res, err
+	}
+	if requiresNodeCnt(h, info) {
+		var ok bool
+		if info, ok = m.withDefaultNodeCnt(info); !ok {
+			return res, errors.Annotatef(ErrUnknownNodeCnt, "node cnt: %v", info.NodeCnt)
+		}
+	}
+	nodeCnt := m.computeNodeCnt(info)
+	if d, ok := h.(*deciderHandlerImpl); ok && d.nodeCnt > 0 {
+		nodeCnt = d.nodeCnt
+	}
+	var prefixRows uint64
+	if prefixRows, err = m.resumePrefixRows(info); err != nil {
+		return res, err
+	}
+	if h != nil {
+		if m.errFrequency != nil && m.errFrequency.exceeded(cause.category, m.nowFunc()) {
+			// The refused occurrence is counted too, because the err keeps occurring.
+			m.errFrequency.record(cause.category, m.nowFunc())
+			return res, errors.Annotatef(ErrTooFrequent, "category: %v, window: %v, threshold: %v",
+				cause.category, m.errFrequency.window, m.errFrequency.threshold)
+		}
+		if m.maxCumulativeNodeCnt > 0 && callsAutoScaler(h, info) && m.cumulativeNodeCnt+nodeCnt > m.maxCumulativeNodeCnt {
+			return res, errors.Annotatef(ErrNodeCntBudgetExceeded, "requested: %v, node cnt: %v, max: %v",
+				m.cumulativeNodeCnt, nodeCnt, m.maxCumulativeNodeCnt)
+		}
+		if err = m.waitFirstRecoveryGrace(ctx); err != nil {
+			return res, err
+		}
+		if m.quota != nil {
+			if err = m.quota.Acquire(ctx); err != nil {
+				return res, errors.Annotate(err, "acquire quota of mpp err recovery")
+			}
+			defer m.quota.Release()
+		}
+	}
+
+	// All budgets are consumed before any state of m is changed, so a refused attempt leaves no partial state.
+	if !m.consumeSharedBudget() {
+		// Budget is used up by others after checkRecoverable.
+		err = errors.Annotate(ErrRecoveryExhausted, "shared budget is used up")
+		m.onRecoveryExhausted(info, err)
+		return res, err
+	}
+	if h != nil && m.rateLimiter != nil && !m.rateLimiter.allow(cause.category) {
+		m.refundSharedBudget()
+		return res, errors.Annotatef(ErrCategoryRateLimited, "category: %v", cause.category)
+	}
+	if h != nil {
+		m.recoveredCategories[cause.category] = struct{}{}
+		// Only occurrences admitted by all budgets are counted, so refusals by other limits don't add up.
+		if m.errFrequency != nil {
+			m.errFrequency.record(cause.category, m.nowFunc())
+		}
+	}
+	m.curRecoveryCnt++
+	m.lifetimeRecoveryCnt++
+	if m.aggregator != nil {
+		m.aggregator.recoveryCnt.Add(1)
+	}
+
+	now := m.nowFunc()
+	if m.curRecoveryCnt == 1 {
+		m.firstRecoveryTime = now
+	}
+	event := RecoveryEvent{
+		Time:       now,
+		Attempt:    m.curRecoveryCnt,
+		Category:   cause.category,
+		StoreAddr:  info.StoreAddr,
+		FragmentID: info.FragmentID,
+	}
+	if len(info.StoreAddr) != 0 && !m.observabilityDisabled {
+		m.mu.Lock()
+		m.mu.storeRecoveryCnt[info.StoreAddr]++
+		m.mu.Unlock()
+	}
+	if info.FragmentID != 0 && !m.observabilityDisabled {
+		m.mu.Lock()
+		m.mu.fragmentRecoveryCnt[info.FragmentID]++
+		m.mu.Unlock()
+	}
+	if h == nil {
+		err = errors.New("no handler to recovery this type of mpp err")
+	} else {
+		event.Handler = h.name()
+		if !m.observabilityDisabled {
+			m.mu.Lock()
+			m.mu.handlerRecoveryCnt[event.Handler]++
+			m.mu.Unlock()
+		}
+		m.lastClassification.attempted = true
+		m.autoScaler.retries = 0
+		res, err = m.runHandler(ctx, h, cause.category, info, nodeCnt)
+		event.NodeCnt = res.RequestedNodeCnt
+		if err == nil {
+			// Only the node cnt actually requested from AutoScaler is charged.
+			m.cumulativeNodeCnt += res.RequestedNodeCnt
+		}
+		event.InnerRetries = m.autoScaler.retries
+		m.innerRetryCnt += uint64(m.autoScaler.retries)
+		m.trackRecoveryOutcome(cause.category, err == nil)
+	}
+	m.recordEvent(event, err)
+	if err == nil && prefixRows > 0 {
+		// Held rows before the resume offset won't be produced again, keep them to be flushed.
+		if err = m.holder.truncateHeldRows(prefixRows); err != nil {
+			return res, errors.Annotate(err, "truncate held rows to the prefix before resume offset")
+		}
+		res.Action = RecoveryActionFlushPrefixThenResume
+		res.PrefixRows = prefixRows
+		res.StreamedRows = m.streamedRows
+		return res, nil
+	}
+	if err == nil && m.autoResetOnRecovery {
+		// Held chunks are stale because MPP tasks will be re-dispatched from scratch.
+		m.ResetHolder()
+	}
+	if err == nil && m.windowStreaming() {
+		// Held window is stale, the re-dispatched results are held from scratch, skipping the streamed rows.
+		res.StreamedRows = m.streamedRows
+		m.ResetHolder()
+		m.holder.startStreaming()
+	}
+	return res, err
+}
+
+// resumePrefixRows returns the held rows before info.ResumeOffset, which must be flushed before resuming.
+// Resume offset is only supported by the default holder, and ignored if the handler is not order sensitive.
+func (m *RecoveryHandler) resumePrefixRows(info *RecoveryInfo) (uint64, error) {
+	if !m.orderSensitive || info.ResumeOffset <= m.streamedRows {
+		return 0, nil
+	}
+	prefixRows := info.ResumeOffset - m.streamedRows
+	if m.resultHolder != ResultHolder(m.holder) || prefixRows > m.holder.heldRows() {
+		return 0, errors.Annotatef(ErrResumeOffsetOutOfRange, "resume offset: %v, streamed rows: %v, held rows: %v",
+			info.ResumeOffset, m.streamedRows, m.resultHolder.Stats().NumRows)
+	}
+	return prefixRows, nil
+}
+
+// SetOrderSensitive sets whether recovery must preserve the original order of results, it's true by default.
+// If true, resuming from RecoveryInfo.ResumeOffset flushes the held prefix first, and recovery in streaming window
+// mode skips streamed rows of the re-dispatched results, so results are re-streamed in order. If false, like the
+// results of a plan without ORDER BY, recovery simply re-dispatches MPP tasks from scratch, which is cheaper, and
+// it's refused once any row is streamed in streaming window mode, because streamed rows cannot be skipped.
+func (m *RecoveryHandler) SetOrderSensitive(orderSensitive bool) {
+	m.orderSensitive = orderSensitive
+}
+
+// SetPartialResultsOnDisabled sets whether held rows are returned as partial results with a warning when recovery
+// is disabled, instead of failing the query, which suits best-effort analytics. Then Recovery() returns
+// RecoveryActionReturnPartialWithWarning if any row is held, and the held chunks can be popped by PopFrontChk().
+func (m *RecoveryHandler) SetPartialResultsOnDisabled(enabled bool) {
+	m.partialOnDisabled = enabled
+}
+
+// returnPartial stops holding, so the held rows are all the results of statement.
+func (m *RecoveryHandler) returnPartial(info *RecoveryInfo, rows uint64) RecoveryResult {
+	m.partialReturned = true
+	m.stopHolding(cannotHoldReasonDisabled)
+	logutil.BgLogger().Warn("return partial results of mpp query because recovery is disabled",
+		zap.Uint64("rows", rows), zap.String("correlationID", m.correlationID), zap.Error(info.MPPErr))
+	return RecoveryResult{
+		Action:      RecoveryActionReturnPartialWithWarning,
+		PartialRows: rows,
+		Warning:     errors.Annotatef(info.MPPErr, "MPP query returns %d partial row(s) because error recovery is disabled", rows),
+	}
+}
+
+// checkRecoverable returns error if the mpp err cannot be recovered, otherwise returns the handler and the cause to recovery.
+// h is nil if no handler can recovery the mpp err, which still consumes recovery count.
+// The recovery decider is skipped if skipDecider is true, then it has no side effect and can be used by DebugClassify().
+func (m *RecoveryHandler) checkRecoverable(info *RecoveryInfo, skipDecider bool) (h handlerImpl, cause classifiedErr, err error) {
+	if !m.enable {
+		return nil, cause, ErrRecoveryDisabled
+	}
+
+	if info == nil || info.MPPErr == nil {
+		return nil, cause, errors.New("RecoveryInfo is nil or mppErr is nil")
+	}
+
+	if m.streamingRefused() {
+		return nil, cause, ErrResultsAlreadyStreamed
+	}
+
+	if !m.orderSensitive && m.windowStreaming() && m.streamedRows > 0 {
+		return nil, cause, errors.Annotatef(ErrResultsAlreadyStreamed, "streamed rows: %v, results are not order sensitive",
+			m.streamedRows)
+	}
+
+	if m.holder.isKilled() {
+		return nil, cause, errors.Annotate(ErrNonRecoverable, "session is killed")
+	}
+
+	if !m.contextErrRecoverable && isContextDoneErr(info.MPPErr) {
+		return nil, cause, errors.Annotatef(ErrNonRecoverable, "mpp err is caused by context done: %v", info.MPPErr)
+	}
+
+	if m.curRecoveryCnt >= m.maxRecoveryCnt {
+		return nil, cause, errors.Annotatef(ErrRecoveryExhausted, "cur: %v, max: %v", m.curRecoveryCnt, m.maxRecoveryCnt)
+	}
+	if m.sharedBudget != nil && m.sharedBudget.Load() == 0 {
+		return nil, cause, errors.Annotate(ErrRecoveryExhausted, "shared budget is used up")
+	}
+
+	if m.decider != nil && !skipDecider {
+		if h, cause, err = m.decide(info); err != nil {
+			return nil, cause, err
+		}
+		return h, cause, m.checkRecoveryTypeSupported(h, info)
+	}
+	h, cause, fatal := m.chooseHandler(info.MPPErr)
+	if fatal {
+		return nil, cause, errors.Annotatef(ErrNonRecoverable, "mpp err is fatal: %v", cause.err)
+	}
+	if h != nil && !m.categoryAllowed(cause.category) {
+		return nil, cause, errors.Annotatef(ErrTooManyCategories, "category: %v, max: %v", cause.category, m.maxDistinctCategories)
+	}
+	if err = m.checkRecoveryTypeSupported(h, info); err != nil {
+		return nil, cause, err
+	}
+	return h, cause, nil
+}
+
+// checkRecoveryTypeSupported returns ErrNonRecoverable if h requires a recovery type that AutoScaler doesn't support,
+// so the attempt is not wasted.
+func (m *RecoveryHandler) checkRecoveryTypeSupported(h handlerImpl, info *RecoveryInfo) error {
+	r, ok := h.(recoveryTypeRequirer)
+	if !ok {
+		return nil
+	}
+	if recoveryType, required := r.requiredRecoveryType(info); required && !m.autoScaler.supports(recoveryType) {
+		return errors.Annotatef(ErrNonRecoverable, "recovery type %v of handler %v is not supported by AutoScaler",
+			recoveryType, h.name())
+	}
+	return nil
+}
+
+// consumeSharedBudget consumes one from the shared budget, it returns false if budget is used up.
+func (m *RecoveryHandler) consumeSharedBudget() bool {
+	if m.sharedBudget == nil {
+		return true
+	}
+	for {
+		budget := m.sharedBudget.Load()
+		if budget == 0 {
+			return false
+		}
+		if m.sharedBudget.CompareAndSwap(budget, budget-1) {
+			return true
+		}
+	}
+}
+
+// refundSharedBudget gives back the budget consumed by a refused attempt.
+func (m *RecoveryHandler) refundSharedBudget() {
+	if m.sharedBudget != nil {
+		m.sharedBudget.Add(1)
+	}
+}
+
+// BuildClientError annotates origErr with the recovery context of this statement, like attempts made, recovered
+// categories and whether recovery is exhausted, so users understand the query was retried before it fails.
+// origErr is returned as is if no recovery is attempted or refused, and errors.Cause() of result is still origErr.
+func (m *RecoveryHandler) BuildClientError(origErr error) error {
+	if origErr == nil || (m.curRecoveryCnt == 0 && !m.stmtExhausted) {
+		return origErr
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "MPP query failed after %d recovery attempt(s)", m.curRecoveryCnt)
+	if len(m.recoveredCategories) > 0 {
+		categories := make([]string, 0, len(m.recoveredCategories))
+		for category := range m.recoveredCategories {
+			categories = append(categories, category.String())
+		}
+		slices.Sort(categories)
+		fmt.Fprintf(&sb, " for %s", strings.Join(categories, ", "))
+	}
+	if m.stmtExhausted {
+		sb.WriteString(", recovery budget is exhausted")
+	}
+	return errors.Annotate(origErr, sb.String())
+}
+
+// DebugClassify returns how Recovery would handle err without any side effect, which helps to debug why recovery
+// doesn't happen. normalized is the normalized message of the cause that decides the category and handler.
+// The user defined RecoveryDecider is not called, so matchedHandler and wouldRecover are always the verdict of
+// the built-in handlers, even if Recovery would ask the decider instead.
+func (m *RecoveryHandler) DebugClassify(err error) (normalized string, category RecoveryErrorCategory, matchedHandler string, wouldRecover bool) {
+	if err == nil {
+		return "", CategoryUnknown, "", false
+	}
+	h, cause, _ := m.chooseHandler(err)
+	if h != nil {
+		matchedHandler = h.name()
+	}
+	checkedHandler, _, checkErr := m.checkRecoverable(&RecoveryInfo{MPPErr: err}, true)
+	return normalizeErrMsg(cause.err), cause.category, matchedHandler, checkErr == nil && checkedHandler != nil
+}
+
+type recoveryClassification struct {
+	category    RecoveryErrorCategory
+	recoverable bool
+	attempted   bool
+}
+
+// classifyForRecovery returns whether the mpp err is recoverable by its nature, regardless of limits like
+// maxRecoveryCnt. attempted is always false.
+func (m *RecoveryHandler) classifyForRecovery(info *RecoveryInfo) recoveryClassification {
+	if info == nil || info.MPPErr == nil {
+		return recoveryClassification{}
+	}
+	h, cause, fatal := m.chooseHandler(info.MPPErr)
+	return recoveryClassification{
+		category:    cause.category,
+		recoverable: h != nil && !fatal && (m.contextErrRecoverable || !isContextDoneErr(info.MPPErr)),
+	}
+}
+
+// LastClassification returns the decision of the most recent Recovery call, which helps precise error reporting.
+// recoverable is true if the mpp err has a handler to recovery it and isn't fatal. attempted is true if the handler
+// is called, so recoverable but not attempted means recovery is refused intentionally, like exceeding maxRecoveryCnt.
+// All are zero values if Recovery isn't called since the handler is created or ResetAll() is called.
+func (m *RecoveryHandler) LastClassification() (category RecoveryErrorCategory, recoverable bool, attempted bool) {
+	c := m.lastClassification
+	return c.category, c.recoverable, c.attempted
+}
+
+// RecoveryAsync runs Recovery in another goroutine and delivers the error returned by it on the returned channel,
+// so the caller goroutine isn't blocked by the AutoScaler call. Only one async recovery may be in flight at a time,
+// Recovery and RecoveryAsync called before the error is delivered get ErrRecoveryInFlight immediately. Except Stats,
+// other methods of RecoveryHandler must not be called until the error is received, receiving from the channel makes
+// all state mutations of Recovery visible.
+func (m *RecoveryHandler) RecoveryAsync(ctx context.Context, info *RecoveryInfo) <-chan error {
+	errCh := make(chan error, 1)
+	if !m.asyncInFlight.CompareAndSwap(false, true) {
+		errCh <- ErrRecoveryInFlight
+		return errCh
+	}
+	go func() {
+		_, err := m.recovery(ctx, info)
+		m.asyncInFlight.Store(false)
+		errCh <- err
+	}()
+	return errCh
+}
+
+// markStmtStart records the start time of statement if it's not recorded.
+func (m *RecoveryHandler) markStmtStart() {
+	if m.stmtStartTime.IsZero() {
+		m.stmtStartTime = m.nowFunc()
+	}
+}
+
+// TimeToFirstRecovery returns how long after the statement starts the first recovery is attempted, ok is false if
+// no recovery is attempted in this statement. The statement starts at the first HoldResult() or Recovery() call
+// after ResetRecoveryCnt().
+func (m *RecoveryHandler) TimeToFirstRecovery() (d time.Duration, ok bool) {
+	if m.firstRecoveryTime.IsZero() {
+		return 0, false
+	}
+	return m.firstRecoveryTime.Sub(m.stmtStartTime), true
+}
+
+// ConcurrentRecoveryPolicy decides how Recovery calls are handled when another Recovery is running, like multiple
+// failing fragments of the same statement call Recovery simultaneously.
+type ConcurrentRecoveryPolicy int
+
+const (
+	// ConcurrentRecoveryCoalesce makes concurrent calls wait and share the outcome of the running one, so they don't
+	// call AutoScaler redundantly. It's the default policy.
+	ConcurrentRecoveryCoalesce ConcurrentRecoveryPolicy = iota
+	// ConcurrentRecoveryIndependent makes concurrent calls run one by one, each of them counts independently.
+	ConcurrentRecoveryIndependent
+)
+
+// SetConcurrentRecoveryPolicy sets how concurrent Recovery calls are handled.
+func (m *RecoveryHandler) SetConcurrentRecoveryPolicy(policy ConcurrentRecoveryPolicy) {
+	m.concurrentPolicy = policy
+}
+
+// callDecider calls the user defined decider, Recovery called by it is refused as reentrant.
+func (m *RecoveryHandler) callDecider(info *RecoveryInfo) (shouldRecover bool, recoveryType tiflashcompute.RecoveryType, nodeCnt int) {
+	m.inUserCallback.Store(true)
+	defer m.inUserCallback.Store(false)
+	m.publishStats()
+	return m.decider(info, m.Stats())
+}
+
+// recoveryCtxKey marks the ctx passed to user defined handlers, the value is the RecoveryHandler.
+type recoveryCtxKey struct{}
+
+// beginRecovery waits for the running Recovery by concurrentPolicy. run is true if the caller should run recovery,
+// otherwise the caller is coalesced and res and err are the outcome of the running one. Waiting isn't aware of ctx,
+// which is bounded by the running one.
+func (m *RecoveryHandler) beginRecovery() (run bool, res RecoveryResult, err error) {
+	m.flight.Lock()
+	defer m.flight.Unlock()
+	if m.inRecovery.Load() && m.concurrentPolicy == ConcurrentRecoveryCoalesce {
+		gen := m.flight.gen
+		m.flight.waiters++
+		for m.flight.gen == gen {
+			m.flight.cond.Wait()
+		}
+		m.flight.waiters--
+		return false, m.flight.res, m.flight.err
+	}
+	m.flight.waiters++
+	for m.inRecovery.Load() {
+		m.flight.cond.Wait()
+	}
+	m.flight.waiters--
+	m.inRecovery.Store(true)
+	return true, res, nil
+}
+
+// endRecovery publishes the outcome of Recovery to coalesced calls, and wakes up the waiting calls.
+func (m *RecoveryHandler) endRecovery(res RecoveryResult, err error) {
+	m.flight.Lock()
+	m.flight.gen++
+	m.flight.res, m.flight.err = res, err
+	m.inRecovery.Store(false)
+	m.flight.Unlock()
+	m.flight.cond.Broadcast()
+}
+
+// runHandler runs doRecovery of h for category, which is bounded by the timeout of category if it's set.
+func (m *RecoveryHandler) runHandler(ctx context.Context, h handlerImpl, category RecoveryErrorCategory, info *RecoveryInfo, nodeCnt int) (RecoveryResult, error) {
+	if _, ok := h.(*fallbackHandlerImpl); ok {
+		// Only user defined handler may call Recovery again, so mark ctx to detect reentrancy. Built-in handlers
+		// don't need it, which keeps recovery allocation free.
+		ctx = context.WithValue(ctx, recoveryCtxKey{}, m)
+		m.inUserCallback.Store(true)
+		defer m.inUserCallback.Store(false)
+	}
+	timeout := m.handlerTimeout
+	if categoryTimeout, ok := m.categoryTimeouts[category]; ok {
+		timeout = categoryTimeout
+	}
+	if timeout <= 0 {
+		return h.doRecovery(ctx, info, nodeCnt)
+	}
+	handlerCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res, err := h.doRecovery(handlerCtx, info, nodeCnt)
+	if err != nil && ctx.Err() == nil && handlerCtx.Err() == context.DeadlineExceeded {
+		return res, errors.Annotatef(ErrHandlerTimeout, "handler: %s, category: %v, timeout: %v", h.name(), category, timeout)
+	}
+	return res, err
+}
+
+// SetFirstRecoveryGrace sets the delay before the first recovery attempt of a statement, which gives
+// flaky-but-self-healing clusters a chance to recover by themselves. Following attempts are not delayed.
+func (m *RecoveryHandler) SetFirstRecoveryGrace(grace time.Duration) {
+	m.firstRecoveryGrace = grace
+}
+
+// waitFirstRecoveryGrace waits firstRecoveryGrace before the first recovery attempt.
+// It returns ctx.Err() if ctx is done while waiting.
+func (m *RecoveryHandler) waitFirstRecoveryGrace(ctx context.Context) error {
+	if m.firstRecoveryGrace <= 0 || m.curRecoveryCnt != 0 {
+		return nil
+	}
+	select {
+	case <-m.afterFunc(m.firstRecoveryGrace):
+		return nil
+	case <-ctx.Done():
+		return errors.Annotate(ctx.Err(), "wait grace period before first recovery")
+	}
+}
+
+// SetReplicaUnavailableWait sets the duration to wait before re-dispatching MPP tasks when TiFlash replica is
+// unavailable, which gives the replica time to be ready. 0 means re-dispatch immediately.
+func (m *RecoveryHandler) SetReplicaUnavailableWait(wait time.Duration) {
+	m.replicaWait = wait
+}
+
+// SetAutoResetOnRecovery sets whether to reset the holder automatically after a successful recovery,
+// so the caller doesn't need to call ResetHolder(). The recovery count is not reset.
+func (m *RecoveryHandler) SetAutoResetOnRecovery(autoReset bool) {
+	m.autoResetOnRecovery = autoReset
+}
+
+// SetHandlerTimeout sets the timeout of each handler in one recovery, 0 means no timeout.
+// So one slow handler, like waiting for AutoScaler, doesn't consume the whole time of the query.
+func (m *RecoveryHandler) SetHandlerTimeout(timeout time.Duration) {
+	m.handlerTimeout = timeout
+}
+
+// SetCategoryTimeouts overrides the handler timeout for each error category, like the recovery type mapping, so slow
+// but expected operations, like rescale of mem limit errors waiting for AutoScaler provisioning, aren't cut off while
+// fast ones are bounded tightly. Categories not in timeouts use the timeout set by SetHandlerTimeout(), and 0 means
+// no timeout for the category.
+func (m *RecoveryHandler) SetCategoryTimeouts(timeouts map[RecoveryErrorCategory]time.Duration) {
+	m.categoryTimeouts = maps.Clone(timeouts)
+}
+
+// SetCategoryRateLimiter sets the limiter shared across handlers to suppress recovery storms of a category.
+func (m *RecoveryHandler) SetCategoryRateLimiter(limiter *CategoryRateLimiter) {
+	m.rateLimiter = limiter
+}
+
+// SetErrFrequencyLimit refuses recovery of a category if it occurs more than threshold times within window,
+// because the error that keeps occurring is likely unrecoverable. Occurrences refused by other limits, like the
+// recovery budget or the rate limiter, are not counted. Occurrences are kept across statements until ResetAll()
+// is called. window or threshold <= 0 means no limit.
+func (m *RecoveryHandler) SetErrFrequencyLimit(window time.Duration, threshold int) {
+	if window <= 0 || threshold <= 0 {
+		m.errFrequency = nil
+		return
+	}
+	m.errFrequency = newErrFrequencyTracker(window, threshold)
+}
+
+// SetMaxDistinctCategories sets the max number of distinct error categories that can be recovered in one statement.
+// Recovery of a new category is refused once exceeded. 0 means no limit.
+func (m *RecoveryHandler) SetMaxDistinctCategories(maxCnt int) {
+	m.maxDistinctCategories = maxCnt
+}
+
+// categoryAllowed returns false if category is new and too many categories are recovered.
+func (m *RecoveryHandler) categoryAllowed(category RecoveryErrorCategory) bool {
+	if _, ok := m.recoveredCategories[category]; ok {
+		return true
+	}
+	return m.maxDistinctCategories <= 0 || len(m.recoveredCategories) < m.maxDistinctCategories
+}
+
+// chooseHandler returns the handler to recovery mppErr and the cause it handles.
+// MPPErr may be a multi-error, its causes are tried from the most severe one, see classifyErr().
+// The fallback handler is only chosen when no specific handler accepts any cause.
+// Causes of disabled categories are skipped, see SetCategoryEnabled().
+// fatal is true if a handler reports any cause is fatal, then no handler is chosen.
+func (m *RecoveryHandler) chooseHandler(mppErr error) (_ handlerImpl, _ classifiedErr, fatal bool) {
+	m.causesBuf = appendClassifiedErrs(m.causesBuf[:0], mppErr, m.categorySeverity)
+	causes := m.causesBuf
+	// Any fatal cause makes the whole mpp err unrecoverable, so check them before choosing handler.
+	for _, cause := range causes {
+		for _, h := range m.handlers {
+			if c, ok := h.(fatalErrClassifier); ok && c.isFatalErr(cause.err) {
+				return nil, cause, true
+			}
+		}
+	}
+	var firstEnabled *classifiedErr
+	for i, cause := range causes {
+		if _, disabled := m.disabledCategories[cause.category]; disabled {
+			continue
+		}
+		if firstEnabled == nil {
+			firstEnabled = &causes[i]
+		}
+		for _, h := range m.handlers {
+			if h.chooseHandlerImpl(cause.err) {
+				return h, cause, false
+			}
+		}
+	}
+	if m.fallback != nil && firstEnabled != nil {
+		return m.fallback, *firstEnabled, false
+	}
+	return nil, causes[0], false
+}
+
+// SetCategorySeverity overrides the severity of categories, the bigger the value, the more severe the category.
+// The most severe cause of a multi-error is tried first and is logged when recovery is exhausted.
+// Categories not in severity keep the default severity.
+func (m *RecoveryHandler) SetCategorySeverity(severity map[RecoveryErrorCategory]int) {
+	categorySeverity := make(map[RecoveryErrorCategory]int, len(defaultCategorySeverity))
+	for category, s := range defaultCategorySeverity {
+		categorySeverity[category] = s
+	}
+	for category, s := range severity {
+		categorySeverity[category] = s
+	}
+	m.categorySeverity = categorySeverity
+}
+
+// SetCategoryEnabled enables or disables recovery of the category, all categories are enabled by default.
+// It takes effect only when recovery is enabled.
+func (m *RecoveryHandler) SetCategoryEnabled(category RecoveryErrorCategory, enabled bool) {
+	if enabled {
+		delete(m.disabledCategories, category)
+	} else {
+		m.disabledCategories[category] = struct{}{}
+	}
+}
+
+// SetConsecutiveFailureThreshold disables recovery of category after it fails to recover in threshold consecutive
+// statements, which likely indicates a persistent cluster problem. A statement fails if recovery of the category
+// returns error or is exhausted, and a successful recovery resets the count. The count survives ResetHolder() and
+// ResetRecoveryCnt(), and the category keeps disabled until ResetConsecutiveFailures() or ResetAll() is called.
+// threshold <= 0 means never disable the category, which is the default.
+func (m *RecoveryHandler) SetConsecutiveFailureThreshold(category RecoveryErrorCategory, threshold int) {
+	if threshold <= 0 {
+		delete(m.failureThresholds, category)
+		return
+	}
+	if m.failureThresholds == nil {
+		m.failureThresholds = make(map[RecoveryErrorCategory]int)
+		m.consecutiveFailures = make(map[RecoveryErrorCategory]int)
+		m.stmtFailedCategories = make(map[RecoveryErrorCategory]struct{})
+		m.autoDisabledCategories = make(map[RecoveryErrorCategory]struct{})
+	}
+	m.failureThresholds[category] = threshold
+}
+
+// ConsecutiveFailures returns the number of consecutive statements in which category fails to recover.
+func (m *RecoveryHandler) ConsecutiveFailures(category RecoveryErrorCategory) int {
+	return m.consecutiveFailures[category]
+}
+
+// ResetConsecutiveFailures forgets the consecutive failures, and enables the categories disabled by them.
+func (m *RecoveryHandler) ResetConsecutiveFailures() {
+	for category := range m.autoDisabledCategories {
+		delete(m.disabledCategories, category)
+	}
+	clear(m.autoDisabledCategories)
+	clear(m.consecutiveFailures)
+	clear(m.stmtFailedCategories)
+}
+
+// trackRecoveryOutcome counts the statement as failed for category at its first failure, and disables category
+// once the threshold is reached.
+func (m *RecoveryHandler) trackRecoveryOutcome(category RecoveryErrorCategory, succeeded bool) {
+	threshold, ok := m.failureThresholds[category]
+	if !ok {
+		return
+	}
+	if succeeded {
+		m.consecutiveFailures[category] = 0
+		return
+	}
+	if _, failed := m.stmtFailedCategories[category]; failed {
+		return
+	}
+	m.stmtFailedCategories[category] = struct{}{}
+	m.consecutiveFailures[category]++
+	if m.consecutiveFailures[category] >= threshold {
+		logutil.BgLogger().Warn("disable recovery of category after consecutive failed statements",
+			zap.Stringer("category", category), zap.Int("threshold", threshold), zap.String("correlationID", m.correlationID))
+		m.disabledCategories[category] = struct{}{}
+		m.autoDisabledCategories[category] = struct{}{}
+	}
+}
+
+// RecoveryDecider decides whether to recovery the mpp err, and the recovery type and node cnt passed to AutoScaler.
+// nodeCnt <= 0 means using the node cnt computed by NodeCntPolicy.
+type RecoveryDecider func(info *RecoveryInfo, stats RecoveryStats) (shouldRecover bool, recoveryType tiflashcompute.RecoveryType, nodeCnt int)
+
+// SetRecoveryDecider sets the callback that decides recoverability programmatically. It overrides handler selection
+// entirely, including fatal errs, disabled categories and fallback handler. Limits like maxRecoveryCnt still apply.
+// nil means using the builtin handlers, which is the default.
+func (m *RecoveryHandler) SetRecoveryDecider(decider RecoveryDecider) {
+	m.decider = decider
+}
+
+// decide returns the handler to recovery by decider.
+func (m *RecoveryHandler) decide(info *RecoveryInfo) (handlerImpl, classifiedErr, error) {
+	m.causesBuf = appendClassifiedErrs(m.causesBuf[:0], info.MPPErr, m.categorySeverity)
+	cause := m.causesBuf[0]
+	shouldRecover, recoveryType, nodeCnt := m.callDecider(info)
+	if !shouldRecover {
+		return nil, cause, errors.Annotatef(ErrNonRecoverable, "refused by recovery decider: %v", info.MPPErr)
+	}
+	return &deciderHandlerImpl{autoScaler: m.autoScaler, recoveryType: recoveryType, nodeCnt: nodeCnt}, cause, nil
+}
+
+// SetFallbackHandler sets the handler that is used when no specific handler can recovery the mpp err.
+// Recovery by fallback handler also counts against max recovery cnt.
+func (m *RecoveryHandler) SetFallbackHandler(h Handler) {
+	if h == nil {
+		m.fallback = nil
+		return
+	}
+	m.fallback = &fallbackHandlerImpl{h: h}
+}
+
+// Handler is the interface of user defined recovery handler.
+type Handler interface {
+	// DoRecovery recovery the mpp err, nodeCnt is computed by NodeCntPolicy.
+	DoRecovery(ctx context.Context, info *RecoveryInfo, nodeCnt int) error
+}
+
+type handlerImpl interface {
+	// name is used in stats and events.
+	name() string
+	chooseHandlerImpl(mppErr error) bool
+	// doRecovery recovery the error, nodeCnt is computed by NodeCntPolicy.
+	doRecovery(ctx context.Context, info *RecoveryInfo, nodeCnt int) (RecoveryResult, error)
+}
+
+// recoveryTypeRequirer is optionally implemented by handlerImpl that calls AutoScaler, so it's not chosen if its
+// recovery type is not supported. required is false if AutoScaler won't be called for info.
+type recoveryTypeRequirer interface {
+	requiredRecoveryType(info *RecoveryInfo) (recoveryType tiflashcompute.RecoveryType, required bool)
+}
+
+// callsAutoScaler returns whether h calls AutoScaler with the node cnt for info.
+func callsAutoScaler(h handlerImpl, info *RecoveryInfo) bool {
+	r, ok := h.(recoveryTypeRequirer)
+	if !ok {
+		return false
+	}
+	_, required := r.requiredRecoveryType(info)
+	return required
+}
+
+// requiresNodeCnt returns whether h needs a known node cnt for info, the user defined handler is assumed to call
+// AutoScaler. Other handlers only re-dispatch MPP tasks, so they don't need a known node cnt.
+func requiresNodeCnt(h handlerImpl, info *RecoveryInfo) bool {
+	_, ok := h.(*fallbackHandlerImpl)
+	return ok || callsAutoScaler(h, info)
+}
+
+// fatalErrClassifier is optionally implemented by handlerImpl to report the mpp err is fatal, like version mismatch.
+// Then no handler is evaluated, so a lower-priority handler never tries to recovery a fatal err.
+type fatalErrClassifier interface {
+	isFatalErr(mppErr error) bool
+}
+
+var _ handlerImpl = &memLimitHandlerImpl{}
+var _ handlerImpl = &exchangeReceiverHandlerImpl{}
+var _ handlerImpl = &fallbackHandlerImpl{}
+var _ handlerImpl = &replicaUnavailableHandlerImpl{}
+var _ handlerImpl = &staleSnapshotHandlerImpl{}
+var _ handlerImpl = &deciderHandlerImpl{}
+var _ fatalErrClassifier = &memLimitHandlerImpl{}
+var _ recoveryTypeRequirer = &memLimitHandlerImpl{}
+var _ recoveryTypeRequirer = &deciderHandlerImpl{}
+
+const (
+	memLimitHandlerName           = "mem_limit"
+	exchangeReceiverHandlerName   = "exchange_receiver"
+	replicaUnavailableHandlerName = "replica_unavailable"
+	staleSnapshotHandlerName      = "stale_snapshot"
+	fallbackHandlerName           = "fallback"
+	deciderHandlerName            = "decider"
+)
+
+type memLimitHandlerImpl struct {
+	useAutoScaler bool
+	autoScaler    *autoScalerCaller
+}
+
+func newMemLimitHandlerImpl(useAutoScaler bool, autoScaler *autoScalerCaller) *memLimitHandlerImpl {
+	return &memLimitHandlerImpl{
+		useAutoScaler: useAutoScaler,
+		autoScaler:    autoScaler,
+	}
+}
+
+func (*memLimitHandlerImpl) name() string {
+	return memLimitHandlerName
+}
+
+// isFatalErr implements fatalErrClassifier interface.
+func (*memLimitHandlerImpl) isFatalErr(mppErr error) bool {
+	return isMemLimitFatalErr(mppErr)
+}
+
+func (h *memLimitHandlerImpl) chooseHandlerImpl(mppErr error) bool {
+	// Decline if AutoScaler is unavailable, so other handlers can still run.
+	if classifyLeafErr(mppErr) == CategoryMemLimit && h.useAutoScaler && !h.autoScaler.unavailable {
+		return true
+	}
+	return false
+}
+
+// requiredRecoveryType implements recoveryTypeRequirer interface.
+func (h *memLimitHandlerImpl) requiredRecoveryType(info *RecoveryInfo) (tiflashcompute.RecoveryType, bool) {
+	return h.autoScaler.recoveryTypeOf(CategoryMemLimit, tiflashcompute.RecoveryTypeMemLimit), h.autoScaler.shouldRescale(info)
+}
+
+func (h *memLimitHandlerImpl) doRecovery(ctx context.Context, info *RecoveryInfo, nodeCnt int) (RecoveryResult, error) {
+	if !h.autoScaler.shouldRescale(info) {
+		return RecoveryResult{Action: RecoveryActionRedispatch}, nil
+	}
+	recoveryType := h.autoScaler.recoveryTypeOf(CategoryMemLimit, tiflashcompute.RecoveryTypeMemLimit)
+	return h.autoScaler.rescale(ctx, info, recoveryType, nodeCnt)
+}
+
+// deciderHandlerImpl rescales by the recovery type and node cnt decided by RecoveryDecider.
+type deciderHandlerImpl struct {
+	autoScaler   *autoScalerCaller
+	recoveryType tiflashcompute.RecoveryType
+	// nodeCnt overrides the node cnt computed by NodeCntPolicy if it's positive.
+	nodeCnt int
+}
+
+func (*deciderHandlerImpl) name() string {
+	return deciderHandlerName
+}
+
+// chooseHandlerImpl is not used, because RecoveryDecider has decided to recovery.
+func (*deciderHandlerImpl) chooseHandlerImpl(error) bool {
+	return true
+}
+
+// requiredRecoveryType implements recoveryTypeRequirer interface.
+func (h *deciderHandlerImpl) requiredRecoveryType(*RecoveryInfo) (tiflashcompute.RecoveryType, bool) {
+	return h.recoveryType, true
+}
+
+func (h *deciderHandlerImpl) doRecovery(ctx context.Context, info *RecoveryInfo, nodeCnt int) (RecoveryResult, error) {
+	return h.autoScaler.rescale(ctx, info, h.recoveryType, nodeCnt)
+}
+
+// exchangeReceiverHandlerImpl handles broken data streams between MPP tasks,
+// which can be recovered by re-dispatching MPP tasks without rescale.
+type exchangeReceiverHandlerImpl struct{}
+
+func (*exchangeReceiverHandlerImpl) name() string {
+	return exchangeReceiverHandlerName
+}
+
+func (*exchangeReceiverHandlerImpl) chooseHandlerImpl(mppErr error) bool {
+	return classifyLeafErr(mppErr) == CategoryExchangeReceiver
+}
+
+func (*exchangeReceiverHandlerImpl) doRecovery(context.Context, *RecoveryInfo, int) (RecoveryResult, error) {
+	return RecoveryResult{Action: RecoveryActionRedispatch}, nil
+}
+
+// defaultReplicaWait is the default duration to wait when TiFlash replica is unavailable.
+const defaultReplicaWait = time.Second
+
+// replicaUnavailableHandlerImpl waits for the TiFlash replica to be available, then re-dispatches MPP tasks.
+// Rescale cannot help because the replica is not ready.
+type replicaUnavailableHandlerImpl struct {
+	// m provides replicaWait and afterFunc.
+	m *RecoveryHandler
+}
+
+func (*replicaUnavailableHandlerImpl) name() string {
+	return replicaUnavailableHandlerName
+}
+
+func (*replicaUnavailableHandlerImpl) chooseHandlerImpl(mppErr error) bool {
+	return classifyLeafErr(mppErr) == CategoryReplicaUnavailable
+}
+
+func (h *replicaUnavailableHandlerImpl) doRecovery(ctx context.Context, _ *RecoveryInfo, _ int) (RecoveryResult, error) {
+	res := RecoveryResult{Action: RecoveryActionRedispatch}
+	if h.m.replicaWait <= 0 {
+		return res, nil
+	}
+	select {
+	case <-h.m.afterFunc(h.m.replicaWait):
+		return res, nil
+	case <-ctx.Done():
+		return res, errors.Annotate(ctx.Err(), "wait for TiFlash replica to be available")
+	}
+}
+
+// staleSnapshotHandlerImpl handles errs caused by stale read TS, which can be recovered by re-dispatching MPP tasks
+// with a refreshed read TS. Rescale cannot help, so AutoScaler isn't called. It only matches if enabled by
+// SetStaleSnapshotRecovery().
+type staleSnapshotHandlerImpl struct {
+	m *RecoveryHandler
+}
+
+func (*staleSnapshotHandlerImpl) name() string {
+	return staleSnapshotHandlerName
+}
+
+func (h *staleSnapshotHandlerImpl) chooseHandlerImpl(mppErr error) bool {
+	return h.m.staleSnapshotRecovery && classifyLeafErr(mppErr) == CategoryStaleSnapshot
+}
+
+func (*staleSnapshotHandlerImpl) doRecovery(context.Context, *RecoveryInfo, int) (RecoveryResult, error) {
+	return RecoveryResult{Action: RecoveryActionRefreshSnapshotAndRetry}, nil
+}
+
+// fallbackHandlerImpl wraps the user defined Handler, it always matches.
+type fallbackHandlerImpl struct {
+	h Handler
+}
+
+func (*fallbackHandlerImpl) name() string {
+	return fallbackHandlerName
+}
+
+func (*fallbackHandlerImpl) chooseHandlerImpl(error) bool {
+	return true
 }
 
-func (h *mppResultHolder) reset() {
-	h.cannotHold = false
-	h.curRows = 0
-	h.chks = h.chks[:0]
-	h.memTracker.Detach()
+// doRecovery returns RecoveryActionRedispatch, because user defined handler cannot rescale by AutoScaler.
+func (h *fallbackHandlerImpl) doRecovery(ctx context.Context, info *RecoveryInfo, nodeCnt int) (RecoveryResult, error) {
+	return RecoveryResult{Action: RecoveryActionRedispatch}, h.h.DoRecovery(ctx, info, nodeCnt)
 }
@@ -0,0 +1,4135 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	perrors "github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/memory"
+	"github.com/pingcap/tidb/pkg/util/sqlkiller"
+	"github.com/pingcap/tidb/pkg/util/tiflashcompute"
+	"github.com/stretchr/testify/require"
+)
+
+type mockTopoFetcher struct {
+	// mu protects all fields except block, because calls abandoned by timeout may still be running.
+	mu   sync.Mutex
+	topo []string
+	err  error
+	// block is waited before RecoveryAndGetTopo returns if it's not nil.
+	block chan struct{}
+
+	recoveryTypes []tiflashcompute.RecoveryType
+	nodeCnts      []int
+}
+
+func newMockTopoFetcher() *mockTopoFetcher {
+	return &mockTopoFetcher{topo: []string{"127.0.0.1:3930"}}
+}
+
+func (f *mockTopoFetcher) FetchAndGetTopo() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.topo, f.err
+}
+
+func (f *mockTopoFetcher) RecoveryAndGetTopo(recovery tiflashcompute.RecoveryType, oriCNCnt int) ([]string, error) {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recoveryTypes = append(f.recoveryTypes, recovery)
+	f.nodeCnts = append(f.nodeCnts, oriCNCnt)
+	return f.topo, f.err
+}
+
+type mockClock struct {
+	now time.Time
+}
+
+func newMockClock() *mockClock {
+	return &mockClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *mockClock) Now() time.Time {
+	return c.now
+}
+
+func (c *mockClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// After advances the clock by d and fires immediately.
+func (c *mockClock) After(d time.Duration) <-chan time.Time {
+	c.Advance(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func newTestRecoveryHandler(holderCap uint64) *RecoveryHandler {
+	return NewRecoveryHandler(true, holderCap, true, memory.NewTracker(-1, -1))
+}
+
+func runRecovery(h *RecoveryHandler, info *RecoveryInfo) error {
+	_, err := h.Recovery(context.Background(), info)
+	return err
+}
+
+func setTestTopoFetcher(h *RecoveryHandler, fetcher tiflashcompute.TopoFetcher) {
+	h.autoScaler.fetcher = fetcher
+}
+
+var testFieldTypes = []*types.FieldType{types.NewFieldType(mysql.TypeLonglong)}
+
+func newTestChunk(rows int) *chunk.Chunk {
+	chk := chunk.NewChunkWithCapacity(testFieldTypes, rows)
+	for i := 0; i < rows; i++ {
+		chk.AppendInt64(0, int64(i))
+	}
+	return chk
+}
+
+func TestHeldAge(t *testing.T) {
+	clock := newMockClock()
+	h := newTestRecoveryHandler(100)
+	h.nowFunc = clock.Now
+
+	require.Equal(t, time.Duration(0), h.OldestHeldAge())
+	require.Equal(t, time.Duration(0), h.NewestHeldAge())
+
+	h.HoldResult(newTestChunk(1))
+	clock.Advance(time.Second)
+	h.HoldResult(newTestChunk(1))
+	clock.Advance(2 * time.Second)
+	h.HoldResult(newTestChunk(1))
+	clock.Advance(3 * time.Second)
+	require.Equal(t, 6*time.Second, h.OldestHeldAge())
+	require.Equal(t, 3*time.Second, h.NewestHeldAge())
+
+	require.NotNil(t, h.PopFrontChk())
+	require.Equal(t, 5*time.Second, h.OldestHeldAge())
+	require.Equal(t, 3*time.Second, h.NewestHeldAge())
+
+	h.ResetHolder()
+	require.Equal(t, time.Duration(0), h.OldestHeldAge())
+	require.Equal(t, time.Duration(0), h.NewestHeldAge())
+}
+
+// emptyMultiErr is a multi-error that may not contain any non-nil error.
+type emptyMultiErr struct {
+	errs []error
+}
+
+func (*emptyMultiErr) Error() string {
+	return "Memory limit exceeded"
+}
+
+func (e *emptyMultiErr) Unwrap() []error {
+	return e.errs
+}
+
+func TestRecoveryMultiError(t *testing.T) {
+	memErr := errors.New("Memory limit (total) exceeded caused by 'RSS(Resident Set Size) much larger than limit'")
+	netErr := errors.New("rpc error: code = Unavailable desc = transport is closing")
+
+	require.Equal(t, CategoryMemLimit, classifyLeafErr(memErr))
+	require.Equal(t, CategoryNetwork, classifyLeafErr(netErr))
+
+	// Memory limit is more severe than network, so it's chosen no matter the order.
+	for _, mppErr := range []error{errors.Join(netErr, memErr), errors.Join(memErr, netErr)} {
+		causes := classifyErr(mppErr, defaultCategorySeverity)
+		require.Len(t, causes, 2)
+		require.Equal(t, CategoryMemLimit, causes[0].category)
+		require.Equal(t, CategoryNetwork, causes[1].category)
+
+		fetcher := newMockTopoFetcher()
+		h := newTestRecoveryHandler(100)
+		setTestTopoFetcher(h, fetcher)
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: mppErr, NodeCnt: 2}))
+		require.Equal(t, []tiflashcompute.RecoveryType{tiflashcompute.RecoveryTypeMemLimit}, fetcher.recoveryTypes)
+	}
+
+	// Nested and wrapped multi-error is flattened.
+	nested := fmt.Errorf("mpp failed: %w", errors.Join(netErr, errors.Join(netErr, memErr)))
+	causes := classifyErr(nested, defaultCategorySeverity)
+	require.Len(t, causes, 3)
+	require.Equal(t, memErr, causes[0].err)
+
+	// Multi-error without non-nil errors is the only leaf itself.
+	for _, empty := range []error{&emptyMultiErr{}, &emptyMultiErr{errs: []error{nil, nil}}, fmt.Errorf("wrapped: %w", &emptyMultiErr{})} {
+		causes = classifyErr(empty, defaultCategorySeverity)
+		require.Len(t, causes, 1)
+		require.Equal(t, empty, causes[0].err)
+		require.Equal(t, CategoryMemLimit, Classify(empty))
+		h := newTestRecoveryHandler(100)
+		setTestTopoFetcher(h, newMockTopoFetcher())
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: empty, NodeCnt: 1}))
+		h.maxRecoveryCnt = 1
+		require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: empty, NodeCnt: 1}), ErrRecoveryExhausted)
+		h.SetRecoveryDecider(func(*RecoveryInfo, RecoveryStats) (bool, tiflashcompute.RecoveryType, int) {
+			return false, tiflashcompute.RecoveryTypeMemLimit, 0
+		})
+		h.ResetRecoveryCnt()
+		require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: empty, NodeCnt: 1}), ErrNonRecoverable)
+	}
+
+	// No handler for network err.
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	err := runRecovery(h, &RecoveryInfo{MPPErr: errors.Join(netErr, netErr), NodeCnt: 2})
+	require.ErrorContains(t, err, "no handler to recovery")
+	require.Empty(t, fetcher.recoveryTypes)
+}
+
+func TestNodeGroupThrottler(t *testing.T) {
+	memErr := errors.New("Memory limit exceeded")
+	clock := newMockClock()
+	throttler := NewNodeGroupThrottler(time.Minute, NodeGroupThrottleReject)
+	throttler.nowFunc = clock.Now
+
+	fetcher := newMockTopoFetcher()
+	newHandler := func() *RecoveryHandler {
+		h := newTestRecoveryHandler(100)
+		setTestTopoFetcher(h, fetcher)
+		h.SetNodeGroupThrottler(throttler)
+		return h
+	}
+
+	// Throttler is shared by handlers, and each group is throttled independently.
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 1, NodeGroup: "g1"}))
+	err := runRecovery(newHandler(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 1, NodeGroup: "g1"})
+	require.ErrorIs(t, err, ErrNodeGroupThrottled)
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 1, NodeGroup: "g2"}))
+	// Empty group is not throttled.
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	require.Len(t, fetcher.nodeCnts, 4)
+
+	clock.Advance(time.Minute)
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 1, NodeGroup: "g1"}))
+	require.ErrorIs(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 1, NodeGroup: "g1"}), ErrNodeGroupThrottled)
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 1, NodeGroup: "g2"}))
+	require.Len(t, fetcher.nodeCnts, 6)
+
+	// Coalesce policy skips the call but recovery succeeds.
+	throttler.policy = NodeGroupThrottleCoalesce
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 1, NodeGroup: "g2"}))
+	require.Len(t, fetcher.nodeCnts, 6)
+}
+
+func TestUsesAutoScaler(t *testing.T) {
+	for _, useAutoScaler := range []bool{true, false} {
+		h := NewRecoveryHandler(useAutoScaler, 100, true, memory.NewTracker(-1, -1))
+		require.Equal(t, useAutoScaler, h.UsesAutoScaler())
+		require.Equal(t, useAutoScaler, h.Stats().UseAutoScaler)
+	}
+}
+
+func TestRecoveryEmptyTopo(t *testing.T) {
+	memErr := errors.New("Memory limit exceeded")
+	fetcher := newMockTopoFetcher()
+	fetcher.topo = nil
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	err := runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrEmptyTopo)
+	require.Len(t, fetcher.nodeCnts, 1)
+
+	// Fetch error is returned as it is.
+	fetchErr := errors.New("mock fetch error")
+	fetcher.err = fetchErr
+	err = runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1})
+	require.ErrorIs(t, err, fetchErr)
+	require.NotErrorIs(t, err, ErrEmptyTopo)
+}
+
+func TestProgressWeightedNodeCntPolicy(t *testing.T) {
+	memErr := errors.New("Memory limit exceeded")
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	h.maxRecoveryCnt = 100
+	h.SetNodeCntPolicy(NewProgressWeightedNodeCntPolicy(0.25))
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 8}))
+		h.HoldResult(newTestChunk(25))
+	}
+	// Held rows: 0, 25, 50, 75 out of 100.
+	require.Equal(t, []int{8, 6, 4, 2}, fetcher.nodeCnts)
+	require.Equal(t, h.holder.memTracker.BytesConsumed(), h.NumHoldBytes())
+
+	// Bounded by minRatio and at least 1 node.
+	policy := NewProgressWeightedNodeCntPolicy(0.5)
+	require.Equal(t, 4, policy(&RecoveryInfo{NodeCnt: 8}, HoldProgress{HeldRows: 99, Capacity: 100}))
+	policy = NewProgressWeightedNodeCntPolicy(0)
+	require.Equal(t, 1, policy(&RecoveryInfo{NodeCnt: 8}, HoldProgress{HeldRows: 100, Capacity: 100}))
+	require.Equal(t, 8, DefaultNodeCntPolicy(&RecoveryInfo{NodeCnt: 8}, HoldProgress{HeldRows: 100, Capacity: 100}))
+}
+
+type mockHandler struct {
+	infos    []*RecoveryInfo
+	nodeCnts []int
+	err      error
+}
+
+func (h *mockHandler) DoRecovery(_ context.Context, info *RecoveryInfo, nodeCnt int) error {
+	h.infos = append(h.infos, info)
+	h.nodeCnts = append(h.nodeCnts, nodeCnt)
+	return h.err
+}
+
+func TestFallbackHandler(t *testing.T) {
+	memErr := errors.New("Memory limit exceeded")
+	unknownErr := errors.New("mock unknown err")
+	fetcher := newMockTopoFetcher()
+	fallback := &mockHandler{}
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+
+	err := runRecovery(h, &RecoveryInfo{MPPErr: unknownErr, NodeCnt: 3})
+	require.ErrorContains(t, err, "no handler to recovery")
+
+	h.SetFallbackHandler(fallback)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: unknownErr, NodeCnt: 3}))
+	require.Equal(t, []int{3}, fallback.nodeCnts)
+	// Specific handler is preferred.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 3}))
+	require.Len(t, fallback.infos, 1)
+	require.Len(t, fetcher.nodeCnts, 1)
+	// Fallback counts against max recovery cnt.
+	require.Equal(t, uint32(3), h.RecoveryCnt())
+	require.ErrorContains(t, runRecovery(h, &RecoveryInfo{MPPErr: unknownErr, NodeCnt: 3}), "exceeds max recovery cnt")
+
+	stats := h.Stats()
+	require.Equal(t, map[string]uint32{fallbackHandlerName: 1, memLimitHandlerName: 1}, stats.HandlerRecoveryCnt)
+	events := h.Events()
+	require.Len(t, events, 4)
+	require.True(t, events[3].Exhausted)
+	require.Equal(t, "", events[0].Handler)
+	require.Contains(t, events[0].ErrMsg, "no handler to recovery")
+	require.Equal(t, fallbackHandlerName, events[1].Handler)
+	require.Equal(t, CategoryUnknown, events[1].Category)
+	require.Empty(t, events[1].ErrMsg)
+	require.Equal(t, memLimitHandlerName, events[2].Handler)
+	require.Equal(t, CategoryMemLimit, events[2].Category)
+	require.Equal(t, uint32(3), events[2].Attempt)
+}
+
+type reentrantHandler struct {
+	h         *RecoveryHandler
+	nestedErr error
+}
+
+func (r *reentrantHandler) DoRecovery(ctx context.Context, info *RecoveryInfo, _ int) error {
+	_, r.nestedErr = r.h.Recovery(ctx, info)
+	return nil
+}
+
+func TestRecoveryReentered(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	handler := &reentrantHandler{h: h}
+	h.SetFallbackHandler(handler)
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}))
+	require.ErrorIs(t, handler.nestedErr, ErrRecoveryReentered)
+	require.Equal(t, uint32(1), h.RecoveryCnt())
+	require.Len(t, h.Events(), 1)
+
+	// Guard is released after recovery returns.
+	handler.nestedErr = nil
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}))
+	require.ErrorIs(t, handler.nestedErr, ErrRecoveryReentered)
+	require.Equal(t, uint32(2), h.RecoveryCnt())
+}
+
+// detachedReentrantHandler calls Recovery again without the ctx passed to it.
+type detachedReentrantHandler struct {
+	h         *RecoveryHandler
+	nestedErr error
+}
+
+func (r *detachedReentrantHandler) DoRecovery(_ context.Context, info *RecoveryInfo, _ int) error {
+	_, r.nestedErr = r.h.Recovery(context.Background(), info)
+	return nil
+}
+
+func TestRecoveryReenteredWithoutCtx(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	handler := &detachedReentrantHandler{h: h}
+	h.SetFallbackHandler(handler)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}))
+	require.ErrorIs(t, handler.nestedErr, ErrRecoveryReentered)
+	require.Equal(t, uint32(1), h.RecoveryCnt())
+	require.False(t, h.inUserCallback.Load())
+
+	// Decider calls Recovery again.
+	h = newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	var nestedErr error
+	h.SetRecoveryDecider(func(info *RecoveryInfo, _ RecoveryStats) (bool, tiflashcompute.RecoveryType, int) {
+		_, nestedErr = h.Recovery(context.Background(), info)
+		return true, tiflashcompute.RecoveryTypeMemLimit, 0
+	})
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1}))
+	require.ErrorIs(t, nestedErr, ErrRecoveryReentered)
+	require.Equal(t, uint32(1), h.RecoveryCnt())
+	require.False(t, h.inUserCallback.Load())
+}
+
+type mockRowWriter struct {
+	vals     []int64
+	errAfter int
+}
+
+func (w *mockRowWriter) WriteRow(row chunk.Row) error {
+	if w.errAfter > 0 && len(w.vals) >= w.errAfter {
+		return errors.New("mock write err")
+	}
+	w.vals = append(w.vals, row.GetInt64(0))
+	return nil
+}
+
+func TestDumpHeldRows(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	h.HoldResult(newTestChunk(2))
+	h.HoldResult(newTestChunk(3))
+
+	w := &mockRowWriter{}
+	require.NoError(t, h.DumpHeldRows(w))
+	require.Equal(t, []int64{0, 1, 0, 1, 2}, w.vals)
+	// Held chunks are not consumed.
+	require.Equal(t, 2, h.NumHoldChk())
+	require.Equal(t, uint64(5), h.NumHoldRows())
+	w = &mockRowWriter{}
+	require.NoError(t, h.DumpHeldRows(w))
+	require.Equal(t, []int64{0, 1, 0, 1, 2}, w.vals)
+
+	w = &mockRowWriter{errAfter: 3}
+	require.ErrorContains(t, h.DumpHeldRows(w), "mock write err")
+	require.Equal(t, []int64{0, 1, 0}, w.vals)
+}
+
+func TestRecoveryContextDoneErr(t *testing.T) {
+	fallback := &mockHandler{}
+	h := newTestRecoveryHandler(100)
+	h.SetFallbackHandler(fallback)
+
+	for _, mppErr := range []error{
+		context.Canceled,
+		fmt.Errorf("mpp task failed: %w", context.DeadlineExceeded),
+		perrors.Trace(fmt.Errorf("mpp task failed: %w", context.Canceled)),
+		errors.Join(errors.New("Memory limit exceeded"), context.Canceled),
+	} {
+		err := runRecovery(h, &RecoveryInfo{MPPErr: mppErr, NodeCnt: 1})
+		require.ErrorIs(t, err, ErrNonRecoverable)
+	}
+	// Not consume recovery cnt.
+	require.Equal(t, uint32(0), h.RecoveryCnt())
+	require.Empty(t, fallback.infos)
+
+	h.SetContextErrRecoverable(true)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: context.Canceled, NodeCnt: 1}))
+	require.Equal(t, uint32(1), h.RecoveryCnt())
+	require.Len(t, fallback.infos, 1)
+}
+
+func TestDroppedChunks(t *testing.T) {
+	h := newTestRecoveryHandler(5)
+	require.True(t, h.HoldResult(newTestChunk(3)))
+	require.True(t, h.HoldResult(newTestChunk(3)))
+	require.False(t, h.CanHoldResult())
+	require.False(t, h.HoldResult(newTestChunk(3)))
+	require.False(t, h.HoldResult(newTestChunk(3)))
+
+	stats := h.Stats()
+	require.Equal(t, uint64(2), stats.DroppedChunks)
+	require.Equal(t, 2, stats.HeldChunks)
+	require.Equal(t, uint64(6), stats.HeldRows)
+}
+
+func TestMinChunkRowsToHold(t *testing.T) {
+	h := newTestRecoveryHandler(10)
+	h.SetMinChunkRowsToHold(3)
+	require.False(t, h.HoldResult(newTestChunk(1)))
+	require.True(t, h.HoldResult(newTestChunk(3)))
+	require.False(t, h.HoldResult(newTestChunk(2)))
+	require.True(t, h.HoldResult(newTestChunk(5)))
+	require.True(t, h.CanHoldResult())
+	require.True(t, h.HoldResult(newTestChunk(4)))
+	require.False(t, h.CanHoldResult())
+	// Chunks are dropped instead of skipped when holder cannot hold anymore.
+	require.False(t, h.HoldResult(newTestChunk(1)))
+
+	stats := h.Stats()
+	require.Equal(t, 3, stats.HeldChunks)
+	require.Equal(t, uint64(12), stats.HeldRows)
+	require.Equal(t, uint64(2), stats.SkippedChunks)
+	require.Equal(t, uint64(1), stats.DroppedChunks)
+}
+
+type mockSpillBackend struct {
+	mu       sync.Mutex
+	data     map[uint64][]byte
+	writeErr error
+}
+
+func newMockSpillBackend() *mockSpillBackend {
+	return &mockSpillBackend{data: make(map[uint64][]byte)}
+}
+
+func (b *mockSpillBackend) Write(seq uint64, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.writeErr != nil {
+		return b.writeErr
+	}
+	b.data[seq] = append([]byte{}, data...)
+	return nil
+}
+
+func (b *mockSpillBackend) Read(seq uint64) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.data[seq]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+
+func (b *mockSpillBackend) Delete(seq uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.data, seq)
+	return nil
+}
+
+func newTestChunkFrom(start, rows int) *chunk.Chunk {
+	chk := chunk.NewChunkWithCapacity(testFieldTypes, rows)
+	for i := 0; i < rows; i++ {
+		chk.AppendInt64(0, int64(start+i))
+	}
+	return chk
+}
+
+func TestSpillBackend(t *testing.T) {
+	backend := newMockSpillBackend()
+	h := newTestRecoveryHandler(100)
+	oneChkMem := newTestChunkFrom(0, 2).MemoryUsage()
+	// Only 2 chunks can be kept in memory.
+	require.NoError(t, h.SetSpillBackend(backend, testFieldTypes, 2*oneChkMem))
+
+	for i := 0; i < 5; i++ {
+		require.True(t, h.HoldResult(newTestChunkFrom(i*2, 2)))
+	}
+	require.Equal(t, 5, h.NumHoldChk())
+	require.Equal(t, uint64(10), h.NumHoldRows())
+	require.Equal(t, 2*oneChkMem, h.NumHoldBytes())
+	require.Equal(t, 3, h.Stats().SpilledChunks)
+	require.Len(t, backend.data, 3)
+
+	w := &mockRowWriter{}
+	require.NoError(t, h.DumpHeldRows(w))
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, w.vals)
+
+	// Backend cannot be changed while chunks are spilled to it.
+	require.ErrorIs(t, h.SetSpillBackend(nil, nil, 0), ErrSpilledChunksHeld)
+	require.ErrorIs(t, h.SetSpillBackend(newMockSpillBackend(), testFieldTypes, 0), ErrSpilledChunksHeld)
+
+	var vals []int64
+	for h.NumHoldChk() > 0 {
+		chk := h.PopFrontChk()
+		require.NotNil(t, chk)
+		for i := 0; i < chk.NumRows(); i++ {
+			vals = append(vals, chk.GetRow(i).GetInt64(0))
+		}
+	}
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, vals)
+	require.Equal(t, int64(0), h.NumHoldBytes())
+	require.Empty(t, backend.data)
+	// No chunk is spilled after all are popped.
+	require.NoError(t, h.SetSpillBackend(backend, testFieldTypes, 2*oneChkMem))
+
+	// Chunk is kept in memory if spill failed.
+	h.ResetHolder()
+	backend.writeErr = errors.New("mock write err")
+	for i := 0; i < 3; i++ {
+		require.True(t, h.HoldResult(newTestChunkFrom(i*2, 2)))
+	}
+	require.Equal(t, 0, h.Stats().SpilledChunks)
+	require.Equal(t, 3*oneChkMem, h.NumHoldBytes())
+}
+
+func TestSpillStats(t *testing.T) {
+	backend := newMockSpillBackend()
+	h := newTestRecoveryHandler(100)
+	require.Equal(t, SpillStat{}, h.SpillStats())
+	require.NoError(t, h.SetSpillBackend(backend, testFieldTypes, 0))
+
+	for i := 0; i < 3; i++ {
+		require.True(t, h.HoldResult(newTestChunkFrom(i*2, 2)))
+	}
+	var spilledBytes int64
+	for _, data := range backend.data {
+		spilledBytes += int64(len(data))
+	}
+	require.Equal(t, SpillStat{SpilledFiles: 3, SpilledBytes: spilledBytes}, h.SpillStats())
+
+	require.NoError(t, h.DumpHeldRows(&mockRowWriter{}))
+	require.Equal(t, spilledBytes, h.SpillStats().ReadBytes)
+	require.NotNil(t, h.PopFrontChk())
+	require.Equal(t, spilledBytes+spilledBytes/3, h.SpillStats().ReadBytes)
+	require.Equal(t, 3, h.SpillStats().SpilledFiles)
+
+	h.ResetHolder()
+	require.Equal(t, SpillStat{}, h.SpillStats())
+	require.True(t, h.HoldResult(newTestChunkFrom(0, 2)))
+	require.Equal(t, 1, h.SpillStats().SpilledFiles)
+	h.Close()
+	require.Equal(t, SpillStat{}, h.SpillStats())
+	require.Empty(t, backend.data)
+}
+
+func TestEstimateRecoveryCost(t *testing.T) {
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	info := &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 4}
+
+	require.Equal(t, RecoveryCostEstimate{NodeCnt: 4, Attempt: 1, Score: 4}, h.EstimateRecoveryCost(info))
+
+	h.HoldResult(newTestChunk(50))
+	require.Equal(t, RecoveryCostEstimate{NodeCnt: 4, Attempt: 1, Score: 6}, h.EstimateRecoveryCost(info))
+
+	h.SetNodeCntPolicy(NewProgressWeightedNodeCntPolicy(0))
+	require.Equal(t, RecoveryCostEstimate{NodeCnt: 2, Attempt: 1, Score: 3}, h.EstimateRecoveryCost(info))
+	// No side effect.
+	require.Empty(t, fetcher.nodeCnts)
+	require.Equal(t, uint32(0), h.RecoveryCnt())
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, runRecovery(h, info))
+	}
+	require.Equal(t, RecoveryCostEstimate{NodeCnt: 2, Attempt: 4, Exhausted: true, Score: 12}, h.EstimateRecoveryCost(info))
+
+	// Same node cnt as Recovery, with default node cnt and max jitter.
+	var budget atomic.Uint32
+	budget.Store(1)
+	h = NewRecoveryHandler(true, 100, true, memory.NewTracker(-1, -1), WithSharedBudget(&budget))
+	fetcher = newMockTopoFetcher()
+	setTestTopoFetcher(h, fetcher)
+	h.SetDefaultNodeCnt(3)
+	h.SetNodeCntJitter(2)
+	unknownInfo := &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded")}
+	require.Equal(t, RecoveryCostEstimate{NodeCnt: 5, Attempt: 1, Score: 5}, h.EstimateRecoveryCost(unknownInfo))
+	require.NoError(t, runRecovery(h, unknownInfo))
+	require.GreaterOrEqual(t, fetcher.nodeCnts[0], 3)
+	require.LessOrEqual(t, fetcher.nodeCnts[0], 5)
+	// Shared budget is used up.
+	require.True(t, h.EstimateRecoveryCost(unknownInfo).Exhausted)
+}
+
+func TestMaxDistinctCategories(t *testing.T) {
+	memErr := errors.New("Memory limit exceeded")
+	netErr := errors.New("connection refused")
+	unknownErr := errors.New("mock unknown err")
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	h.SetFallbackHandler(&mockHandler{})
+	h.maxRecoveryCnt = 100
+	h.SetMaxDistinctCategories(2)
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: netErr, NodeCnt: 1}))
+	// Already recovered categories are still allowed.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: netErr, NodeCnt: 1}))
+	require.Equal(t, uint32(4), h.RecoveryCnt())
+
+	err := runRecovery(h, &RecoveryInfo{MPPErr: unknownErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrTooManyCategories)
+	require.Equal(t, uint32(4), h.RecoveryCnt())
+
+	h.SetMaxDistinctCategories(0)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: unknownErr, NodeCnt: 1}))
+}
+
+func TestRandSource(t *testing.T) {
+	memErr := errors.New("Memory limit exceeded")
+	recoveryNodeCnts := func(seed int64) []int {
+		fetcher := newMockTopoFetcher()
+		h := newTestRecoveryHandler(100)
+		setTestTopoFetcher(h, fetcher)
+		h.maxRecoveryCnt = 10
+		h.SetRandSource(rand.NewSource(seed))
+		h.SetNodeCntJitter(100)
+		for i := 0; i < 10; i++ {
+			require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 2}))
+		}
+		return fetcher.nodeCnts
+	}
+
+	nodeCnts := recoveryNodeCnts(1)
+	require.Equal(t, nodeCnts, recoveryNodeCnts(1))
+	require.NotEqual(t, nodeCnts, recoveryNodeCnts(2))
+	for _, nodeCnt := range nodeCnts {
+		require.GreaterOrEqual(t, nodeCnt, 2)
+		require.LessOrEqual(t, nodeCnt, 102)
+	}
+}
+
+func TestExchangeReceiverHandler(t *testing.T) {
+	for _, msg := range []string{
+		"Exchange receiver meet error : Receive cancel request from TiDB",
+		"ExchangeReceiver: read data failed",
+		"exchange receiver: connection broken",
+	} {
+		require.Equal(t, CategoryExchangeReceiver, classifyLeafErr(errors.New(msg)))
+	}
+
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 2})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRedispatch, res.Action)
+	// No rescale.
+	require.Empty(t, fetcher.nodeCnts)
+	require.Equal(t, exchangeReceiverHandlerName, h.Events()[0].Handler)
+
+	// Memory limit is more severe, so rescale.
+	mppErr := errors.Join(errors.New("Exchange receiver meet error"), errors.New("Memory limit exceeded"))
+	res, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: mppErr, NodeCnt: 2})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRescale, res.Action)
+	require.Len(t, fetcher.nodeCnts, 1)
+
+	// Works without AutoScaler.
+	h = NewRecoveryHandler(false, 100, true, memory.NewTracker(-1, -1))
+	res, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 1})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRedispatch, res.Action)
+}
+
+func TestHoldingStatus(t *testing.T) {
+	h := newTestRecoveryHandler(5)
+	canHold, reason := h.HoldingStatus()
+	require.True(t, canHold)
+	require.Empty(t, reason)
+
+	h.HoldResult(newTestChunk(5))
+	canHold, reason = h.HoldingStatus()
+	require.False(t, canHold)
+	require.Equal(t, "capacity reached", reason)
+	// The first reason is kept.
+	h.PopFrontChk()
+	_, reason = h.HoldingStatus()
+	require.Equal(t, "capacity reached", reason)
+
+	h.ResetHolder()
+	h.HoldResult(newTestChunk(1))
+	h.PopFrontChk()
+	canHold, reason = h.HoldingStatus()
+	require.False(t, canHold)
+	require.Equal(t, "chunk popped", reason)
+
+	h.ResetHolder()
+	h.DisableHolding()
+	require.False(t, h.CanHoldResult())
+	canHold, reason = h.HoldingStatus()
+	require.False(t, canHold)
+	require.Equal(t, "disabled", reason)
+
+	h = newTestRecoveryHandler(0)
+	_, reason = h.HoldingStatus()
+	require.Equal(t, "zero capacity", reason)
+}
+
+func TestStreamHeldChunks(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	for i := 0; i < 5; i++ {
+		h.HoldResult(newTestChunkFrom(i*2, 2))
+	}
+	require.Greater(t, h.NumHoldBytes(), int64(0))
+
+	var vals []int64
+	for chk := range h.StreamHeldChunks(context.Background()) {
+		for i := 0; i < chk.NumRows(); i++ {
+			vals = append(vals, chk.GetRow(i).GetInt64(0))
+		}
+	}
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, vals)
+	require.Equal(t, 0, h.NumHoldChk())
+	require.Equal(t, int64(0), h.NumHoldBytes())
+	_, reason := h.HoldingStatus()
+	require.Equal(t, "chunk popped", reason)
+
+	// Stop streaming when ctx is done, not received chunks are still held.
+	h.ResetHolder()
+	for i := 0; i < 5; i++ {
+		h.HoldResult(newTestChunkFrom(i*2, 2))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := h.StreamHeldChunks(ctx)
+	chk := <-ch
+	require.Equal(t, int64(0), chk.GetRow(0).GetInt64(0))
+	cancel()
+	for range ch {
+	}
+	require.GreaterOrEqual(t, h.NumHoldChk(), 3)
+	require.LessOrEqual(t, h.NumHoldChk(), 4)
+	require.Equal(t, int64(h.NumHoldChk())*chk.MemoryUsage(), h.NumHoldBytes())
+}
+
+func TestCategoryEnabled(t *testing.T) {
+	memErr := errors.New("Memory limit exceeded")
+	exchangeErr := errors.New("Exchange receiver meet error")
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	h.maxRecoveryCnt = 100
+
+	h.SetCategoryEnabled(CategoryMemLimit, false)
+	require.ErrorContains(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}), "no handler to recovery")
+	require.Empty(t, fetcher.nodeCnts)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: exchangeErr, NodeCnt: 1}))
+	// Less severe cause is used if the dominant one is disabled.
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.Join(memErr, exchangeErr), NodeCnt: 1})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRedispatch, res.Action)
+
+	// Fallback handler doesn't handle disabled categories either.
+	fallback := &mockHandler{}
+	h.SetFallbackHandler(fallback)
+	require.ErrorContains(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}), "no handler to recovery")
+	require.Empty(t, fallback.infos)
+
+	h.SetCategoryEnabled(CategoryMemLimit, true)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	require.Len(t, fetcher.nodeCnts, 1)
+}
+
+func TestResetAccountingCheck(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	h.SetAccountingCheck(true)
+	h.HoldResult(newTestChunk(2))
+	h.HoldResult(newTestChunk(2))
+	h.PopFrontChk()
+	require.NoError(t, h.holder.Reset())
+	require.Equal(t, int64(0), h.NumHoldBytes())
+
+	// Induce imbalance.
+	h.HoldResult(newTestChunk(2))
+	h.holder.memTracker.Consume(100)
+	err := h.holder.Reset()
+	require.ErrorContains(t, err, "imbalanced, remained bytes: 100")
+	require.Equal(t, int64(0), h.NumHoldBytes())
+
+	h.SetAccountingCheck(false)
+	h.holder.memTracker.Consume(100)
+	require.NoError(t, h.holder.Reset())
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	memErr := errors.New("Memory limit exceeded")
+	fetcher := newMockTopoFetcher()
+	fetcher.block = make(chan struct{})
+	defer close(fetcher.block)
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	h.SetHandlerTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	err := runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrHandlerTimeout)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Contains(t, h.Events()[0].ErrMsg, "handler: mem_limit")
+
+	// Parent ctx done is not a handler timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = h.Recovery(ctx, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1})
+	require.ErrorIs(t, err, context.Canceled)
+	require.NotErrorIs(t, err, ErrHandlerTimeout)
+
+	// Fast handler is not affected.
+	fallback := &mockHandler{}
+	h.SetFallbackHandler(fallback)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}))
+}
+
+func TestDebugClassify(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+
+	normalized, category, handler, wouldRecover := h.DebugClassify(errors.New("  Memory limit\n exceeded "))
+	require.Equal(t, "Memory limit exceeded", normalized)
+	require.Equal(t, CategoryMemLimit, category)
+	require.Equal(t, memLimitHandlerName, handler)
+	require.True(t, wouldRecover)
+
+	mppErr := errors.Join(errors.New("connection refused"), errors.New("Exchange receiver meet error"))
+	normalized, category, handler, wouldRecover = h.DebugClassify(mppErr)
+	require.Equal(t, "Exchange receiver meet error", normalized)
+	require.Equal(t, CategoryExchangeReceiver, category)
+	require.Equal(t, exchangeReceiverHandlerName, handler)
+	require.True(t, wouldRecover)
+
+	normalized, category, handler, wouldRecover = h.DebugClassify(errors.New("connection refused"))
+	require.Equal(t, "connection refused", normalized)
+	require.Equal(t, CategoryNetwork, category)
+	require.Empty(t, handler)
+	require.False(t, wouldRecover)
+
+	_, category, handler, wouldRecover = h.DebugClassify(fmt.Errorf("Memory limit: %w", context.Canceled))
+	require.Equal(t, CategoryMemLimit, category)
+	require.Equal(t, memLimitHandlerName, handler)
+	require.False(t, wouldRecover)
+
+	h.SetCategoryEnabled(CategoryMemLimit, false)
+	_, _, handler, wouldRecover = h.DebugClassify(errors.New("Memory limit exceeded"))
+	require.Empty(t, handler)
+	require.False(t, wouldRecover)
+
+	// Decider is not called, the verdict of built-in handlers is reported.
+	deciderCalled := false
+	h.SetRecoveryDecider(func(*RecoveryInfo, RecoveryStats) (bool, tiflashcompute.RecoveryType, int) {
+		deciderCalled = true
+		return false, tiflashcompute.RecoveryTypeNull, 0
+	})
+	_, _, handler, wouldRecover = h.DebugClassify(mppErr)
+	require.Equal(t, exchangeReceiverHandlerName, handler)
+	require.True(t, wouldRecover)
+	require.False(t, deciderCalled)
+
+	// No side effect.
+	require.Equal(t, uint32(0), h.RecoveryCnt())
+	require.Empty(t, h.Events())
+}
+
+func TestLifetimeRecoveryCnt(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	for i := 0; i < 2; i++ {
+		require.True(t, h.HoldResult(newTestChunk(3)))
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+		require.Equal(t, uint32(2), h.RecoveryCnt())
+		h.ResetHolder()
+		h.ResetRecoveryCnt()
+		require.Equal(t, uint32(0), h.RecoveryCnt())
+		require.Equal(t, uint64(2*(i+1)), h.LifetimeRecoveryCnt())
+	}
+	require.Equal(t, uint64(4), h.Stats().LifetimeRecoveryCnt)
+
+	h.ResetAll()
+	require.Equal(t, uint64(0), h.LifetimeRecoveryCnt())
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	h.Close()
+	require.Equal(t, uint64(0), h.Stats().LifetimeRecoveryCnt)
+	require.Equal(t, 0, h.NumHoldChk())
+}
+
+func TestMarkResultsStreamed(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	require.True(t, h.HoldResult(newTestChunk(3)))
+	h.MarkResultsStreamed()
+	canHold, reason := h.HoldingStatus()
+	require.False(t, canHold)
+	require.Equal(t, "results streamed", reason)
+	require.False(t, h.HoldResult(newTestChunk(3)))
+
+	err := runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrResultsAlreadyStreamed)
+	require.Equal(t, uint32(0), h.RecoveryCnt())
+
+	// Still refused after holder is reset.
+	h.ResetHolder()
+	require.False(t, h.CanHoldResult())
+	err = runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrResultsAlreadyStreamed)
+
+	// Next statement.
+	h.ResetRecoveryCnt()
+	require.True(t, h.CanHoldResult())
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+}
+
+func TestAutoResetOnRecovery(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	require.True(t, h.HoldResult(newTestChunk(3)))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, 1, h.NumHoldChk())
+
+	h.SetAutoResetOnRecovery(true)
+	require.True(t, h.HoldResult(newTestChunk(3)))
+	// Failed recovery doesn't reset the holder.
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("unknown"), NodeCnt: 1}))
+	require.Equal(t, 2, h.NumHoldChk())
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, 0, h.NumHoldChk())
+	require.Equal(t, uint64(0), h.NumHoldRows())
+	require.Equal(t, int64(0), h.NumHoldBytes())
+	require.True(t, h.CanHoldResult())
+	require.Equal(t, uint32(3), h.RecoveryCnt())
+}
+
+func TestCategoryRateLimiter(t *testing.T) {
+	clock := newMockClock()
+	limiter := NewCategoryRateLimiter(1, 2)
+	limiter.nowFunc = clock.Now
+
+	fetcher := newMockTopoFetcher()
+	newHandler := func() *RecoveryHandler {
+		h := newTestRecoveryHandler(100)
+		setTestTopoFetcher(h, fetcher)
+		h.SetCategoryRateLimiter(limiter)
+		return h
+	}
+	memLimitErr := errors.New("Memory limit exceeded")
+	exchangeErr := errors.New("Exchange receiver meet error")
+
+	// Limiter is shared by handlers, and each category has its own bucket.
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	h := newHandler()
+	err := runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrCategoryRateLimited)
+	require.Equal(t, uint32(0), h.RecoveryCnt())
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: exchangeErr, NodeCnt: 1}))
+	require.Len(t, fetcher.nodeCnts, 2)
+
+	clock.Advance(time.Second)
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.ErrorIs(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrCategoryRateLimited)
+
+	// Tokens never exceed burst.
+	clock.Advance(time.Hour)
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.NoError(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.ErrorIs(t, runRecovery(newHandler(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrCategoryRateLimited)
+}
+
+func TestHeldRowsDigest(t *testing.T) {
+	newHandler := func(chks ...*chunk.Chunk) *RecoveryHandler {
+		h := newTestRecoveryHandler(100)
+		for _, chk := range chks {
+			require.True(t, h.HoldResult(chk))
+		}
+		return h
+	}
+	digest := newHandler(newTestChunkFrom(0, 3), newTestChunkFrom(3, 3)).HeldRowsDigest()
+	require.Equal(t, digest, newHandler(newTestChunkFrom(0, 3), newTestChunkFrom(3, 3)).HeldRowsDigest())
+	// Digest is computed over rows, so chunk boundaries don't matter.
+	require.Equal(t, digest, newHandler(newTestChunkFrom(0, 6)).HeldRowsDigest())
+
+	// Spilled chunks are included.
+	spilled := newTestRecoveryHandler(100)
+	require.NoError(t, spilled.SetSpillBackend(newMockSpillBackend(), testFieldTypes, 0))
+	require.True(t, spilled.HoldResult(newTestChunkFrom(0, 3)))
+	require.True(t, spilled.HoldResult(newTestChunkFrom(3, 3)))
+	require.Equal(t, 2, spilled.Stats().SpilledChunks)
+	require.Equal(t, digest, spilled.HeldRowsDigest())
+
+	// Order sensitive.
+	require.NotEqual(t, digest, newHandler(newTestChunkFrom(3, 3), newTestChunkFrom(0, 3)).HeldRowsDigest())
+	require.NotEqual(t, digest, newHandler(newTestChunkFrom(0, 3), newTestChunkFrom(4, 3)).HeldRowsDigest())
+	require.NotEqual(t, digest, newHandler(newTestChunkFrom(0, 3)).HeldRowsDigest())
+
+	nullChk := chunk.NewChunkWithCapacity(testFieldTypes, 1)
+	nullChk.AppendNull(0)
+	zeroChk := chunk.NewChunkWithCapacity(testFieldTypes, 1)
+	zeroChk.AppendInt64(0, 0)
+	require.NotEqual(t, newHandler(nullChk).HeldRowsDigest(), newHandler(zeroChk).HeldRowsDigest())
+}
+
+type fatalHandlerImpl struct {
+	fatalPattern string
+}
+
+func (*fatalHandlerImpl) name() string {
+	return "fatal"
+}
+
+func (h *fatalHandlerImpl) isFatalErr(mppErr error) bool {
+	return strings.Contains(mppErr.Error(), h.fatalPattern)
+}
+
+func (*fatalHandlerImpl) chooseHandlerImpl(error) bool {
+	return false
+}
+
+func (*fatalHandlerImpl) doRecovery(context.Context, *RecoveryInfo, int) (RecoveryResult, error) {
+	panic("fatal handler should never recovery")
+}
+
+func TestFatalErrShortCircuit(t *testing.T) {
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	fallback := &mockHandler{}
+	h.SetFallbackHandler(fallback)
+	h.handlers = append([]handlerImpl{&fatalHandlerImpl{fatalPattern: "version mismatch"}}, h.handlers...)
+
+	err := runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded, version mismatch"), NodeCnt: 1})
+	require.ErrorIs(t, err, ErrNonRecoverable)
+	// Cause of multi-error is fatal too.
+	mppErr := errors.Join(errors.New("Memory limit exceeded"), errors.New("version mismatch"))
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: mppErr, NodeCnt: 1}), ErrNonRecoverable)
+	require.Empty(t, fetcher.nodeCnts)
+	require.Empty(t, fallback.infos)
+	require.Equal(t, uint32(0), h.RecoveryCnt())
+
+	_, _, handler, wouldRecover := h.DebugClassify(errors.New("version mismatch"))
+	require.Empty(t, handler)
+	require.False(t, wouldRecover)
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1}))
+	require.Len(t, fetcher.nodeCnts, 1)
+}
+
+func TestFirstRecoveryGrace(t *testing.T) {
+	clock := newMockClock()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	h.nowFunc = clock.Now
+	h.afterFunc = clock.After
+	memLimitErr := errors.New("Memory limit exceeded")
+	start := clock.Now()
+
+	// No grace by default.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, start, clock.Now())
+
+	h.ResetRecoveryCnt()
+	h.SetFirstRecoveryGrace(time.Second)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, start.Add(time.Second), clock.Now())
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, start.Add(time.Second), clock.Now())
+
+	// Waiting is interrupted by ctx.
+	h.ResetRecoveryCnt()
+	h.afterFunc = func(time.Duration) <-chan time.Time { return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := h.Recovery(ctx, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, uint32(0), h.RecoveryCnt())
+}
+
+func TestRecoveryTypeMapping(t *testing.T) {
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	mapping := map[RecoveryErrorCategory]tiflashcompute.RecoveryType{CategoryMemLimit: tiflashcompute.RecoveryTypeNull}
+	h.SetRecoveryTypeMapping(mapping)
+	// Mapping is copied.
+	delete(mapping, CategoryMemLimit)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	h.SetRecoveryTypeMapping(nil)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, []tiflashcompute.RecoveryType{
+		tiflashcompute.RecoveryTypeMemLimit,
+		tiflashcompute.RecoveryTypeNull,
+		tiflashcompute.RecoveryTypeMemLimit,
+	}, fetcher.recoveryTypes)
+}
+
+func TestRecoveryExhausted(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	}
+	require.Equal(t, uint64(0), h.Stats().ExhaustedCnt)
+	for i := 0; i < 2; i++ {
+		err := runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+		require.ErrorIs(t, err, ErrRecoveryExhausted)
+	}
+	require.Equal(t, uint32(3), h.RecoveryCnt())
+	require.Equal(t, uint64(2), h.Stats().ExhaustedCnt)
+
+	events := h.Events()
+	require.Len(t, events, 5)
+	for i, event := range events {
+		require.Equal(t, i >= 3, event.Exhausted)
+	}
+	require.Equal(t, uint32(3), events[4].Attempt)
+	require.Equal(t, CategoryMemLimit, events[4].Category)
+	require.Empty(t, events[4].Handler)
+	require.Contains(t, events[4].ErrMsg, "exceeds max recovery cnt")
+}
+
+func TestDebugHeldChunks(t *testing.T) {
+	h := newTestRecoveryHandler(5)
+	require.NoError(t, h.SetSpillBackend(newMockSpillBackend(), testFieldTypes, 2*newTestChunk(2).MemoryUsage()))
+	chk1, chk2, chk3 := newTestChunkFrom(0, 2), newTestChunkFrom(2, 2), newTestChunkFrom(4, 2)
+	for _, chk := range []*chunk.Chunk{chk1, chk2, chk3} {
+		require.True(t, h.HoldResult(chk))
+	}
+	require.False(t, h.CanHoldResult())
+	require.Equal(t, 1, h.Stats().SpilledChunks)
+
+	chks := h.DebugHeldChunks()
+	require.Len(t, chks, 3)
+	require.Same(t, chk1, chks[0])
+	require.Same(t, chk2, chks[1])
+	// Spilled chunk is read back.
+	require.Equal(t, int64(4), chks[2].GetRow(0).GetInt64(0))
+
+	h.DebugClearChunks()
+	require.Empty(t, h.DebugHeldChunks())
+	require.Equal(t, 0, h.NumHoldChk())
+	require.Equal(t, int64(0), h.NumHoldBytes())
+	require.Equal(t, 0, h.Stats().SpilledChunks)
+	require.Equal(t, uint64(6), h.NumHoldRows())
+	require.False(t, h.CanHoldResult())
+}
+
+func TestRecoveryAsync(t *testing.T) {
+	infos := []*RecoveryInfo{
+		{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1},
+		{MPPErr: errors.New("mock unknown err"), NodeCnt: 1},
+		{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 1},
+		{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1},
+	}
+	syncHandler := newTestRecoveryHandler(100)
+	setTestTopoFetcher(syncHandler, newMockTopoFetcher())
+	asyncHandler := newTestRecoveryHandler(100)
+	setTestTopoFetcher(asyncHandler, newMockTopoFetcher())
+	for _, info := range infos {
+		_, syncErr := syncHandler.Recovery(context.Background(), info)
+		asyncErr := <-asyncHandler.RecoveryAsync(context.Background(), info)
+		if syncErr == nil {
+			require.NoError(t, asyncErr)
+		} else {
+			require.EqualError(t, asyncErr, syncErr.Error())
+		}
+		syncCategory, syncRecoverable, syncAttempted := syncHandler.LastClassification()
+		asyncCategory, asyncRecoverable, asyncAttempted := asyncHandler.LastClassification()
+		require.Equal(t, syncCategory, asyncCategory)
+		require.Equal(t, syncRecoverable, asyncRecoverable)
+		require.Equal(t, syncAttempted, asyncAttempted)
+	}
+	require.Equal(t, syncHandler.RecoveryCnt(), asyncHandler.RecoveryCnt())
+	require.Equal(t, syncHandler.Stats().HandlerRecoveryCnt, asyncHandler.Stats().HandlerRecoveryCnt)
+	require.Len(t, asyncHandler.Events(), len(syncHandler.Events()))
+
+	// Only one async recovery may be in flight.
+	fetcher := newMockTopoFetcher()
+	fetcher.block = make(chan struct{})
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	errCh := h.RecoveryAsync(context.Background(), infos[0])
+	require.ErrorIs(t, <-h.RecoveryAsync(context.Background(), infos[0]), ErrRecoveryInFlight)
+	// Sync recovery is rejected too, instead of racing with the async one.
+	_, err := h.Recovery(context.Background(), infos[0])
+	require.ErrorIs(t, err, ErrRecoveryInFlight)
+	require.Eventually(t, func() bool { return h.Stats().InRecovery }, time.Second, time.Millisecond)
+	close(fetcher.block)
+	require.NoError(t, <-errCh)
+	require.Equal(t, uint32(1), h.RecoveryCnt())
+	require.NoError(t, <-h.RecoveryAsync(context.Background(), infos[0]))
+	require.NoError(t, runRecovery(h, infos[0]))
+	require.Equal(t, uint32(3), h.RecoveryCnt())
+}
+
+func TestDefaultNodeCnt(t *testing.T) {
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	err := runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr})
+	require.ErrorIs(t, err, ErrUnknownNodeCnt)
+	require.Equal(t, uint32(0), h.RecoveryCnt())
+
+	h.SetDefaultNodeCnt(4)
+	info := &RecoveryInfo{MPPErr: memLimitErr}
+	require.NoError(t, runRecovery(h, info))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: -1}))
+	// Known node cnt is not overridden.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 2}))
+	require.Equal(t, []int{4, 4, 2}, fetcher.nodeCnts)
+	// Info of caller is not modified.
+	require.Equal(t, 0, info.NodeCnt)
+
+	// Node cnt is not required by handlers that don't call AutoScaler.
+	h = newTestRecoveryHandler(100)
+	fetcher = newMockTopoFetcher()
+	setTestTopoFetcher(h, fetcher)
+	h.SetStaleSnapshotRecovery(true)
+	h.SetRescaleFragmentRatio(0.5)
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr}), ErrUnknownNodeCnt)
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.New("exchange receiver meet error")})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRedispatch, res.Action)
+	res, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.New("read ts is stale")})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRefreshSnapshotAndRetry, res.Action)
+	// Re-dispatch without rescale if only a few fragments failed.
+	res, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, FailedFragmentRatio: 0.1})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRedispatch, res.Action)
+	require.Empty(t, fetcher.nodeCnts)
+}
+
+func TestOnHoldChunk(t *testing.T) {
+	h := newTestRecoveryHandler(5)
+	h.SetMinChunkRowsToHold(2)
+	var seen []*chunk.Chunk
+	h.OnHoldChunk(func(chk *chunk.Chunk) {
+		// Called after accounting.
+		require.Equal(t, chk, h.DebugHeldChunks()[h.NumHoldChk()-1])
+		seen = append(seen, chk)
+	})
+	chk1, chk2 := newTestChunk(2), newTestChunk(3)
+	require.True(t, h.HoldResult(chk1))
+	// Skipped chunk doesn't trigger hook.
+	require.False(t, h.HoldResult(newTestChunk(1)))
+	require.True(t, h.HoldResult(chk2))
+	// Dropped chunk doesn't trigger hook.
+	require.False(t, h.HoldResult(newTestChunk(2)))
+	require.Len(t, seen, 2)
+	require.Same(t, chk1, seen[0])
+	require.Same(t, chk2, seen[1])
+
+	// Panic is recovered.
+	h.ResetHolder()
+	h.OnHoldChunk(func(*chunk.Chunk) { panic("mock hook panic") })
+	require.True(t, h.HoldResult(newTestChunk(2)))
+	require.Equal(t, 1, h.NumHoldChk())
+}
+
+type mockQuota struct {
+	tokens   chan struct{}
+	acquired int
+}
+
+func newMockQuota(n int) *mockQuota {
+	q := &mockQuota{tokens: make(chan struct{}, n)}
+	for i := 0; i < n; i++ {
+		q.tokens <- struct{}{}
+	}
+	return q
+}
+
+func (q *mockQuota) Acquire(context.Context) error {
+	select {
+	case <-q.tokens:
+		q.acquired++
+		return nil
+	default:
+		return errors.New("mock quota exhausted")
+	}
+}
+
+func (q *mockQuota) Release() {
+	q.tokens <- struct{}{}
+}
+
+func TestRecoveryQuota(t *testing.T) {
+	quota := newMockQuota(1)
+	fetcher := newMockTopoFetcher()
+	fetcher.block = make(chan struct{})
+	newHandler := func() *RecoveryHandler {
+		h := NewRecoveryHandler(true, 100, true, memory.NewTracker(-1, -1), WithQuota(quota))
+		setTestTopoFetcher(h, fetcher)
+		return h
+	}
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	h1, h2 := newHandler(), newHandler()
+	errCh := h1.RecoveryAsync(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.Eventually(t, func() bool { return len(quota.tokens) == 0 }, time.Second, time.Millisecond)
+	err := runRecovery(h2, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.ErrorContains(t, err, "mock quota exhausted")
+	require.Equal(t, uint32(0), h2.RecoveryCnt())
+
+	close(fetcher.block)
+	require.NoError(t, <-errCh)
+	// Quota is released after recovery.
+	require.Len(t, quota.tokens, 1)
+	require.NoError(t, runRecovery(h2, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Len(t, quota.tokens, 1)
+	require.Equal(t, 2, quota.acquired)
+
+	// Quota is not acquired if no handler can recovery.
+	require.Error(t, runRecovery(h2, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}))
+	require.Equal(t, 2, quota.acquired)
+}
+
+func TestDuplicateChunkCheck(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	h.SetDuplicateChunkCheck(true)
+	chk := newTestChunk(3)
+	require.True(t, h.HoldResult(chk))
+	require.False(t, h.HoldResult(chk))
+	require.Equal(t, 1, h.NumHoldChk())
+	require.Equal(t, uint64(3), h.NumHoldRows())
+	require.Equal(t, chk.MemoryUsage(), h.NumHoldBytes())
+	require.Equal(t, uint64(0), h.Stats().DroppedChunks)
+
+	// Chunk can be held again after it's popped.
+	require.Same(t, chk, h.PopFrontChk())
+	h.ResetHolder()
+	require.True(t, h.HoldResult(chk))
+
+	h.SetDuplicateChunkCheck(false)
+	require.True(t, h.HoldResult(chk))
+	require.Equal(t, 2, h.NumHoldChk())
+}
+
+func TestMaxCumulativeNodeCnt(t *testing.T) {
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	h.SetMaxCumulativeNodeCnt(10)
+	h.SetNodeCntPolicy(func(info *RecoveryInfo, _ HoldProgress) int {
+		return info.NodeCnt * 2
+	})
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 2}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 3}))
+	// 4 + 6 + 2 > 10.
+	err := runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrNodeCntBudgetExceeded)
+	require.Equal(t, uint32(2), h.RecoveryCnt())
+	require.Equal(t, []int{4, 6}, fetcher.nodeCnts)
+
+	// Budget is per statement.
+	h.ResetRecoveryCnt()
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 5}))
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrNodeCntBudgetExceeded)
+
+	// Re-dispatch doesn't request nodes, so it's neither refused nor charged.
+	exchangeErr := errors.New("Exchange receiver meet error")
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: exchangeErr, NodeCnt: 5}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: exchangeErr, NodeCnt: 5}))
+	require.Equal(t, uint32(3), h.RecoveryCnt())
+	require.Equal(t, 10, h.cumulativeNodeCnt)
+	require.Equal(t, []int{4, 6, 10}, fetcher.nodeCnts)
+
+	// Failed recovery is not charged.
+	h.ResetRecoveryCnt()
+	fetcher.err = errors.New("mock AutoScaler err")
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 5}))
+	require.Zero(t, h.cumulativeNodeCnt)
+}
+
+func TestWouldHaveRecovered(t *testing.T) {
+	fetcher := newMockTopoFetcher()
+	h := NewRecoveryHandler(true, 100, false, memory.NewTracker(-1, -1))
+	setTestTopoFetcher(h, fetcher)
+
+	err := runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1})
+	require.ErrorIs(t, err, ErrRecoveryDisabled)
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 1}), ErrRecoveryDisabled)
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}), ErrRecoveryDisabled)
+	require.ErrorIs(t, runRecovery(h, nil), ErrRecoveryDisabled)
+
+	stats := h.Stats()
+	require.Equal(t, uint64(2), stats.WouldHaveRecoveredCnt)
+	require.Equal(t, uint32(0), stats.RecoveryCnt)
+	require.Empty(t, fetcher.nodeCnts)
+}
+
+func TestAdaptiveCapacity(t *testing.T) {
+	parent := memory.NewTracker(-1, -1)
+	h := NewRecoveryHandler(true, 100, true, parent)
+	h.SetAdaptiveCapacity(true)
+	bytesPerRow := newTestChunk(10).MemoryUsage() / 10
+
+	// No memory limit, the configured capacity is used.
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, uint64(100), h.holdProgress().Capacity)
+
+	// Plenty of memory.
+	h.ResetHolder()
+	parent.SetBytesLimit(1000 * bytesPerRow)
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, uint64(100), h.holdProgress().Capacity)
+
+	// Under pressure, capacity shrinks to held rows plus headroom rows.
+	parent.Consume(1000*bytesPerRow - 40*bytesPerRow)
+	heldBytes := h.NumHoldBytes()
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, uint64(10+(40*bytesPerRow-heldBytes)/bytesPerRow), h.holdProgress().Capacity)
+	require.Less(t, h.holdProgress().Capacity, uint64(100))
+	require.True(t, h.CanHoldResult())
+	parent.Consume(20 * bytesPerRow)
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.False(t, h.CanHoldResult())
+	_, reason := h.HoldingStatus()
+	require.Equal(t, "capacity reached", reason)
+
+	// Memory is released, capacity grows again.
+	h.ResetHolder()
+	parent.Consume(-(1000*bytesPerRow - 20*bytesPerRow))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, uint64(100), h.holdProgress().Capacity)
+
+	h.SetAdaptiveCapacity(false)
+	parent.Consume(1000 * bytesPerRow)
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, uint64(100), h.holdProgress().Capacity)
+}
+
+func TestDrainStats(t *testing.T) {
+	h := newTestRecoveryHandler(5)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	require.True(t, h.HoldResult(newTestChunk(5)))
+	require.False(t, h.HoldResult(newTestChunk(5)))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	stats := h.DrainStats()
+	require.Equal(t, uint64(1), stats.DroppedChunks)
+	require.Equal(t, map[string]uint32{memLimitHandlerName: 1}, stats.HandlerRecoveryCnt)
+
+	require.False(t, h.HoldResult(newTestChunk(5)))
+	require.False(t, h.HoldResult(newTestChunk(5)))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	stats = h.DrainStats()
+	require.Equal(t, uint64(2), stats.DroppedChunks)
+	require.Equal(t, map[string]uint32{memLimitHandlerName: 2}, stats.HandlerRecoveryCnt)
+	// Structural states are kept.
+	require.Equal(t, 1, stats.HeldChunks)
+	require.Equal(t, uint32(3), stats.RecoveryCnt)
+	require.Equal(t, 1, h.NumHoldChk())
+
+	stats = h.DrainStats()
+	require.Equal(t, uint64(0), stats.DroppedChunks)
+	require.Empty(t, stats.HandlerRecoveryCnt)
+	require.Equal(t, uint32(3), h.Stats().RecoveryCnt)
+}
+
+func TestAutoScalerUnavailable(t *testing.T) {
+	fetcher := newMockTopoFetcher()
+	fetcher.err = errors.New("mock AutoScaler unavailable")
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	h.SetAutoScalerUnavailableThreshold(2)
+	h.maxRecoveryCnt = 10
+	memLimitErr := errors.New("Memory limit exceeded")
+	exchangeErr := errors.New("Exchange receiver meet error")
+
+	require.ErrorContains(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), "mock AutoScaler unavailable")
+	require.False(t, h.AutoScalerUnavailable())
+	require.ErrorContains(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), "mock AutoScaler unavailable")
+	require.True(t, h.AutoScalerUnavailable())
+	require.Len(t, fetcher.nodeCnts, 2)
+
+	// Handlers depending on AutoScaler decline.
+	require.ErrorContains(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), "no handler to recovery")
+	require.Len(t, fetcher.nodeCnts, 2)
+	// Other handlers still run.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.Join(memLimitErr, exchangeErr), NodeCnt: 1}))
+	require.Equal(t, exchangeReceiverHandlerName, h.Events()[3].Handler)
+
+	// Next statement tries AutoScaler again, and success resets consecutive failures.
+	h.ResetRecoveryCnt()
+	require.False(t, h.AutoScalerUnavailable())
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	fetcher.err = nil
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	fetcher.err = errors.New("mock AutoScaler unavailable")
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.False(t, h.AutoScalerUnavailable())
+}
+
+func TestHeldSchemaInfo(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	require.Equal(t, HeldSchemaInfo{}, h.HeldSchemaInfo())
+	require.True(t, h.HoldResult(newTestChunk(2)))
+	require.Equal(t, HeldSchemaInfo{Established: true, NumCols: 1}, h.HeldSchemaInfo())
+
+	wideFieldTypes := []*types.FieldType{types.NewFieldType(mysql.TypeLonglong), types.NewFieldType(mysql.TypeLonglong)}
+	wideChk := chunk.NewChunkWithCapacity(wideFieldTypes, 1)
+	wideChk.AppendInt64(0, 1)
+	wideChk.AppendInt64(1, 1)
+	require.False(t, h.HoldResult(wideChk))
+	require.Equal(t, 1, h.NumHoldChk())
+	require.True(t, h.HoldResult(newTestChunk(2)))
+
+	// Schema is established again after reset.
+	h.ResetHolder()
+	require.Equal(t, HeldSchemaInfo{}, h.HeldSchemaInfo())
+	require.True(t, h.HoldResult(wideChk))
+	require.Equal(t, HeldSchemaInfo{Established: true, NumCols: 2}, h.HeldSchemaInfo())
+	require.False(t, h.HoldResult(newTestChunk(2)))
+}
+
+func TestExhaustCooldown(t *testing.T) {
+	clock := newMockClock()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	h.nowFunc = clock.Now
+	h.SetExhaustCooldown(time.Minute)
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	}
+	require.True(t, h.CanHoldResult())
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrRecoveryExhausted)
+
+	// Retry of the statement with the reused handler.
+	h.ResetHolder()
+	h.ResetRecoveryCnt()
+	require.False(t, h.CanHoldResult())
+	canHold, reason := h.HoldingStatus()
+	require.False(t, canHold)
+	require.Equal(t, "cooldown after recovery exhausted", reason)
+	require.False(t, h.HoldResult(newTestChunk(2)))
+
+	clock.Advance(time.Minute - time.Second)
+	require.False(t, h.CanHoldResult())
+	clock.Advance(time.Second)
+	require.True(t, h.CanHoldResult())
+	require.True(t, h.HoldResult(newTestChunk(2)))
+}
+
+func TestStoreRecoveryCnt(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	h.maxRecoveryCnt = 10
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, StoreAddr: "store1"}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, StoreAddr: "store2"}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, StoreAddr: "store1"}))
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1, StoreAddr: "store1"}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+
+	require.Equal(t, map[string]uint32{"store1": 3, "store2": 1}, h.Stats().StoreRecoveryCnt)
+	events := h.Events()
+	require.Equal(t, "store1", events[0].StoreAddr)
+	require.Equal(t, "store2", events[1].StoreAddr)
+	require.Empty(t, events[4].StoreAddr)
+
+	require.Equal(t, map[string]uint32{"store1": 3, "store2": 1}, h.DrainStats().StoreRecoveryCnt)
+	require.Empty(t, h.Stats().StoreRecoveryCnt)
+}
+
+func TestWriteReadHeldChunks(t *testing.T) {
+	src := newTestRecoveryHandler(100)
+	var buf bytes.Buffer
+	_, err := src.WriteHeldChunks(&buf)
+	require.Error(t, err)
+
+	src.SetFieldTypes(testFieldTypes)
+	require.NoError(t, src.SetSpillBackend(newMockSpillBackend(), testFieldTypes, 2*newTestChunk(2).MemoryUsage()))
+	for i := 0; i < 3; i++ {
+		require.True(t, src.HoldResult(newTestChunkFrom(i*2, 2)))
+	}
+	nullChk := chunk.NewChunkWithCapacity(testFieldTypes, 1)
+	nullChk.AppendNull(0)
+	require.True(t, src.HoldResult(nullChk))
+	written, err := src.WriteHeldChunks(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), written)
+	require.Equal(t, 4, src.NumHoldChk())
+
+	dst := newTestRecoveryHandler(100)
+	dst.SetFieldTypes(testFieldTypes)
+	require.NoError(t, dst.ReadHeldChunks(&buf))
+	require.Equal(t, src.NumHoldChk(), dst.NumHoldChk())
+	require.Equal(t, src.NumHoldRows(), dst.NumHoldRows())
+	require.Equal(t, src.HeldRowsDigest(), dst.HeldRowsDigest())
+	var heldBytes int64
+	for _, chk := range dst.DebugHeldChunks() {
+		heldBytes += chk.MemoryUsage()
+	}
+	require.Equal(t, heldBytes, dst.NumHoldBytes())
+	require.True(t, dst.DebugHeldChunks()[3].GetRow(0).IsNull(0))
+	dst.ResetHolder()
+	require.Equal(t, int64(0), dst.NumHoldBytes())
+
+	// Truncated data.
+	buf.Reset()
+	_, err = src.WriteHeldChunks(&buf)
+	require.NoError(t, err)
+	buf.Truncate(buf.Len() - 1)
+	require.Error(t, dst.ReadHeldChunks(&buf))
+
+	// Corrupted length prefix.
+	dst.ResetHolder()
+	var lenBuf [chkLenSize]byte
+	binary.LittleEndian.PutUint64(lenBuf[:], math.MaxUint64)
+	require.ErrorContains(t, dst.ReadHeldChunks(bytes.NewReader(lenBuf[:])), "data is corrupted")
+	// Trailing bytes after the chunk.
+	data := chunk.NewCodec(testFieldTypes).Encode(newTestChunk(2))
+	data = append(data, 0)
+	binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(data)))
+	require.ErrorContains(t, dst.ReadHeldChunks(bytes.NewReader(append(lenBuf[:], data...))), "data is corrupted")
+	// Truncated chunk.
+	binary.LittleEndian.PutUint64(lenBuf[:], 3)
+	require.ErrorContains(t, dst.ReadHeldChunks(bytes.NewReader(append(lenBuf[:], data[:3]...))), "data is corrupted")
+	require.Zero(t, dst.NumHoldChk())
+
+	// Read chunks are checked like other results.
+	buf.Reset()
+	_, err = src.WriteHeldChunks(&buf)
+	require.NoError(t, err)
+	require.NoError(t, dst.ReadHeldChunks(bytes.NewReader(buf.Bytes())))
+	require.Equal(t, uint64(7), dst.NumHoldRows())
+	mismatched := newTestRecoveryHandler(100)
+	mismatched.SetFieldTypes(testFieldTypes)
+	require.True(t, mismatched.HoldResult(chunk.NewChunkWithCapacity(append(testFieldTypes, testFieldTypes...), 1)))
+	require.Error(t, mismatched.ReadHeldChunks(bytes.NewReader(buf.Bytes())))
+	require.Equal(t, 1, mismatched.NumHoldChk())
+}
+
+func TestCategorySeverity(t *testing.T) {
+	memLimitErr := errors.New("Memory limit exceeded")
+	exchangeErr := errors.New("Exchange receiver meet error")
+	mppErr := errors.Join(memLimitErr, exchangeErr)
+
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	_, category, handler, _ := h.DebugClassify(mppErr)
+	require.Equal(t, CategoryMemLimit, category)
+	require.Equal(t, memLimitHandlerName, handler)
+
+	severity := map[RecoveryErrorCategory]int{CategoryExchangeReceiver: 10}
+	h.SetCategorySeverity(severity)
+	// Severity is copied.
+	severity[CategoryExchangeReceiver] = 0
+	_, category, handler, _ = h.DebugClassify(mppErr)
+	require.Equal(t, CategoryExchangeReceiver, category)
+	require.Equal(t, exchangeReceiverHandlerName, handler)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: mppErr, NodeCnt: 1}))
+	require.Empty(t, fetcher.nodeCnts)
+	require.Equal(t, CategoryExchangeReceiver, h.Events()[0].Category)
+
+	// Categories not overridden keep default severity.
+	_, category, _, _ = h.DebugClassify(errors.Join(errors.New("connection refused"), memLimitErr))
+	require.Equal(t, CategoryMemLimit, category)
+	// The default severity is not modified.
+	require.Equal(t, 2, defaultCategorySeverity[CategoryExchangeReceiver])
+}
+
+func TestMaxBytesPerRow(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	normalChk := newTestChunk(10)
+	h.SetMaxBytesPerRow(normalChk.MemoryUsage())
+	require.True(t, h.HoldResult(normalChk))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+
+	// Chunk with huge hidden allocation.
+	abnormalChk := chunk.NewChunkWithCapacity(testFieldTypes, 100000)
+	abnormalChk.AppendInt64(0, 1)
+	require.False(t, h.HoldResult(abnormalChk))
+	require.False(t, h.CanHoldResult())
+	_, reason := h.HoldingStatus()
+	require.Equal(t, "abnormal memory usage", reason)
+	require.Equal(t, 2, h.NumHoldChk())
+	require.Equal(t, 2*normalChk.MemoryUsage(), h.NumHoldBytes())
+
+	h.ResetHolder()
+	h.SetMaxBytesPerRow(0)
+	require.True(t, h.HoldResult(abnormalChk))
+}
+
+func TestMaxHoldAge(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	clock := newMockClock()
+	h.nowFunc = clock.Now
+	h.SetMaxHoldAge(time.Second)
+
+	// Empty holder never exceeds the age.
+	clock.Advance(time.Minute)
+	require.True(t, h.CanHoldResult())
+
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	clock.Advance(500 * time.Millisecond)
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	clock.Advance(500 * time.Millisecond)
+	require.True(t, h.CanHoldResult())
+
+	clock.Advance(time.Millisecond)
+	require.False(t, h.CanHoldResult())
+	_, reason := h.HoldingStatus()
+	require.Equal(t, "max hold age exceeded", reason)
+	require.False(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, 2, h.NumHoldChk())
+	require.Equal(t, uint64(1), h.Stats().DroppedChunks)
+
+	h.ResetHolder()
+	require.True(t, h.CanHoldResult())
+	require.True(t, h.HoldResult(newTestChunk(10)))
+
+	// Age is checked by HoldResult even if CanHoldResult isn't called.
+	clock.Advance(2 * time.Second)
+	require.False(t, h.HoldResult(newTestChunk(10)))
+
+	h.ResetHolder()
+	h.SetMaxHoldAge(0)
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	clock.Advance(time.Hour)
+	require.True(t, h.CanHoldResult())
+}
+
+func TestEventLabels(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	memErr := errors.New("Memory limit exceeded")
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	labels := map[string]string{"conn": "1", "user": "root"}
+	h.SetEventLabels(labels)
+	// Labels are copied.
+	labels["conn"] = "2"
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	// Exhausted event also carries labels.
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}), ErrRecoveryExhausted)
+
+	events := h.Events()
+	require.Len(t, events, 4)
+	require.Nil(t, events[0].Labels)
+	for _, event := range events[1:] {
+		require.Equal(t, map[string]string{"conn": "1", "user": "root"}, event.Labels)
+	}
+
+	data, err := h.MarshalState()
+	require.NoError(t, err)
+	var state RecoveryState
+	require.NoError(t, json.Unmarshal(data, &state))
+	require.Equal(t, map[string]string{"conn": "1", "user": "root"}, state.Labels)
+	require.Len(t, state.Events, 4)
+	require.Equal(t, state.Labels, state.Events[3].Labels)
+	require.Equal(t, uint32(3), state.Stats.RecoveryCnt)
+
+	h.SetEventLabels(nil)
+	h.ResetRecoveryCnt()
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	events = h.Events()
+	require.Nil(t, events[len(events)-1].Labels)
+	data, err = h.MarshalState()
+	require.NoError(t, err)
+	require.NotContains(t, string(data), `"labels"`)
+}
+
+func TestErrFrequencyLimit(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	clock := newMockClock()
+	h.nowFunc = clock.Now
+	h.SetErrFrequencyLimit(time.Minute, 2)
+	memErr := errors.New("Memory limit exceeded")
+	exchangeErr := errors.New("Exchange receiver meet error")
+	recovery := func(mppErr error) error {
+		h.ResetRecoveryCnt()
+		return runRecovery(h, &RecoveryInfo{MPPErr: mppErr, NodeCnt: 1})
+	}
+
+	// Burst of the same category.
+	require.NoError(t, recovery(memErr))
+	clock.Advance(10 * time.Second)
+	require.NoError(t, recovery(memErr))
+	clock.Advance(10 * time.Second)
+	err := recovery(memErr)
+	require.ErrorIs(t, err, ErrTooFrequent)
+	require.Equal(t, uint32(0), h.RecoveryCnt())
+	// Each category has its own window.
+	require.NoError(t, recovery(exchangeErr))
+
+	// Refused occurrences are counted too, so the first two expire after the window but the third one doesn't.
+	clock.Advance(51 * time.Second)
+	require.NoError(t, recovery(memErr))
+	require.ErrorIs(t, recovery(memErr), ErrTooFrequent)
+
+	clock.Advance(time.Hour)
+	require.NoError(t, recovery(memErr))
+	require.NoError(t, recovery(memErr))
+	require.ErrorIs(t, recovery(memErr), ErrTooFrequent)
+
+	// ResetAll clears occurrences.
+	h.ResetAll()
+	require.NoError(t, recovery(memErr))
+
+	h.SetErrFrequencyLimit(0, 0)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, recovery(memErr))
+	}
+
+	// Occurrences refused by other limits are not counted.
+	h.SetErrFrequencyLimit(time.Minute, 2)
+	limiter := NewCategoryRateLimiter(1, 1)
+	limiter.nowFunc = clock.Now
+	h.SetCategoryRateLimiter(limiter)
+	require.NoError(t, recovery(memErr))
+	for i := 0; i < 3; i++ {
+		require.ErrorIs(t, recovery(memErr), ErrCategoryRateLimited)
+	}
+	clock.Advance(time.Second)
+	require.NoError(t, recovery(memErr))
+	h.maxRecoveryCnt = 0
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}), ErrRecoveryExhausted)
+	h.maxRecoveryCnt = 3
+	clock.Advance(time.Second)
+	require.ErrorIs(t, recovery(memErr), ErrTooFrequent)
+}
+
+func TestLastClassification(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	fetcher := newMockTopoFetcher()
+	setTestTopoFetcher(h, fetcher)
+	memErr := errors.New("Memory limit exceeded")
+	checkLast := func(category RecoveryErrorCategory, recoverable, attempted bool) {
+		c, r, a := h.LastClassification()
+		require.Equal(t, category, c)
+		require.Equal(t, recoverable, r)
+		require.Equal(t, attempted, a)
+	}
+	checkLast(CategoryUnknown, false, false)
+
+	// Recoverable.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	checkLast(CategoryMemLimit, true, true)
+
+	// Attempted but failed.
+	fetcher.err = errors.New("mock autoscaler err")
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	checkLast(CategoryMemLimit, true, true)
+	fetcher.err = nil
+
+	// Unknown.
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}))
+	checkLast(CategoryUnknown, false, false)
+
+	// Recoverable but refused intentionally.
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}), ErrRecoveryExhausted)
+	checkLast(CategoryMemLimit, true, false)
+
+	// Non-recoverable.
+	h.ResetRecoveryCnt()
+	err := runRecovery(h, &RecoveryInfo{MPPErr: errors.Join(memErr, context.Canceled), NodeCnt: 1})
+	require.ErrorIs(t, err, ErrNonRecoverable)
+	checkLast(CategoryMemLimit, false, false)
+	h.SetCategoryEnabled(CategoryMemLimit, false)
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	checkLast(CategoryMemLimit, false, false)
+
+	h.ResetAll()
+	checkLast(CategoryUnknown, false, false)
+}
+
+// sliceResultHolder is a trivial ResultHolder that holds at most capacity chunks.
+type sliceResultHolder struct {
+	capacity   int
+	chks       []*chunk.Chunk
+	numRows    uint64
+	cannotHold bool
+	resetCnt   int
+}
+
+func (h *sliceResultHolder) Insert(chk *chunk.Chunk, _ time.Time) bool {
+	if !h.CanHold() {
+		return false
+	}
+	h.chks = append(h.chks, chk)
+	h.numRows += uint64(chk.NumRows())
+	return true
+}
+
+func (h *sliceResultHolder) CanHold() bool {
+	return !h.cannotHold && len(h.chks) < h.capacity
+}
+
+func (h *sliceResultHolder) StopHolding() {
+	h.cannotHold = true
+}
+
+func (h *sliceResultHolder) PopFront() (*chunk.Chunk, error) {
+	if len(h.chks) == 0 {
+		return nil, errors.New("empty")
+	}
+	chk := h.chks[0]
+	h.chks = h.chks[1:]
+	h.cannotHold = true
+	return chk, nil
+}
+
+func (h *sliceResultHolder) Reset() error {
+	h.chks = nil
+	h.numRows = 0
+	h.cannotHold = false
+	h.resetCnt++
+	return nil
+}
+
+func (h *sliceResultHolder) Stats() ResultHolderStats {
+	return ResultHolderStats{NumChks: len(h.chks), NumRows: h.numRows, MemUsage: int64(len(h.chks)), Capacity: uint64(h.capacity)}
+}
+
+func TestCustomResultHolder(t *testing.T) {
+	holder := &sliceResultHolder{capacity: 2}
+	h := NewRecoveryHandler(true, 100, true, memory.NewTracker(-1, -1), WithResultHolder(holder))
+	setTestTopoFetcher(h, newMockTopoFetcher())
+
+	chk1, chk2 := newTestChunk(10), newTestChunk(20)
+	require.True(t, h.CanHoldResult())
+	require.True(t, h.HoldResult(chk1))
+	require.True(t, h.HoldResult(chk2))
+	require.False(t, h.CanHoldResult())
+	canHold, reason := h.HoldingStatus()
+	require.False(t, canHold)
+	require.Equal(t, "custom holder cannot hold", reason)
+	require.False(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, []*chunk.Chunk{chk1, chk2}, holder.chks)
+
+	require.Equal(t, 2, h.NumHoldChk())
+	require.Equal(t, uint64(30), h.NumHoldRows())
+	require.Equal(t, int64(2), h.NumHoldBytes())
+	stats := h.Stats()
+	require.Equal(t, 2, stats.HeldChunks)
+	require.Equal(t, uint64(1), stats.DroppedChunks)
+	// Default holder is not used.
+	require.Zero(t, h.holder.numChks())
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1}))
+	require.Same(t, chk1, h.PopFrontChk())
+	require.Equal(t, 1, h.NumHoldChk())
+
+	h.ResetHolder()
+	require.Equal(t, 1, holder.resetCnt)
+	require.True(t, h.CanHoldResult())
+	h.DisableHolding()
+	require.False(t, h.CanHoldResult())
+	h.ResetHolder()
+	h.MarkResultsStreamed()
+	require.True(t, holder.cannotHold)
+}
+
+func TestEventNodeCnt(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	fetcher := newMockTopoFetcher()
+	setTestTopoFetcher(h, fetcher)
+	h.maxRecoveryCnt = 10
+	memErr := errors.New("Memory limit exceeded")
+
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 4})
+	require.NoError(t, err)
+	require.Equal(t, 4, res.RequestedNodeCnt)
+	h.SetNodeCntJitter(3)
+	h.SetRandSource(rand.NewSource(1))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 4}))
+	h.SetNodeCntJitter(0)
+	// Failed AutoScaler call still requests nodes.
+	fetcher.err = errors.New("mock autoscaler err")
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 5}))
+	fetcher.err = nil
+	// AutoScaler isn't called.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 4}))
+	throttler := NewNodeGroupThrottler(time.Minute, NodeGroupThrottleCoalesce)
+	h.SetNodeGroupThrottler(throttler)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 6, NodeGroup: "g1"}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 6, NodeGroup: "g1"}))
+
+	events := h.Events()
+	require.Len(t, events, 6)
+	require.Equal(t, []int{4, 5, 6}, []int{fetcher.nodeCnts[0], fetcher.nodeCnts[2], fetcher.nodeCnts[3]})
+	require.Len(t, fetcher.nodeCnts, 4)
+	for i, nodeCnt := range fetcher.nodeCnts[:3] {
+		require.Equal(t, nodeCnt, events[i].NodeCnt)
+	}
+	require.Zero(t, events[3].NodeCnt)
+	require.Equal(t, 6, events[4].NodeCnt)
+	require.Zero(t, events[5].NodeCnt)
+}
+
+func TestMaxStateSize(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	h.SetEventLabels(map[string]string{"conn": "1"})
+	for i := 0; i < defaultMaxRecoveryEvents; i++ {
+		h.ResetRecoveryCnt()
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1}))
+	}
+	full, err := h.MarshalState()
+	require.NoError(t, err)
+	var state RecoveryState
+	require.NoError(t, json.Unmarshal(full, &state))
+	require.Len(t, state.Events, defaultMaxRecoveryEvents)
+	require.False(t, state.Truncated)
+
+	maxSize := len(full) / 2
+	h.SetMaxStateSize(maxSize)
+	data, err := h.MarshalState()
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(data), maxSize)
+	state = RecoveryState{}
+	require.NoError(t, json.Unmarshal(data, &state))
+	require.True(t, state.Truncated)
+	require.NotEmpty(t, state.Events)
+	require.Less(t, len(state.Events), defaultMaxRecoveryEvents)
+	// The newest events are kept.
+	events := h.Events()
+	require.Equal(t, events[len(events)-1].Time.Unix(), state.Events[len(state.Events)-1].Time.Unix())
+	require.Equal(t, map[string]string{"conn": "1"}, state.Labels)
+	require.Equal(t, uint64(defaultMaxRecoveryEvents), state.Stats.LifetimeRecoveryCnt)
+
+	// Stats are always kept.
+	h.SetMaxStateSize(1)
+	data, err = h.MarshalState()
+	require.NoError(t, err)
+	state = RecoveryState{}
+	require.NoError(t, json.Unmarshal(data, &state))
+	require.True(t, state.Truncated)
+	require.Empty(t, state.Events)
+	require.Nil(t, state.Labels)
+	require.Equal(t, uint64(defaultMaxRecoveryEvents), state.Stats.LifetimeRecoveryCnt)
+
+	h.SetMaxStateSize(0)
+	data, err = h.MarshalState()
+	require.NoError(t, err)
+	require.Equal(t, full, data)
+}
+
+func TestMemLimitFatalErr(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	fetcher := newMockTopoFetcher()
+	setTestTopoFetcher(h, fetcher)
+	fatalErr := errors.New("Memory limit exceeded: single row is too large to fit in memory of any node")
+
+	_, category, _, wouldRecover := h.DebugClassify(fatalErr)
+	require.Equal(t, CategoryMemLimit, category)
+	require.False(t, wouldRecover)
+	err := runRecovery(h, &RecoveryInfo{MPPErr: fatalErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrNonRecoverable)
+	require.Zero(t, h.RecoveryCnt())
+	require.Empty(t, fetcher.nodeCnts)
+	_, recoverable, attempted := h.LastClassification()
+	require.False(t, recoverable)
+	require.False(t, attempted)
+
+	// Fatal cause in a multi-error makes the whole err fatal.
+	err = runRecovery(h, &RecoveryInfo{MPPErr: errors.Join(errors.New("Exchange receiver meet error"), fatalErr), NodeCnt: 1})
+	require.ErrorIs(t, err, ErrNonRecoverable)
+
+	// Retryable mem limit err.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1}))
+	require.Len(t, fetcher.nodeCnts, 1)
+	// Patterns only apply to mem limit errs.
+	require.False(t, isMemLimitFatalErr(errors.New("mock unknown err: single row")))
+}
+
+func TestDecisionSink(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	fetcher := &hookedTopoFetcher{mockTopoFetcher: newMockTopoFetcher()}
+	setTestTopoFetcher(h, fetcher)
+	clock := newMockClock()
+	h.nowFunc = clock.Now
+	fetcher.onRecovery = func() { clock.Advance(time.Second) }
+	var buf bytes.Buffer
+	h.SetDecisionSink(&buf)
+	memErr := errors.New("Memory limit exceeded")
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 4}))
+	fetcher.err = errors.New("mock autoscaler err")
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 2}))
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}))
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}), ErrRecoveryExhausted)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	decisions := make([]map[string]any, 0, len(lines))
+	for _, line := range lines {
+		var decision map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &decision))
+		decisions = append(decisions, decision)
+	}
+	require.Equal(t, map[string]any{
+		"attempt": 1.0, "category": "MemLimit", "handler": memLimitHandlerName, "outcome": "recovered",
+		"duration": "1s", "node_cnt": 4.0,
+	}, decisions[0])
+	require.Equal(t, map[string]any{
+		"attempt": 2.0, "category": "MemLimit", "handler": memLimitHandlerName, "outcome": "failed",
+		"error": "mock autoscaler err", "duration": "1s", "node_cnt": 2.0,
+	}, decisions[1])
+	require.Equal(t, "refused", decisions[2]["outcome"])
+	require.Equal(t, "Unknown", decisions[2]["category"])
+	require.NotContains(t, decisions[2], "handler")
+	require.Equal(t, 3.0, decisions[3]["attempt"])
+	require.Equal(t, "refused", decisions[3]["outcome"])
+	require.Contains(t, decisions[3]["error"], "exceeds max recovery cnt")
+	require.Equal(t, "0s", decisions[3]["duration"])
+
+	// Write error doesn't fail recovery.
+	h.SetDecisionSink(&mockErrWriter{})
+	h.ResetRecoveryCnt()
+	fetcher.err = nil
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+}
+
+// hookedTopoFetcher calls onRecovery before RecoveryAndGetTopo returns.
+type hookedTopoFetcher struct {
+	*mockTopoFetcher
+	onRecovery func()
+}
+
+func (f *hookedTopoFetcher) RecoveryAndGetTopo(recovery tiflashcompute.RecoveryType, oriCNCnt int) ([]string, error) {
+	if f.onRecovery != nil {
+		f.onRecovery()
+	}
+	return f.mockTopoFetcher.RecoveryAndGetTopo(recovery, oriCNCnt)
+}
+
+type mockErrWriter struct{}
+
+func (*mockErrWriter) Write([]byte) (int, error) {
+	return 0, errors.New("mock write err")
+}
+
+func TestRescaleFragmentRatio(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	fetcher := newMockTopoFetcher()
+	setTestTopoFetcher(h, fetcher)
+	h.maxRecoveryCnt = 10
+	memErr := errors.New("Memory limit exceeded")
+	recovery := func(ratio float64) RecoveryResult {
+		res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memErr, NodeCnt: 2, FailedFragmentRatio: ratio})
+		require.NoError(t, err)
+		return res
+	}
+
+	// Always rescale by default.
+	require.Equal(t, RecoveryActionRescale, recovery(0.1).Action)
+	require.Len(t, fetcher.nodeCnts, 1)
+
+	h.SetRescaleFragmentRatio(0.5)
+	// Below threshold, re-dispatch.
+	res := recovery(0.1)
+	require.Equal(t, RecoveryActionRedispatch, res.Action)
+	require.Zero(t, res.RequestedNodeCnt)
+	require.Len(t, fetcher.nodeCnts, 1)
+	require.Equal(t, RecoveryActionRedispatch, recovery(0.49).Action)
+	require.Len(t, fetcher.nodeCnts, 1)
+
+	// Above threshold, rescale.
+	require.Equal(t, RecoveryActionRescale, recovery(0.5).Action)
+	require.Equal(t, RecoveryActionRescale, recovery(1).Action)
+	require.Len(t, fetcher.nodeCnts, 3)
+	// Unknown ratio, rescale.
+	require.Equal(t, RecoveryActionRescale, recovery(0).Action)
+	require.Len(t, fetcher.nodeCnts, 4)
+}
+
+// staticTopoFetcher returns topo without allocation.
+type staticTopoFetcher struct {
+	topo []string
+}
+
+func (f *staticTopoFetcher) FetchAndGetTopo() ([]string, error) {
+	return f.topo, nil
+}
+
+func (f *staticTopoFetcher) RecoveryAndGetTopo(tiflashcompute.RecoveryType, int) ([]string, error) {
+	return f.topo, nil
+}
+
+func TestObservabilityDisabled(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, &staticTopoFetcher{topo: []string{"127.0.0.1:3930"}})
+	var buf bytes.Buffer
+	h.SetDecisionSink(&buf)
+	h.SetEventLabels(map[string]string{"conn": "1"})
+	h.SetObservabilityEnabled(false)
+	ctx := context.Background()
+	memInfo := &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1, StoreAddr: "127.0.0.1:3930"}
+	exchangeInfo := &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 1}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		h.ResetRecoveryCnt()
+		_, err := h.Recovery(ctx, memInfo)
+		require.NoError(t, err)
+		_, err = h.Recovery(ctx, exchangeInfo)
+		require.NoError(t, err)
+	})
+	require.Zero(t, allocs)
+	require.Zero(t, buf.Len())
+	require.Empty(t, h.Events())
+	stats := h.Stats()
+	require.Empty(t, stats.HandlerRecoveryCnt)
+	require.Empty(t, stats.StoreRecoveryCnt)
+	require.Equal(t, uint32(2), stats.RecoveryCnt)
+
+	// Exhausted recoveries and dropped chunks are not counted, but cooldown still works.
+	h.SetExhaustCooldown(time.Hour)
+	h.maxRecoveryCnt = 2
+	require.ErrorIs(t, runRecovery(h, memInfo), ErrRecoveryExhausted)
+	require.False(t, h.HoldResult(newTestChunk(1)))
+	stats = h.Stats()
+	require.Zero(t, stats.ExhaustedCnt)
+	require.Zero(t, stats.DroppedChunks)
+	require.Empty(t, h.Events())
+
+	h.SetObservabilityEnabled(true)
+	h.ResetAll()
+	require.NoError(t, runRecovery(h, memInfo))
+	require.Len(t, h.Events(), 1)
+	require.NotZero(t, buf.Len())
+	require.Equal(t, uint32(1), h.Stats().StoreRecoveryCnt["127.0.0.1:3930"])
+}
+
+func BenchmarkRecoveryObservabilityDisabled(b *testing.B) {
+	h := newTestRecoveryHandler(100)
+	h.SetObservabilityEnabled(false)
+	ctx := context.Background()
+	info := &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 1}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ResetRecoveryCnt()
+		_, _ = h.Recovery(ctx, info)
+	}
+}
+
+func TestReplicaUnavailableHandler(t *testing.T) {
+	for _, msg := range []string{
+		"TiFlash replica is not available",
+		"Exchange receiver meet error : tiflash replica unavailable for table 1",
+		"TiFlash replica is not ready",
+	} {
+		require.Equal(t, CategoryReplicaUnavailable, classifyLeafErr(errors.New(msg)))
+	}
+
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	clock := newMockClock()
+	h.nowFunc = clock.Now
+	h.afterFunc = clock.After
+	replicaErr := errors.New("TiFlash replica is not available")
+
+	start := clock.Now()
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: replicaErr, NodeCnt: 2})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRedispatch, res.Action)
+	require.Equal(t, defaultReplicaWait, clock.Now().Sub(start))
+	// No rescale.
+	require.Empty(t, fetcher.nodeCnts)
+	require.Equal(t, replicaUnavailableHandlerName, h.Events()[0].Handler)
+	require.Equal(t, CategoryReplicaUnavailable, h.Events()[0].Category)
+
+	h.SetReplicaUnavailableWait(5 * time.Second)
+	start = clock.Now()
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: replicaErr, NodeCnt: 2}))
+	require.Equal(t, 5*time.Second, clock.Now().Sub(start))
+
+	// Memory limit is more severe, so rescale.
+	mppErr := errors.Join(replicaErr, errors.New("Memory limit exceeded"))
+	res, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: mppErr, NodeCnt: 2})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRescale, res.Action)
+
+	// Wait is interrupted by ctx.
+	h = newTestRecoveryHandler(100)
+	h.afterFunc = func(time.Duration) <-chan time.Time { return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = h.Recovery(ctx, &RecoveryInfo{MPPErr: replicaErr, NodeCnt: 2})
+	require.ErrorIs(t, err, context.Canceled)
+
+	h.SetReplicaUnavailableWait(0)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: replicaErr, NodeCnt: 2}))
+}
+
+func TestRecoveryDecider(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	fetcher := newMockTopoFetcher()
+	setTestTopoFetcher(h, fetcher)
+	var gotStats []RecoveryStats
+	h.SetRecoveryDecider(func(info *RecoveryInfo, stats RecoveryStats) (bool, tiflashcompute.RecoveryType, int) {
+		gotStats = append(gotStats, stats)
+		switch info.MPPErr.Error() {
+		case "mock unknown err":
+			return true, tiflashcompute.RecoveryTypeMemLimit, 7
+		case "Memory limit exceeded":
+			return false, tiflashcompute.RecoveryTypeNull, 0
+		default:
+			return true, tiflashcompute.RecoveryTypeNull, 0
+		}
+	})
+
+	// Decider recoveries an err that no builtin handler accepts, with its recovery type and node cnt.
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 2})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRescale, res.Action)
+	require.Equal(t, 7, res.RequestedNodeCnt)
+	require.Equal(t, []tiflashcompute.RecoveryType{tiflashcompute.RecoveryTypeMemLimit}, fetcher.recoveryTypes)
+	require.Equal(t, []int{7}, fetcher.nodeCnts)
+	require.Equal(t, deciderHandlerName, h.Events()[0].Handler)
+	_, recoverable, attempted := h.LastClassification()
+	require.True(t, recoverable)
+	require.True(t, attempted)
+
+	// Decider refuses an err that builtin handler accepts.
+	err = runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 2})
+	require.ErrorIs(t, err, ErrNonRecoverable)
+	require.Equal(t, uint32(1), h.RecoveryCnt())
+	category, recoverable, attempted := h.LastClassification()
+	require.Equal(t, CategoryMemLimit, category)
+	require.False(t, recoverable)
+	require.False(t, attempted)
+
+	// Node cnt computed by policy is used if decider returns 0.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 3}))
+	require.Equal(t, []int{7, 3}, fetcher.nodeCnts)
+	require.Equal(t, tiflashcompute.RecoveryTypeNull, fetcher.recoveryTypes[1])
+
+	// Decider gets current stats.
+	require.Len(t, gotStats, 3)
+	require.Equal(t, uint32(0), gotStats[0].RecoveryCnt)
+	require.Equal(t, uint32(1), gotStats[2].RecoveryCnt)
+
+	// Limits still apply.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 2}))
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 2}), ErrRecoveryExhausted)
+	require.Len(t, gotStats, 4)
+
+	h.SetRecoveryDecider(nil)
+	h.ResetRecoveryCnt()
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 2}))
+	require.Len(t, fetcher.nodeCnts, 3)
+}
+
+func TestSelfCheck(t *testing.T) {
+	newHealthyHandler := func() *RecoveryHandler {
+		h := newTestRecoveryHandler(25)
+		setTestTopoFetcher(h, newMockTopoFetcher())
+		require.NoError(t, h.SetSpillBackend(newMockSpillBackend(), testFieldTypes, newTestChunk(10).MemoryUsage()))
+		require.True(t, h.HoldResult(newTestChunk(10)))
+		require.True(t, h.HoldResult(newTestChunk(10)))
+		require.NotNil(t, h.PopFrontChk())
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1}))
+		require.NoError(t, h.SelfCheck())
+		return h
+	}
+	require.NoError(t, newTestRecoveryHandler(0).SelfCheck())
+
+	h := newHealthyHandler()
+	h.holder.curRows++
+	require.ErrorContains(t, h.SelfCheck(), "held rows mismatch")
+
+	h = newHealthyHandler()
+	h.holder.numSpilledChks++
+	require.ErrorContains(t, h.SelfCheck(), "spilled chunks mismatch")
+
+	h = newHealthyHandler()
+	h.holder.memTracker.Consume(10)
+	require.ErrorContains(t, h.SelfCheck(), "memory accounting mismatch")
+
+	h = newHealthyHandler()
+	h.holder.reason = cannotHoldReasonNone
+	require.ErrorContains(t, h.SelfCheck(), "cannotHold mismatches reason")
+
+	h = newHealthyHandler()
+	h.ResetHolder()
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	h.holder.curRows += 20
+	h.holder.poppedRows += 20
+	require.ErrorContains(t, h.SelfCheck(), "holder can hold after capacity reached")
+
+	h = newHealthyHandler()
+	h.holder.schema = HeldSchemaInfo{}
+	require.ErrorContains(t, h.SelfCheck(), "schema is not established")
+
+	h = newHealthyHandler()
+	h.curRecoveryCnt = h.maxRecoveryCnt + 1
+	require.ErrorContains(t, h.SelfCheck(), "recovery cnt exceeds max")
+
+	h = newHealthyHandler()
+	h.lifetimeRecoveryCnt = 0
+	require.ErrorContains(t, h.SelfCheck(), "exceeds lifetime recovery cnt")
+}
+
+type mockChunkPool struct {
+	puts []*chunk.Chunk
+}
+
+func (p *mockChunkPool) PutChunk(fields []*types.FieldType, chk *chunk.Chunk) {
+	if len(fields) != chk.NumCols() {
+		panic("unexpected field types")
+	}
+	p.puts = append(p.puts, chk)
+}
+
+func TestPopFrontChkWithRelease(t *testing.T) {
+	// Default behavior is unchanged without chunk pool.
+	h := NewRecoveryHandler(false, 100, true, memory.NewTracker(-1, -1))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	chk, release := h.PopFrontChkWithRelease()
+	require.Equal(t, 10, chk.NumRows())
+	release()
+	chk, release = h.PopFrontChkWithRelease()
+	require.Nil(t, chk)
+	release()
+
+	pool := &mockChunkPool{}
+	h = NewRecoveryHandler(false, 100, true, memory.NewTracker(-1, -1), WithChunkPool(pool, testFieldTypes))
+	chk1, chk2 := newTestChunk(10), newTestChunk(20)
+	require.True(t, h.HoldResult(chk1))
+	require.True(t, h.HoldResult(chk2))
+
+	chk, release1 := h.PopFrontChkWithRelease()
+	require.Same(t, chk1, chk)
+	require.Empty(t, pool.puts)
+	release1()
+	require.Equal(t, []*chunk.Chunk{chk1}, pool.puts)
+	// Release more than once does not return chunk to pool again.
+	release1()
+	require.Len(t, pool.puts, 1)
+
+	chk, release2 := h.PopFrontChkWithRelease()
+	require.Same(t, chk2, chk)
+	release2()
+	require.Equal(t, []*chunk.Chunk{chk1, chk2}, pool.puts)
+
+	// Chunks of different schema are not returned to pool.
+	h = NewRecoveryHandler(false, 100, true, memory.NewTracker(-1, -1), WithChunkPool(pool, append(testFieldTypes, testFieldTypes...)))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	_, release = h.PopFrontChkWithRelease()
+	release()
+	require.Len(t, pool.puts, 2)
+
+	// Real chunk pool works with popped chunks.
+	realPool := chunk.NewPool(10)
+	h = NewRecoveryHandler(false, 100, true, memory.NewTracker(-1, -1), WithChunkPool(realPool, testFieldTypes))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	_, release = h.PopFrontChkWithRelease()
+	release()
+	require.Equal(t, 0, realPool.GetChunk(testFieldTypes).NumRows())
+}
+
+// budgetStealingQuota uses up the shared budget when acquired, like a concurrent statement retry.
+type budgetStealingQuota struct {
+	budget *atomic.Uint32
+}
+
+func (q *budgetStealingQuota) Acquire(context.Context) error {
+	q.budget.Store(0)
+	return nil
+}
+
+func (*budgetStealingQuota) Release() {}
+
+func TestSharedBudget(t *testing.T) {
+	var budget atomic.Uint32
+	budget.Store(4)
+	h1 := NewRecoveryHandler(true, 100, true, memory.NewTracker(-1, -1), WithSharedBudget(&budget))
+	h2 := NewRecoveryHandler(true, 100, true, memory.NewTracker(-1, -1), WithSharedBudget(&budget))
+	setTestTopoFetcher(h1, newMockTopoFetcher())
+	setTestTopoFetcher(h2, newMockTopoFetcher())
+	info := &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1}
+
+	// Budget is consumed by both handlers.
+	require.NoError(t, runRecovery(h1, info))
+	require.NoError(t, runRecovery(h2, info))
+	require.NoError(t, runRecovery(h1, info))
+	require.Equal(t, uint32(1), budget.Load())
+	// Statement retry consumes the same budget.
+	budget.Add(^uint32(0))
+
+	require.ErrorIs(t, runRecovery(h2, info), ErrRecoveryExhausted)
+	require.ErrorIs(t, runRecovery(h1, info), ErrRecoveryExhausted)
+	require.Equal(t, uint32(0), budget.Load())
+	require.Equal(t, uint32(2), h1.RecoveryCnt())
+	require.Equal(t, uint32(1), h2.RecoveryCnt())
+	require.Equal(t, uint64(1), h1.Stats().ExhaustedCnt)
+
+	// Budget is not refilled by reset.
+	h1.ResetAll()
+	require.ErrorIs(t, runRecovery(h1, info), ErrRecoveryExhausted)
+
+	// Per-handler cap still applies.
+	budget.Store(10)
+	h1.maxRecoveryCnt = 1
+	require.NoError(t, runRecovery(h1, info))
+	require.ErrorIs(t, runRecovery(h1, info), ErrRecoveryExhausted)
+	require.Equal(t, uint32(9), budget.Load())
+
+	// Budget is used up by others after check.
+	budget.Store(1)
+	h2.ResetAll()
+	h2.quota = &budgetStealingQuota{budget: &budget}
+	require.ErrorIs(t, runRecovery(h2, info), ErrRecoveryExhausted)
+	require.Zero(t, h2.RecoveryCnt())
+	require.Equal(t, uint32(0), budget.Load())
+	require.True(t, h2.Events()[0].Exhausted)
+	require.Empty(t, h2.recoveredCategories)
+
+	// Budget is given back if rate limited.
+	budget.Store(2)
+	h2 = NewRecoveryHandler(true, 100, true, memory.NewTracker(-1, -1), WithSharedBudget(&budget))
+	setTestTopoFetcher(h2, newMockTopoFetcher())
+	limiter := NewCategoryRateLimiter(1, 1)
+	limiter.nowFunc = newMockClock().Now
+	h2.SetCategoryRateLimiter(limiter)
+	require.NoError(t, runRecovery(h2, info))
+	require.ErrorIs(t, runRecovery(h2, info), ErrCategoryRateLimited)
+	require.Equal(t, uint32(1), budget.Load())
+	require.Equal(t, uint32(1), h2.RecoveryCnt())
+}
+
+func TestRecoveryFragmentID(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	memLimitErr := errors.New("Memory limit exceeded")
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, FragmentID: 7}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, FragmentID: 7}))
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+
+	events := h.Events()
+	require.Len(t, events, 3)
+	require.Equal(t, uint64(7), events[0].FragmentID)
+	require.Equal(t, uint64(7), events[1].FragmentID)
+	require.Zero(t, events[2].FragmentID)
+	// Only recoveries with FragmentID are counted.
+	require.Equal(t, map[uint64]uint32{7: 2}, h.Stats().FragmentRecoveryCnt)
+
+	data, err := h.MarshalState()
+	require.NoError(t, err)
+	var state RecoveryState
+	require.NoError(t, json.Unmarshal(data, &state))
+	require.Equal(t, map[uint64]uint32{7: 2}, state.Stats.FragmentRecoveryCnt)
+	require.Equal(t, uint64(7), state.Events[0].FragmentID)
+
+	require.Equal(t, map[uint64]uint32{7: 2}, h.DrainStats().FragmentRecoveryCnt)
+	require.Empty(t, h.Stats().FragmentRecoveryCnt)
+}
+
+func TestEventRetention(t *testing.T) {
+	memLimitErr := errors.New("Memory limit exceeded")
+	networkErr := errors.New("connection refused")
+	record := func(h *RecoveryHandler, errs ...error) {
+		for _, err := range errs {
+			// Network err has no handler, but its event is still recorded.
+			_ = runRecovery(h, &RecoveryInfo{MPPErr: err, NodeCnt: 1})
+		}
+	}
+	attempts := func(h *RecoveryHandler) []uint32 {
+		var res []uint32
+		for _, event := range h.Events() {
+			res = append(res, event.Attempt)
+		}
+		return res
+	}
+	newHandler := func() *RecoveryHandler {
+		h := newTestRecoveryHandler(100)
+		h.maxRecoveryCnt = 100
+		setTestTopoFetcher(h, newMockTopoFetcher())
+		return h
+	}
+
+	// Default is a small FIFO cap.
+	h := newHandler()
+	for i := 0; i < defaultMaxRecoveryEvents+1; i++ {
+		record(h, memLimitErr)
+	}
+	require.Len(t, h.Events(), defaultMaxRecoveryEvents)
+	require.Equal(t, uint32(2), h.Events()[0].Attempt)
+
+	h = newHandler()
+	h.SetEventRetention(3, EvictOldest)
+	record(h, memLimitErr, networkErr, memLimitErr)
+	require.Equal(t, []uint32{1, 2, 3}, attempts(h))
+	record(h, networkErr)
+	require.Equal(t, []uint32{2, 3, 4}, attempts(h))
+
+	h = newHandler()
+	h.SetEventRetention(3, EvictLeastSevere)
+	record(h, memLimitErr, networkErr, memLimitErr)
+	require.Equal(t, []uint32{1, 2, 3}, attempts(h))
+	// The least severe one is dropped.
+	record(h, memLimitErr)
+	require.Equal(t, []uint32{1, 3, 4}, attempts(h))
+	// The new event is dropped if it's less severe than all kept events.
+	record(h, networkErr)
+	require.Equal(t, []uint32{1, 3, 4}, attempts(h))
+	// The oldest one is dropped among events of the same severity.
+	record(h, memLimitErr)
+	require.Equal(t, []uint32{3, 4, 6}, attempts(h))
+
+	// Shrinking the cap drops kept events by policy.
+	h = newHandler()
+	record(h, networkErr, memLimitErr, networkErr, memLimitErr)
+	h.SetEventRetention(2, EvictLeastSevere)
+	require.Equal(t, []uint32{2, 4}, attempts(h))
+	h.SetEventRetention(1, EvictOldest)
+	require.Equal(t, []uint32{4}, attempts(h))
+	require.NoError(t, h.SelfCheck())
+
+	h.SetEventRetention(0, EvictOldest)
+	require.Equal(t, defaultMaxRecoveryEvents, h.maxEvents)
+}
+
+func TestBuildClientError(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	h.maxRecoveryCnt = 2
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	h.SetReplicaUnavailableWait(0)
+	origErr := perrors.New("Memory limit exceeded")
+
+	require.NoError(t, h.BuildClientError(nil))
+	// No recovery context.
+	require.Same(t, origErr, h.BuildClientError(origErr))
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: origErr, NodeCnt: 1}))
+	err := h.BuildClientError(origErr)
+	require.Equal(t, "MPP query failed after 1 recovery attempt(s) for MemLimit: Memory limit exceeded", err.Error())
+	require.Same(t, origErr, perrors.Cause(err))
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("TiFlash replica is not available"), NodeCnt: 1}))
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: origErr, NodeCnt: 1}), ErrRecoveryExhausted)
+	require.Equal(t, "MPP query failed after 2 recovery attempt(s) for MemLimit, ReplicaUnavailable, "+
+		"recovery budget is exhausted: Memory limit exceeded", h.BuildClientError(origErr).Error())
+
+	// Recovery context is per statement.
+	h.ResetRecoveryCnt()
+	require.Same(t, origErr, h.BuildClientError(origErr))
+}
+
+func TestStreamingWindow(t *testing.T) {
+	h := newTestRecoveryHandler(25)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	h.SetStreamingWindow(20)
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	// Capacity is reached before streaming.
+	require.False(t, h.CanHoldResult())
+	require.Nil(t, h.PopStreamableChk())
+
+	h.MarkResultsStreamed()
+	require.True(t, h.CanHoldResult())
+	streamed := 0
+	for i := 0; i < 10; i++ {
+		require.True(t, h.HoldResult(newTestChunk(10)))
+		for chk := h.PopStreamableChk(); chk != nil; chk = h.PopStreamableChk() {
+			streamed += chk.NumRows()
+		}
+		// The bounded window is maintained during streaming.
+		require.LessOrEqual(t, h.holder.heldRows(), uint64(20))
+		require.True(t, h.CanHoldResult())
+		require.NoError(t, h.SelfCheck())
+	}
+	require.Equal(t, 110, streamed)
+	require.Equal(t, 2, h.NumHoldChk())
+
+	// Recovery is allowed after streaming, the held window is dropped.
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(110), res.StreamedRows)
+	require.Zero(t, h.NumHoldChk())
+	require.True(t, h.CanHoldResult())
+
+	// The un-streamed tail is drained at the end.
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.Nil(t, h.PopStreamableChk())
+	require.NotNil(t, h.PopFrontChk())
+	require.NotNil(t, h.PopFrontChk())
+	require.Nil(t, h.PopFrontChk())
+
+	h.ResetRecoveryCnt()
+	h.ResetHolder()
+	require.Nil(t, h.PopStreamableChk())
+
+	// Holding and recovery are disabled after streaming without the window.
+	h.SetStreamingWindow(0)
+	h.MarkResultsStreamed()
+	require.False(t, h.HoldResult(newTestChunk(10)))
+	_, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1})
+	require.ErrorIs(t, err, ErrResultsAlreadyStreamed)
+}
+
+type mockClassifierPlugin struct {
+	pattern  string
+	category RecoveryErrorCategory
+}
+
+func (p *mockClassifierPlugin) Classify(err error) (RecoveryErrorCategory, bool) {
+	if strings.Contains(err.Error(), p.pattern) {
+		return p.category, true
+	}
+	return CategoryUnknown, false
+}
+
+func TestClassifierPlugin(t *testing.T) {
+	register := func(plugin ClassifierPlugin) {
+		RegisterClassifier(plugin)
+		t.Cleanup(func() {
+			UnregisterClassifier(plugin)
+		})
+	}
+	customErr := errors.New("TiFlash: E1234 arena exhausted")
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	_, category, _, wouldRecover := h.DebugClassify(customErr)
+	require.Equal(t, CategoryUnknown, category)
+	require.False(t, wouldRecover)
+
+	memLimitPlugin := &mockClassifierPlugin{pattern: "E1234", category: CategoryMemLimit}
+	register(memLimitPlugin)
+	// Plugins are consulted in registration order.
+	register(&mockClassifierPlugin{pattern: "E1234", category: CategoryNetwork})
+	// Plugins are consulted before the built-in matchers.
+	register(&mockClassifierPlugin{pattern: "Memory limit", category: CategoryExchangeReceiver})
+
+	_, category, handler, wouldRecover := h.DebugClassify(customErr)
+	require.Equal(t, CategoryMemLimit, category)
+	require.Equal(t, "mem_limit", handler)
+	require.True(t, wouldRecover)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: customErr, NodeCnt: 1}))
+	require.Equal(t, CategoryMemLimit, h.Events()[0].Category)
+
+	require.Equal(t, CategoryExchangeReceiver, classifyLeafErr(errors.New("Memory limit exceeded")))
+	// Unknown errs still go to the built-in matchers.
+	require.Equal(t, CategoryNetwork, classifyLeafErr(errors.New("connection refused")))
+
+	// The next plugin decides after unregistering.
+	UnregisterClassifier(memLimitPlugin)
+	require.Equal(t, CategoryNetwork, classifyLeafErr(customErr))
+	// Unregistering twice is a no-op.
+	UnregisterClassifier(memLimitPlugin)
+	require.Equal(t, CategoryNetwork, classifyLeafErr(customErr))
+}
+
+// opaqueErr replaces the message of its cause, like an executor err that hides the original message.
+type opaqueErr struct {
+	msg   string
+	cause error
+}
+
+func (e *opaqueErr) Error() string { return e.msg }
+
+func (e *opaqueErr) Unwrap() error { return e.cause }
+
+// causerErr only exposes its cause by Cause().
+type causerErr struct {
+	cause error
+}
+
+func (*causerErr) Error() string { return "distsql request failed" }
+
+func (e *causerErr) Cause() error { return e.cause }
+
+func TestClassifyWrappedErr(t *testing.T) {
+	memLimitErr := perrors.New("Memory limit exceeded: single row is too large")
+	var err error = &opaqueErr{msg: "other error from TiFlash", cause: memLimitErr}
+	err = fmt.Errorf("coprocessor: %w", err)
+	err = &causerErr{cause: err}
+	err = perrors.Trace(err)
+	err = &opaqueErr{msg: "executor failed", cause: err}
+	require.NotContains(t, err.Error(), "Memory limit")
+
+	require.Equal(t, CategoryMemLimit, classifyLeafErr(err))
+	require.True(t, isMemLimitFatalErr(err))
+	require.Equal(t, CategoryExchangeReceiver,
+		classifyLeafErr(&opaqueErr{msg: "executor failed", cause: &causerErr{cause: errors.New("ExchangeReceiver closed")}}))
+	require.Equal(t, CategoryUnknown, classifyLeafErr(&causerErr{}))
+
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	wrapped := &opaqueErr{msg: "executor failed", cause: &causerErr{cause: perrors.New("Memory limit exceeded")}}
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: wrapped, NodeCnt: 1}))
+	require.Equal(t, CategoryMemLimit, h.Events()[0].Category)
+}
+
+func TestRecoveryFlushPrefixThenResume(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	require.NoError(t, h.SetSpillBackend(newMockSpillBackend(), testFieldTypes, newTestChunk(10).MemoryUsage()))
+	for i := 0; i < 4; i++ {
+		require.True(t, h.HoldResult(newTestChunk(10)))
+	}
+	require.Equal(t, 40, int(h.NumHoldRows()))
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	// Rows between held rows and resume offset are lost.
+	_, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, ResumeOffset: 41})
+	require.ErrorIs(t, err, ErrResumeOffsetOutOfRange)
+	require.Zero(t, h.RecoveryCnt())
+
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, ResumeOffset: 25})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionFlushPrefixThenResume, res.Action)
+	require.Equal(t, "FlushPrefixThenResume", res.Action.String())
+	require.Equal(t, uint64(25), res.PrefixRows)
+	require.Equal(t, 1, res.RequestedNodeCnt)
+	// Held chunks are truncated to the prefix, including spilled ones.
+	require.NoError(t, h.SelfCheck())
+	require.Equal(t, uint64(25), h.NumHoldRows())
+	var flushed []int
+	for chk := h.PopFrontChk(); chk != nil; chk = h.PopFrontChk() {
+		flushed = append(flushed, chk.NumRows())
+	}
+	require.Equal(t, []int{10, 10, 5}, flushed)
+	require.NoError(t, h.SelfCheck())
+
+	// Resume from scratch doesn't flush.
+	h.ResetHolder()
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	res, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRescale, res.Action)
+	require.Zero(t, res.PrefixRows)
+}
+
+func TestObservabilityMemTracked(t *testing.T) {
+	parent := memory.NewTracker(-1, -1)
+	h := NewRecoveryHandler(true, 100, true, parent)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	require.Zero(t, h.obsMemTracker.BytesConsumed())
+
+	memLimitErr := errors.New("Memory limit exceeded")
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, StoreAddr: "tiflash-0:3930", FragmentID: 1}))
+	consumed := h.obsMemTracker.BytesConsumed()
+	require.Greater(t, consumed, eventMemSize+3*counterEntryMemSize)
+	// It's visible from parent.
+	require.Equal(t, consumed, parent.BytesConsumed())
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, StoreAddr: "tiflash-0:3930", FragmentID: 1}))
+	// Only the new event is consumed, counters are not changed.
+	require.Equal(t, consumed+eventMemSize+int64(len(memLimitHandlerName)+len("tiflash-0:3930")),
+		h.obsMemTracker.BytesConsumed())
+
+	// Bounded by event retention.
+	h.SetEventRetention(1, EvictOldest)
+	require.Equal(t, consumed, h.obsMemTracker.BytesConsumed())
+
+	h.DrainStats()
+	require.Equal(t, consumed-3*counterEntryMemSize-int64(len(memLimitHandlerName)+len("tiflash-0:3930")),
+		h.obsMemTracker.BytesConsumed())
+
+	require.Contains(t, parent.GetChildrenForTest(), h.obsMemTracker)
+	h.Close()
+	require.Zero(t, h.obsMemTracker.BytesConsumed())
+	require.Zero(t, parent.BytesConsumed())
+	require.NotContains(t, parent.GetChildrenForTest(), h.obsMemTracker)
+}
+
+func TestSimulateRecovery(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	_, err := h.SimulateRecovery(CategoryMemLimit)
+	require.ErrorIs(t, err, ErrSimulationDisabled)
+	require.Zero(t, h.RecoveryCnt())
+
+	h = NewRecoveryHandler(true, 100, true, memory.NewTracker(-1, -1), WithRecoverySimulation())
+	h.maxRecoveryCnt = 10
+	h.SetReplicaUnavailableWait(0)
+	fetcher := newMockTopoFetcher()
+	setTestTopoFetcher(h, fetcher)
+
+	res, err := h.SimulateRecovery(CategoryMemLimit)
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRescale, res.Action)
+	// AutoScaler is called through the injected fetcher.
+	require.Equal(t, []tiflashcompute.RecoveryType{tiflashcompute.RecoveryTypeMemLimit}, fetcher.recoveryTypes)
+	require.Equal(t, []int{1}, fetcher.nodeCnts)
+
+	res, err = h.SimulateRecovery(CategoryExchangeReceiver)
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRedispatch, res.Action)
+	res, err = h.SimulateRecovery(CategoryReplicaUnavailable)
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRedispatch, res.Action)
+	// No handler recoveries network err.
+	_, err = h.SimulateRecovery(CategoryNetwork)
+	require.ErrorContains(t, err, "no handler to recovery")
+	_, err = h.SimulateRecovery(CategoryUnknown)
+	require.ErrorContains(t, err, "cannot simulate")
+
+	events := h.Events()
+	require.Len(t, events, 4)
+	require.Equal(t, memLimitHandlerName, events[0].Handler)
+	require.Equal(t, CategoryMemLimit, events[0].Category)
+	require.Equal(t, exchangeReceiverHandlerName, events[1].Handler)
+	require.Equal(t, replicaUnavailableHandlerName, events[2].Handler)
+	require.Equal(t, CategoryNetwork, events[3].Category)
+	require.Equal(t, uint32(4), h.RecoveryCnt())
+}
+
+func TestConcurrentRecoveryPolicy(t *testing.T) {
+	memLimitErr := errors.New("Memory limit exceeded")
+	waiters := func(h *RecoveryHandler) int {
+		h.flight.Lock()
+		defer h.flight.Unlock()
+		return h.flight.waiters
+	}
+	for _, policy := range []ConcurrentRecoveryPolicy{ConcurrentRecoveryCoalesce, ConcurrentRecoveryIndependent} {
+		h := newTestRecoveryHandler(100)
+		h.maxRecoveryCnt = 10
+		h.SetConcurrentRecoveryPolicy(policy)
+		fetcher := newMockTopoFetcher()
+		fetcher.block = make(chan struct{})
+		setTestTopoFetcher(h, fetcher)
+
+		const concurrency = 3
+		results := make(chan error, concurrency)
+		go func() {
+			_, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+			results <- err
+		}()
+		require.Eventually(t, h.inRecovery.Load, time.Second, time.Millisecond)
+		for i := 1; i < concurrency; i++ {
+			go func() {
+				_, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+				results <- err
+			}()
+		}
+		require.Eventually(t, func() bool { return waiters(h) == concurrency-1 }, time.Second, time.Millisecond)
+		// Unblock all the AutoScaler calls.
+		close(fetcher.block)
+		for i := 0; i < concurrency; i++ {
+			require.NoError(t, <-results)
+		}
+		require.False(t, h.inRecovery.Load())
+		require.Zero(t, waiters(h))
+
+		if policy == ConcurrentRecoveryCoalesce {
+			// Only the first call proceeds, others share its outcome.
+			require.Equal(t, uint32(1), h.RecoveryCnt())
+			require.Len(t, fetcher.nodeCnts, 1)
+		} else {
+			require.Equal(t, uint32(concurrency), h.RecoveryCnt())
+			require.Len(t, fetcher.nodeCnts, concurrency)
+		}
+		require.Len(t, h.Events(), int(h.RecoveryCnt()))
+	}
+}
+
+func TestTimeToFirstRecovery(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	clock := newMockClock()
+	h.nowFunc = clock.Now
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	_, ok := h.TimeToFirstRecovery()
+	require.False(t, ok)
+
+	// Statement starts at the first hold.
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	clock.Advance(time.Second)
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	clock.Advance(2 * time.Second)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	d, ok := h.TimeToFirstRecovery()
+	require.True(t, ok)
+	require.Equal(t, 3*time.Second, d)
+
+	// Only the first recovery counts.
+	clock.Advance(time.Second)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	d, _ = h.TimeToFirstRecovery()
+	require.Equal(t, 3*time.Second, d)
+
+	// Statement starts at the first recovery if nothing is held.
+	h.ResetRecoveryCnt()
+	_, ok = h.TimeToFirstRecovery()
+	require.False(t, ok)
+	clock.Advance(time.Second)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	d, ok = h.TimeToFirstRecovery()
+	require.True(t, ok)
+	require.Zero(t, d)
+}
+
+func TestClassifyMatchesLastClassification(t *testing.T) {
+	require.Equal(t, CategoryUnknown, Classify(nil))
+	for _, err := range []error{
+		errors.New("Memory limit exceeded"),
+		errors.New("Exchange receiver meet error"),
+		errors.New("TiFlash replica is not available"),
+		errors.New("connection refused"),
+		errors.New("mock unknown err"),
+		errors.Join(errors.New("connection refused"), errors.New("Memory limit exceeded")),
+		fmt.Errorf("wrapped: %w", errors.Join(errors.New("Exchange receiver meet error"), errors.New("mock unknown err"))),
+	} {
+		h := newTestRecoveryHandler(100)
+		setTestTopoFetcher(h, newMockTopoFetcher())
+		h.SetReplicaUnavailableWait(0)
+		_ = runRecovery(h, &RecoveryInfo{MPPErr: err, NodeCnt: 1})
+		category, _, _ := h.LastClassification()
+		require.Equal(t, category, Classify(err), err.Error())
+	}
+}
+
+func TestMaintenancePoolSize(t *testing.T) {
+	pool := NewMaintenancePool(2)
+	var running, maxRunning, completed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for !pool.trySubmit(func() {
+					cur := running.Add(1)
+					for prev := maxRunning.Load(); cur > prev && !maxRunning.CompareAndSwap(prev, cur); prev = maxRunning.Load() {
+					}
+					time.Sleep(time.Millisecond)
+					running.Add(-1)
+					completed.Add(1)
+				}) {
+					time.Sleep(100 * time.Microsecond)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	pool.Close()
+	require.Equal(t, int32(80), completed.Load())
+	require.LessOrEqual(t, maxRunning.Load(), int32(2))
+
+	// Tasks are refused when all goroutines are busy or pool is closed.
+	pool = NewMaintenancePool(1)
+	block := make(chan struct{})
+	started := make(chan struct{})
+	// Wait for the goroutine to be idle.
+	require.Eventually(t, func() bool {
+		return pool.trySubmit(func() {
+			close(started)
+			<-block
+		})
+	}, time.Second, time.Millisecond)
+	<-started
+	require.False(t, pool.trySubmit(func() {}))
+	close(block)
+	pool.Close()
+	pool.Close()
+	require.False(t, pool.trySubmit(func() {}))
+}
+
+func TestBackgroundSpill(t *testing.T) {
+	pool := NewMaintenancePool(2)
+	defer pool.Close()
+	backend := newMockSpillBackend()
+	h := NewRecoveryHandler(true, 100, true, memory.NewTracker(-1, -1), WithMaintenancePool(pool))
+	oneChkMem := newTestChunkFrom(0, 2).MemoryUsage()
+	require.NoError(t, h.SetSpillBackend(backend, testFieldTypes, 2*oneChkMem))
+
+	for i := 0; i < 5; i++ {
+		require.True(t, h.HoldResult(newTestChunkFrom(i*2, 2)))
+		require.NoError(t, h.SelfCheck())
+	}
+	h.holder.waitSpills()
+	require.Equal(t, 3, h.Stats().SpilledChunks)
+	require.Equal(t, 2*oneChkMem, h.NumHoldBytes())
+	require.Len(t, backend.data, 3)
+	require.NoError(t, h.SelfCheck())
+
+	var vals []int64
+	for h.NumHoldChk() > 0 {
+		chk := h.PopFrontChk()
+		require.NotNil(t, chk)
+		for i := 0; i < chk.NumRows(); i++ {
+			vals = append(vals, chk.GetRow(i).GetInt64(0))
+		}
+	}
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, vals)
+	require.Equal(t, int64(0), h.NumHoldBytes())
+	require.Empty(t, backend.data)
+
+	// Chunk is kept in memory if background spill failed, and pending spills are waited on close.
+	h.ResetHolder()
+	backend.mu.Lock()
+	backend.writeErr = errors.New("mock write err")
+	backend.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		require.True(t, h.HoldResult(newTestChunkFrom(i*2, 2)))
+	}
+	require.NoError(t, h.DumpHeldRows(&mockRowWriter{}))
+	require.Equal(t, 0, h.Stats().SpilledChunks)
+	require.Equal(t, 3*oneChkMem, h.NumHoldBytes())
+	require.NoError(t, h.SelfCheck())
+	h.Close()
+	require.Zero(t, h.holder.numPendingSpills)
+}
+
+func TestShouldStartHolding(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	h.SetShouldStartHolding(func(stats RecoveryStats) bool {
+		return stats.OfferedRows >= 4
+	})
+	require.False(t, h.CanHoldResult())
+	canHold, reason := h.HoldingStatus()
+	require.False(t, canHold)
+	require.Equal(t, "holding not started", reason)
+
+	require.False(t, h.HoldResult(newTestChunkFrom(0, 2)))
+	require.False(t, h.HoldResult(newTestChunkFrom(2, 2)))
+	require.True(t, h.CanHoldResult())
+	require.True(t, h.HoldResult(newTestChunkFrom(4, 2)))
+	require.True(t, h.HoldResult(newTestChunkFrom(6, 2)))
+	stats := h.Stats()
+	require.Equal(t, uint64(8), stats.OfferedRows)
+	require.Equal(t, uint64(4), stats.HeldRows)
+	require.Equal(t, uint64(2), stats.SkippedChunks)
+
+	// Holding keeps started after holder is reset, e.g. by recovery.
+	h.ResetHolder()
+	require.True(t, h.HoldResult(newTestChunkFrom(0, 2)))
+
+	// The predicate is consulted again in the next statement.
+	h.ResetHolder()
+	h.ResetRecoveryCnt()
+	require.Zero(t, h.Stats().OfferedRows)
+	require.False(t, h.CanHoldResult())
+	require.False(t, h.HoldResult(newTestChunkFrom(0, 4)))
+	require.True(t, h.HoldResult(newTestChunkFrom(4, 2)))
+
+	// Holding starts from the first chunk without predicate.
+	h.SetShouldStartHolding(nil)
+	h.ResetHolder()
+	h.ResetRecoveryCnt()
+	require.True(t, h.HoldResult(newTestChunkFrom(0, 2)))
+}
+
+func TestCloneForNewStmtAggregatesMetrics(t *testing.T) {
+	template := newTestRecoveryHandler(2)
+	agg := NewRecoveryMetricsAggregator()
+	template.SetMetricsAggregator(agg)
+	template.SetMinChunkRowsToHold(2)
+	setTestTopoFetcher(template, newMockTopoFetcher())
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	clones := make([]*RecoveryHandler, 3)
+	for i := range clones {
+		clones[i] = template.CloneForNewStmt(memory.NewTracker(-1, -1))
+	}
+	for i, h := range clones {
+		// Each clone recovers up to the max recovery cnt of template and then is exhausted.
+		for j := 0; j < 3; j++ {
+			require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+		}
+		require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrRecoveryExhausted)
+		require.False(t, h.HoldResult(newTestChunkFrom(0, 1)))
+		for j := 0; j <= i; j++ {
+			h.HoldResult(newTestChunkFrom(0, 2))
+		}
+	}
+	for i, h := range clones {
+		stats := h.Stats()
+		require.Equal(t, uint32(3), stats.RecoveryCnt)
+		require.Equal(t, uint64(1), stats.ExhaustedCnt)
+		require.Equal(t, uint64(1), stats.SkippedChunks)
+		require.Equal(t, uint64(i), stats.DroppedChunks)
+	}
+	require.Zero(t, template.Stats().LifetimeRecoveryCnt)
+	require.Equal(t, AggregatedRecoveryStats{
+		RecoveryCnt:   9,
+		ExhaustedCnt:  3,
+		DroppedChunks: 3,
+		SkippedChunks: 3,
+	}, agg.Stats())
+
+	// Aggregated counters survive draining and resetting of clones.
+	clones[0].DrainStats()
+	clones[1].ResetAll()
+	require.Equal(t, uint64(9), agg.Stats().RecoveryCnt)
+	for _, h := range clones {
+		h.Close()
+	}
+}
+
+func TestConsecutiveFailureThreshold(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	fetcher := newMockTopoFetcher()
+	setTestTopoFetcher(h, fetcher)
+	h.SetConsecutiveFailureThreshold(CategoryMemLimit, 3)
+	memLimitErr := errors.New("Memory limit exceeded")
+	newStmt := func() {
+		h.ResetHolder()
+		h.ResetRecoveryCnt()
+	}
+
+	// Failures in the same statement are counted once, and a success resets the count.
+	fetcher.err = errors.New("mock autoscaler err")
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, 1, h.ConsecutiveFailures(CategoryMemLimit))
+	newStmt()
+	fetcher.err = nil
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Zero(t, h.ConsecutiveFailures(CategoryMemLimit))
+
+	// Exhausted statements are failed too.
+	newStmt()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	}
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrRecoveryExhausted)
+	require.Equal(t, 1, h.ConsecutiveFailures(CategoryMemLimit))
+	fetcher.err = errors.New("mock autoscaler err")
+	for i := 0; i < 2; i++ {
+		newStmt()
+		require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	}
+	require.Equal(t, 3, h.ConsecutiveFailures(CategoryMemLimit))
+
+	// The category is disabled across statements until reset manually.
+	fetcher.err = nil
+	newStmt()
+	err := runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no handler")
+	h.ResetConsecutiveFailures()
+	require.Zero(t, h.ConsecutiveFailures(CategoryMemLimit))
+	newStmt()
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+
+	// Categories disabled manually are not enabled by reset.
+	h.SetCategoryEnabled(CategoryExchangeReceiver, false)
+	h.ResetConsecutiveFailures()
+	newStmt()
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 1}))
+
+	// Clone copies the manually disabled categories and thresholds, but not the auto disabled ones.
+	fetcher.err = errors.New("mock autoscaler err")
+	for i := 0; i < 3; i++ {
+		newStmt()
+		require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	}
+	fetcher.err = nil
+	c := h.CloneForNewStmt(memory.NewTracker(-1, -1))
+	require.Zero(t, c.ConsecutiveFailures(CategoryMemLimit))
+	require.NoError(t, runRecovery(c, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Error(t, runRecovery(c, &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 1}))
+	c.ResetConsecutiveFailures()
+	require.Error(t, runRecovery(c, &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 1}))
+	c.Close()
+}
+
+func TestHeldColumnStats(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	require.Nil(t, h.HeldColumnStats())
+
+	fieldTypes := []*types.FieldType{types.NewFieldType(mysql.TypeLonglong), types.NewFieldType(mysql.TypeVarchar)}
+	for i := 0; i < 3; i++ {
+		chk := chunk.NewChunkWithCapacity(fieldTypes, 4)
+		for j := 0; j < 4; j++ {
+			chk.AppendInt64(0, int64(j))
+			chk.AppendString(1, strings.Repeat("x", 100))
+		}
+		require.True(t, h.HoldResult(chk))
+	}
+	stats := h.HeldColumnStats()
+	require.Len(t, stats, 2)
+	require.Equal(t, 0, stats[0].ColIdx)
+	require.Equal(t, 1, stats[1].ColIdx)
+	// 12 int64 values and 12 strings of 100 bytes are held.
+	require.GreaterOrEqual(t, stats[0].Bytes, int64(12*8))
+	require.Less(t, stats[0].Bytes, int64(12*100))
+	require.GreaterOrEqual(t, stats[1].Bytes, int64(12*100))
+	require.Equal(t, h.NumHoldBytes(), stats[0].Bytes+stats[1].Bytes)
+	require.Equal(t, 3, h.NumHoldChk())
+
+	// Spilled chunks are not counted.
+	h.ResetHolder()
+	backend := newMockSpillBackend()
+	require.NoError(t, h.SetSpillBackend(backend, fieldTypes, 1))
+	chk := chunk.NewChunkWithCapacity(fieldTypes, 1)
+	chk.AppendInt64(0, 1)
+	chk.AppendString(1, "x")
+	require.True(t, h.HoldResult(chk))
+	require.Equal(t, 1, h.Stats().SpilledChunks)
+	require.Nil(t, h.HeldColumnStats())
+}
+
+type capabilityTopoFetcher struct {
+	*mockTopoFetcher
+	supportedTypes []tiflashcompute.RecoveryType
+}
+
+func (f *capabilityTopoFetcher) SupportedRecoveryTypes() []tiflashcompute.RecoveryType {
+	return f.supportedTypes
+}
+
+func TestSupportedRecoveryTypes(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	fetcher := &capabilityTopoFetcher{mockTopoFetcher: newMockTopoFetcher(), supportedTypes: []tiflashcompute.RecoveryType{}}
+	setTestTopoFetcher(h, fetcher)
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	// Mem limit handler declines because the fetcher lacks mem limit support, which doesn't consume recovery count.
+	err := runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrNonRecoverable)
+	require.Contains(t, err.Error(), memLimitHandlerName)
+	require.Zero(t, h.RecoveryCnt())
+	require.Empty(t, fetcher.recoveryTypes)
+
+	// Handlers that don't call AutoScaler are not affected.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Exchange receiver meet error"), NodeCnt: 1}))
+	// Re-dispatch without rescale doesn't require the recovery type.
+	h.SetRescaleFragmentRatio(0.5)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, FailedFragmentRatio: 0.1}))
+	h.SetRescaleFragmentRatio(0)
+
+	// The configured set overrides the capability of fetcher.
+	h.ResetRecoveryCnt()
+	h.SetSupportedRecoveryTypes([]tiflashcompute.RecoveryType{tiflashcompute.RecoveryTypeMemLimit})
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, []tiflashcompute.RecoveryType{tiflashcompute.RecoveryTypeMemLimit}, fetcher.recoveryTypes)
+	h.SetSupportedRecoveryTypes([]tiflashcompute.RecoveryType{tiflashcompute.RecoveryTypeNull})
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrNonRecoverable)
+
+	// Recovery type decided by RecoveryDecider is validated too.
+	h.SetRecoveryDecider(func(*RecoveryInfo, RecoveryStats) (bool, tiflashcompute.RecoveryType, int) {
+		return true, tiflashcompute.RecoveryTypeMemLimit, 0
+	})
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrNonRecoverable)
+
+	// All types are supported if neither the fetcher nor the config reports capability.
+	h.SetRecoveryDecider(nil)
+	h.SetSupportedRecoveryTypes(nil)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+}
+
+func TestPartialResultsOnDisabled(t *testing.T) {
+	h := NewRecoveryHandler(true, 100, false, memory.NewTracker(-1, -1))
+	memLimitErr := errors.New("Memory limit exceeded")
+	h.SetPartialResultsOnDisabled(true)
+	// Nothing to return.
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrRecoveryDisabled)
+
+	require.True(t, h.HoldResult(newTestChunkFrom(0, 2)))
+	require.True(t, h.HoldResult(newTestChunkFrom(2, 2)))
+	require.Nil(t, h.PopFrontChk())
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionReturnPartialWithWarning, res.Action)
+	require.Equal(t, "ReturnPartialWithWarning", res.Action.String())
+	require.Equal(t, uint64(4), res.PartialRows)
+	require.Equal(t, memLimitErr, perrors.Cause(res.Warning))
+	require.Contains(t, res.Warning.Error(), "4 partial row(s)")
+	require.Zero(t, h.RecoveryCnt())
+	require.False(t, h.CanHoldResult())
+
+	var vals []int64
+	for h.NumHoldChk() > 0 {
+		chk := h.PopFrontChk()
+		require.NotNil(t, chk)
+		for i := 0; i < chk.NumRows(); i++ {
+			vals = append(vals, chk.GetRow(i).GetInt64(0))
+		}
+	}
+	require.Equal(t, []int64{0, 1, 2, 3}, vals)
+
+	// Next statement fails outright if the mode is off.
+	h.ResetHolder()
+	h.ResetRecoveryCnt()
+	h.SetPartialResultsOnDisabled(false)
+	require.True(t, h.HoldResult(newTestChunkFrom(0, 2)))
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}), ErrRecoveryDisabled)
+	require.Nil(t, h.PopFrontChk())
+}
+
+func TestCapacityTuning(t *testing.T) {
+	parent := memory.NewTracker(-1, 1000)
+	h := NewRecoveryHandler(true, 6, true, parent)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	h.SetCapacityTuning(&CapacityTuning{MinCapacity: 2, MaxCapacity: 12, Step: 4, MemPressureRatio: 0.8})
+	memLimitErr := errors.New("Memory limit exceeded")
+	runStmt := func(rows int, pressure bool) {
+		if pressure {
+			parent.Consume(900)
+		}
+		for i := 0; i < rows && h.CanHoldResult(); i += 2 {
+			require.True(t, h.HoldResult(newTestChunkFrom(i, 2)))
+		}
+		if pressure {
+			parent.Consume(-900)
+		}
+		_ = runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+		h.ResetHolder()
+		h.ResetRecoveryCnt()
+	}
+
+	// Capacity is enough, it's kept.
+	runStmt(4, false)
+	require.Equal(t, uint64(6), h.EffectiveCapacity())
+	// Holder is full before the error, capacity grows up to max.
+	runStmt(100, false)
+	require.Equal(t, uint64(10), h.EffectiveCapacity())
+	// It takes effect in the next statement.
+	require.Equal(t, uint64(10), h.holder.Stats().Capacity)
+	runStmt(100, false)
+	require.Equal(t, uint64(12), h.EffectiveCapacity())
+	runStmt(100, false)
+	require.Equal(t, uint64(12), h.EffectiveCapacity())
+
+	// Memory pressure shrinks capacity down to min, even if holder is full.
+	for _, want := range []uint64{8, 4, 2, 2} {
+		runStmt(100, true)
+		require.Equal(t, want, h.EffectiveCapacity())
+	}
+
+	// Capacity is kept after tuning is stopped.
+	h.SetCapacityTuning(nil)
+	runStmt(100, false)
+	require.Equal(t, uint64(2), h.EffectiveCapacity())
+}
+
+type correlatedTopoFetcher struct {
+	*mockTopoFetcher
+	correlationIDs []string
+}
+
+func (f *correlatedTopoFetcher) RecoveryAndGetTopoWithCorrelationID(recovery tiflashcompute.RecoveryType, oriCNCnt int, correlationID string) ([]string, error) {
+	f.correlationIDs = append(f.correlationIDs, correlationID)
+	return f.RecoveryAndGetTopo(recovery, oriCNCnt)
+}
+
+func TestCorrelationID(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	fetcher := &correlatedTopoFetcher{mockTopoFetcher: newMockTopoFetcher()}
+	setTestTopoFetcher(h, fetcher)
+	var sink bytes.Buffer
+	h.SetDecisionSink(&sink)
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	// No correlation ID by default.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Empty(t, h.Events()[0].CorrelationID)
+	require.NotContains(t, sink.String(), "correlation_id")
+	require.Empty(t, fetcher.correlationIDs)
+
+	sink.Reset()
+	h.SetCorrelationID("req-1")
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}))
+	events := h.Events()
+	require.Len(t, events, 3)
+	require.Equal(t, "req-1", events[1].CorrelationID)
+	require.Equal(t, "req-1", events[2].CorrelationID)
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		var decision map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &decision))
+		require.Equal(t, "req-1", decision["correlation_id"])
+	}
+	require.Equal(t, []string{"req-1"}, fetcher.correlationIDs)
+	require.Equal(t, 2, len(fetcher.nodeCnts))
+}
+
+type flakyTopoFetcher struct {
+	*mockTopoFetcher
+	// failures is the number of following calls that fail.
+	failures int
+}
+
+func (f *flakyTopoFetcher) RecoveryAndGetTopo(recovery tiflashcompute.RecoveryType, oriCNCnt int) ([]string, error) {
+	topo, err := f.mockTopoFetcher.RecoveryAndGetTopo(recovery, oriCNCnt)
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("mock autoscaler err")
+	}
+	return topo, err
+}
+
+func TestAutoScalerInnerRetry(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	clock := newMockClock()
+	h.nowFunc, h.afterFunc = clock.Now, clock.After
+	fetcher := &flakyTopoFetcher{mockTopoFetcher: newMockTopoFetcher(), failures: 2}
+	setTestTopoFetcher(h, fetcher)
+	h.SetAutoScalerRetry(3, time.Second)
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	start := clock.Now()
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, 2*time.Second, clock.Now().Sub(start))
+	require.Len(t, fetcher.nodeCnts, 3)
+	require.Equal(t, uint32(1), h.RecoveryCnt())
+	require.Equal(t, uint64(2), h.InnerRetryCnt())
+	stats := h.Stats()
+	require.Equal(t, uint32(1), stats.RecoveryCnt)
+	require.Equal(t, uint64(2), stats.InnerRetryCnt)
+	require.Equal(t, map[string]uint32{memLimitHandlerName: 1}, stats.HandlerRecoveryCnt)
+	require.Equal(t, 2, h.Events()[0].InnerRetries)
+
+	// Recovery fails when retries are used up, which still counts once.
+	fetcher.failures = 10
+	require.Error(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, uint32(2), h.RecoveryCnt())
+	require.Equal(t, uint64(5), h.InnerRetryCnt())
+	require.Equal(t, 3, h.Events()[1].InnerRetries)
+
+	// Inner retries are counted per statement.
+	h.ResetRecoveryCnt()
+	fetcher.failures = 0
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Zero(t, h.InnerRetryCnt())
+	require.Zero(t, h.Events()[2].InnerRetries)
+}
+
+// deadlineHandler records the remaining time before deadline of ctx passed to it.
+type deadlineHandler struct {
+	remaining []time.Duration
+}
+
+func (h *deadlineHandler) DoRecovery(ctx context.Context, _ *RecoveryInfo, _ int) error {
+	remaining := time.Duration(-1)
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining = time.Until(deadline)
+	}
+	h.remaining = append(h.remaining, remaining)
+	return nil
+}
+
+func TestCategoryTimeouts(t *testing.T) {
+	fetcher := newMockTopoFetcher()
+	fetcher.block = make(chan struct{})
+	defer close(fetcher.block)
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	fallback := &deadlineHandler{}
+	h.SetFallbackHandler(fallback)
+	h.SetHandlerTimeout(time.Hour)
+	h.SetCategoryTimeouts(map[RecoveryErrorCategory]time.Duration{
+		CategoryMemLimit: 50 * time.Millisecond,
+		CategoryUnknown:  10 * time.Second,
+		CategoryNetwork:  0,
+	})
+
+	start := time.Now()
+	err := runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1})
+	require.ErrorIs(t, err, ErrHandlerTimeout)
+	require.Contains(t, err.Error(), "category: MemLimit, timeout: 50ms")
+	require.Less(t, time.Since(start), 10*time.Second)
+
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("mock unknown err"), NodeCnt: 1}))
+	require.Less(t, fallback.remaining[0], 10*time.Second)
+	require.Greater(t, fallback.remaining[0], 5*time.Second)
+	// No timeout for network errs.
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("connection refused"), NodeCnt: 1}))
+	require.Equal(t, time.Duration(-1), fallback.remaining[1])
+
+	// Other categories use the default timeout.
+	h.SetCategoryTimeouts(nil)
+	h.ResetRecoveryCnt()
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: errors.New("connection refused"), NodeCnt: 1}))
+	require.Greater(t, fallback.remaining[2], 10*time.Second)
+}
+
+func TestWouldExceedCapacity(t *testing.T) {
+	checkPrediction := func(h *RecoveryHandler, chk *chunk.Chunk) {
+		progress := h.holdProgress()
+		predicted := h.WouldExceedCapacity(chk)
+		require.Equal(t, progress, h.holdProgress())
+		held := h.HoldResult(chk)
+		require.Equal(t, predicted, !held || !h.CanHoldResult())
+	}
+
+	// Fixed capacity.
+	h := newTestRecoveryHandler(25)
+	require.False(t, h.WouldExceedCapacity(newTestChunk(10)))
+	for i := 0; i < 3; i++ {
+		checkPrediction(h, newTestChunk(10))
+	}
+	require.True(t, h.WouldExceedCapacity(newTestChunk(1)))
+
+	// Adaptive capacity.
+	parent := memory.NewTracker(-1, -1)
+	h = NewRecoveryHandler(true, 100, true, parent)
+	h.SetAdaptiveCapacity(true)
+	bytesPerRow := newTestChunk(10).MemoryUsage() / 10
+	parent.SetBytesLimit(1000 * bytesPerRow)
+	checkPrediction(h, newTestChunk(10))
+	parent.Consume(1000*bytesPerRow - 40*bytesPerRow)
+	checkPrediction(h, newTestChunk(10))
+	parent.Consume(20 * bytesPerRow)
+	require.True(t, h.WouldExceedCapacity(newTestChunk(10)))
+	checkPrediction(h, newTestChunk(10))
+
+	// Max bytes per row.
+	h = newTestRecoveryHandler(100)
+	h.SetMaxBytesPerRow(1)
+	require.True(t, h.WouldExceedCapacity(newTestChunk(10)))
+	checkPrediction(h, newTestChunk(10))
+}
+
+func TestStaleSnapshotHandler(t *testing.T) {
+	for _, msg := range []string{
+		"[tikv:9006]GC life time is shorter than transaction duration",
+		"Exchange receiver meet error : query id: 1, start ts 100 is smaller than GC safe point 200",
+		"read ts is stale",
+	} {
+		require.Equal(t, CategoryStaleSnapshot, classifyLeafErr(errors.New(msg)))
+	}
+
+	fetcher := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	staleErr := errors.New("start ts 100 is smaller than GC safe point 200")
+	// Disabled by default, because the snapshot must be refreshed by caller.
+	_, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: staleErr, NodeCnt: 2})
+	require.Error(t, err)
+	require.Empty(t, h.Events()[0].Handler)
+
+	h.SetStaleSnapshotRecovery(true)
+	require.True(t, h.CloneForNewStmt(memory.NewTracker(0, -1)).staleSnapshotRecovery)
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: staleErr, NodeCnt: 2})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRefreshSnapshotAndRetry, res.Action)
+	require.Equal(t, "RefreshSnapshotAndRetry", res.Action.String())
+	require.Zero(t, res.RequestedNodeCnt)
+	// No rescale.
+	require.Empty(t, fetcher.nodeCnts)
+	require.Equal(t, staleSnapshotHandlerName, h.Events()[1].Handler)
+	require.Equal(t, CategoryStaleSnapshot, h.Events()[1].Category)
+
+	// Memory limit is more severe, so rescale.
+	mppErr := errors.Join(staleErr, errors.New("Memory limit exceeded"))
+	res, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: mppErr, NodeCnt: 2})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRescale, res.Action)
+}
+
+func TestKilledSessionDropsHeldChunks(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	killer := &sqlkiller.SQLKiller{}
+	h.SetKiller(killer)
+
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.Greater(t, h.NumHoldBytes(), int64(0))
+
+	killer.SendKillSignal(sqlkiller.QueryMemoryExceeded)
+	require.False(t, h.HoldResult(newTestChunk(10)))
+	require.Zero(t, h.NumHoldRows())
+	require.Zero(t, h.NumHoldBytes())
+	require.False(t, h.CanHoldResult())
+	_, reason := h.HoldingStatus()
+	require.Equal(t, "session killed", reason)
+	require.NoError(t, h.holder.selfCheck())
+	// Mpp errs are not recovered.
+	_, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1})
+	require.ErrorIs(t, err, ErrNonRecoverable)
+	require.Zero(t, h.RecoveryCnt())
+
+	// It's fatal until the kill signal is cleared.
+	h.ResetHolder()
+	require.False(t, h.CanHoldResult())
+	killer.Reset()
+	h.ResetHolder()
+	require.True(t, h.HoldResult(newTestChunk(10)))
+}
+
+func TestOrderSensitive(t *testing.T) {
+	memLimitErr := errors.New("Memory limit exceeded")
+	for _, orderSensitive := range []bool{true, false} {
+		h := newTestRecoveryHandler(100)
+		setTestTopoFetcher(h, newMockTopoFetcher())
+		h.SetOrderSensitive(orderSensitive)
+		for i := 0; i < 4; i++ {
+			require.True(t, h.HoldResult(newTestChunk(10)))
+		}
+		res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, ResumeOffset: 25})
+		require.NoError(t, err)
+		if orderSensitive {
+			require.Equal(t, RecoveryActionFlushPrefixThenResume, res.Action)
+			require.Equal(t, uint64(25), res.PrefixRows)
+			require.Equal(t, uint64(25), h.NumHoldRows())
+		} else {
+			// Resume offset is ignored, re-dispatch from scratch.
+			require.Equal(t, RecoveryActionRescale, res.Action)
+			require.Zero(t, res.PrefixRows)
+			require.Equal(t, uint64(40), h.NumHoldRows())
+			// Out of range resume offset is ignored too.
+			_, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1, ResumeOffset: 41})
+			require.NoError(t, err)
+		}
+
+		// Streaming window mode.
+		h = newTestRecoveryHandler(100)
+		setTestTopoFetcher(h, newMockTopoFetcher())
+		h.SetOrderSensitive(orderSensitive)
+		h.SetStreamingWindow(10)
+		h.MarkResultsStreamed()
+		// Nothing is streamed yet, recovery is allowed.
+		require.True(t, h.HoldResult(newTestChunk(10)))
+		res, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+		require.NoError(t, err)
+		require.Zero(t, res.StreamedRows)
+		require.True(t, h.HoldResult(newTestChunk(10)))
+		require.True(t, h.HoldResult(newTestChunk(10)))
+		require.NotNil(t, h.PopStreamableChk())
+		res, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+		if orderSensitive {
+			require.NoError(t, err)
+			require.Equal(t, uint64(10), res.StreamedRows)
+		} else {
+			require.ErrorIs(t, err, ErrResultsAlreadyStreamed)
+			require.Equal(t, uint32(1), h.RecoveryCnt())
+		}
+	}
+}
+
+func TestInRecovery(t *testing.T) {
+	fetcher := newMockTopoFetcher()
+	fetcher.block = make(chan struct{})
+	h := newTestRecoveryHandler(100)
+	setTestTopoFetcher(h, fetcher)
+	require.False(t, h.InRecovery())
+	require.True(t, h.HoldResult(newTestChunk(10)))
+
+	done := make(chan error)
+	go func() {
+		done <- runRecovery(h, &RecoveryInfo{MPPErr: errors.New("Memory limit exceeded"), NodeCnt: 1})
+	}()
+	require.Eventually(t, h.InRecovery, time.Second, time.Millisecond)
+	// Dashboard observes stats from another goroutine while Recovery is running.
+	require.Eventually(t, func() bool { return h.Stats().InRecovery }, time.Second, time.Millisecond)
+	stats := h.Stats()
+	require.Zero(t, stats.RecoveryCnt)
+	require.Equal(t, 1, stats.HeldChunks)
+	close(fetcher.block)
+	require.NoError(t, <-done)
+	require.False(t, h.InRecovery())
+	stats = h.Stats()
+	require.False(t, stats.InRecovery)
+	require.Equal(t, uint32(1), stats.RecoveryCnt)
+}
+
+func TestEstimatedResultRows(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	// Unknown estimate.
+	require.True(t, h.HoldResult(newTestChunk(10)))
+
+	// No limit by default.
+	h.SetEstimatedResultRows(math.MaxUint64)
+	require.True(t, h.CanHoldResult())
+	require.True(t, h.HoldResult(newTestChunk(10)))
+
+	h.SetMaxEstimateRatio(10)
+	h.SetEstimatedResultRows(1000)
+	require.True(t, h.CanHoldResult())
+	require.True(t, h.HoldResult(newTestChunk(10)))
+
+	// Huge estimate skips holding.
+	h.SetEstimatedResultRows(1001)
+	require.False(t, h.CanHoldResult())
+	_, reason := h.HoldingStatus()
+	require.Equal(t, "estimated rows too large", reason)
+	require.True(t, h.WouldExceedCapacity(newTestChunk(10)))
+	require.False(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, uint64(30), h.NumHoldRows())
+	require.Equal(t, uint64(1), h.Stats().SkippedChunks)
+
+	h.SetMaxEstimateRatio(20)
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	h.SetMaxEstimateRatio(0)
+	h.SetEstimatedResultRows(math.MaxUint64)
+	require.True(t, h.HoldResult(newTestChunk(10)))
+
+	// The estimate is per statement.
+	h.SetMaxEstimateRatio(10)
+	require.False(t, h.CanHoldResult())
+	h.ResetRecoveryCnt()
+	require.True(t, h.CanHoldResult())
+}
+
+func TestChunkSizer(t *testing.T) {
+	h := newTestRecoveryHandler(100)
+	h.SetChunkSizer(func(chk *chunk.Chunk) int64 { return int64(chk.NumRows()) * 100 })
+	for i := 0; i < 3; i++ {
+		require.True(t, h.HoldResult(newTestChunk(10)))
+	}
+	require.Equal(t, int64(3000), h.NumHoldBytes())
+	require.NoError(t, h.SelfCheck())
+
+	// Held chunks are released by the bytes accounted on insert, even if sizer is changed.
+	require.NotNil(t, h.PopFrontChk())
+	require.Equal(t, int64(2000), h.NumHoldBytes())
+	h.SetChunkSizer(nil)
+	require.NotNil(t, h.PopFrontChk())
+	require.NotNil(t, h.PopFrontChk())
+	require.Zero(t, h.NumHoldBytes())
+	require.NoError(t, h.SelfCheck())
+	h.ResetHolder()
+
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, newTestChunk(10).MemoryUsage(), h.NumHoldBytes())
+}
+
+func TestTopoFetcherFailover(t *testing.T) {
+	primary := newMockTopoFetcher()
+	primary.err = errors.New("mock AutoScaler unavailable")
+	empty := newMockTopoFetcher()
+	empty.topo = nil
+	secondary := newMockTopoFetcher()
+	unused := newMockTopoFetcher()
+	h := newTestRecoveryHandler(100)
+	h.SetTopoFetchers(primary, empty, secondary, unused)
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	res, err := h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.NoError(t, err)
+	require.Equal(t, RecoveryActionRescale, res.Action)
+	require.Equal(t, []int{1}, primary.nodeCnts)
+	require.Equal(t, []int{1}, empty.nodeCnts)
+	require.Equal(t, []int{1}, secondary.nodeCnts)
+	require.Empty(t, unused.nodeCnts)
+	require.Equal(t, uint32(1), h.RecoveryCnt())
+
+	// Fails if no fetcher provides topo.
+	secondary.err = errors.New("mock AutoScaler unavailable")
+	unused.topo = nil
+	_, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.ErrorIs(t, err, ErrEmptyTopo)
+	require.Len(t, unused.nodeCnts, 1)
+
+	// The primary is tried first.
+	primary.err = nil
+	_, err = h.Recovery(context.Background(), &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.NoError(t, err)
+	require.Len(t, primary.nodeCnts, 3)
+	require.Len(t, empty.nodeCnts, 2)
+}
+
+func TestAutoScalerRateGate(t *testing.T) {
+	clock := newMockClock()
+	gate := NewAutoScalerRateGate(5 * time.Second)
+	gate.nowFunc = clock.Now
+	newHandler := func() *RecoveryHandler {
+		h := newTestRecoveryHandler(100)
+		setTestTopoFetcher(h, newMockTopoFetcher())
+		h.nowFunc = clock.Now
+		h.afterFunc = clock.After
+		h.SetAutoScalerRateGate(gate)
+		return h
+	}
+	h1, h2 := newHandler(), newHandler()
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	start := clock.Now()
+	require.NoError(t, runRecovery(h1, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, start, clock.Now())
+	// The gate is shared, the second call waits the interval.
+	require.NoError(t, runRecovery(h2, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, 5*time.Second, clock.Now().Sub(start))
+
+	// No wait after the interval elapses.
+	clock.Advance(10 * time.Second)
+	start = clock.Now()
+	require.NoError(t, runRecovery(h1, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+	require.Equal(t, start, clock.Now())
+
+	// Wait is interrupted by ctx.
+	h2.afterFunc = func(time.Duration) <-chan time.Time { return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := h2.Recovery(ctx, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSkipLogSampleRate(t *testing.T) {
+	h := newTestRecoveryHandler(20)
+	var reasons []string
+	h.logSkip = func(reason cannotHoldReason, _ *chunk.Chunk) {
+		reasons = append(reasons, reason.String())
+	}
+	h.SetMinChunkRowsToHold(5)
+
+	// No log by default.
+	require.False(t, h.HoldResult(newTestChunk(1)))
+	require.Empty(t, reasons)
+
+	h.SetSkipLogSampleRate(1)
+	require.False(t, h.HoldResult(newTestChunk(1)))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.True(t, h.HoldResult(newTestChunk(10)))
+	require.False(t, h.HoldResult(newTestChunk(10)))
+	h.ResetHolder()
+	h.SetMaxEstimateRatio(10)
+	h.SetEstimatedResultRows(1000)
+	require.False(t, h.HoldResult(newTestChunk(10)))
+	require.Equal(t, []string{"chunk rows below min", "capacity reached", "estimated rows too large"}, reasons)
+
+	// Skips are sampled.
+	h.SetEstimatedResultRows(0)
+	h.SetRandSource(rand.NewSource(1))
+	h.SetSkipLogSampleRate(0.2)
+	reasons = reasons[:0]
+	expected := 0
+	sampler := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		require.False(t, h.HoldResult(newTestChunk(1)))
+		if sampler.Float64() < 0.2 {
+			expected++
+		}
+	}
+	require.Len(t, reasons, expected)
+	require.InDelta(t, 200, expected, 50)
+}
+
+// overlapFetcher records the max number of concurrent AutoScaler calls.
+type overlapFetcher struct {
+	block chan struct{}
+
+	mu        sync.Mutex
+	calls     int
+	active    int
+	maxActive int
+}
+
+func (*overlapFetcher) FetchAndGetTopo() ([]string, error) {
+	return []string{"127.0.0.1:3930"}, nil
+}
+
+func (f *overlapFetcher) RecoveryAndGetTopo(tiflashcompute.RecoveryType, int) ([]string, error) {
+	f.mu.Lock()
+	f.calls++
+	f.active++
+	f.maxActive = max(f.maxActive, f.active)
+	f.mu.Unlock()
+	<-f.block
+	f.mu.Lock()
+	f.active--
+	f.mu.Unlock()
+	return []string{"127.0.0.1:3930"}, nil
+}
+
+func (f *overlapFetcher) stats() (calls, maxActive int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls, f.maxActive
+}
+
+func TestAbandonedAutoScalerCall(t *testing.T) {
+	memErr := errors.New("Memory limit exceeded")
+	fetcher := &overlapFetcher{block: make(chan struct{})}
+	h := newTestRecoveryHandler(100)
+	h.maxRecoveryCnt = 10
+	setTestTopoFetcher(h, fetcher)
+	h.SetHandlerTimeout(20 * time.Millisecond)
+
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}), ErrHandlerTimeout)
+	// The next attempt waits for the abandoned call instead of calling AutoScaler concurrently.
+	require.ErrorIs(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}), ErrHandlerTimeout)
+	calls, _ := fetcher.stats()
+	require.Equal(t, 1, calls)
+	// Waiting for the abandoned call is canceled by timeout, which is not AutoScaler failure.
+	require.Zero(t, h.autoScaler.consecutiveFailures)
+
+	close(fetcher.block)
+	require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1}))
+	calls, maxActive := fetcher.stats()
+	require.Equal(t, 2, calls)
+	require.Equal(t, 1, maxActive)
+
+	// AutoScaler isn't called if ctx is already done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := h.Recovery(ctx, &RecoveryInfo{MPPErr: memErr, NodeCnt: 1})
+	require.ErrorIs(t, err, context.Canceled)
+	calls, _ = fetcher.stats()
+	require.Equal(t, 2, calls)
+}
+
+func TestDrainStatsWhileHolding(t *testing.T) {
+	h := newTestRecoveryHandler(1000)
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	h.maxRecoveryCnt = 100
+	memLimitErr := errors.New("Memory limit exceeded")
+
+	// Metrics exporter drains stats while the executor holds results and recovers.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				h.DrainStats()
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		h.HoldResult(newTestChunk(10))
+		if i%10 == 0 {
+			require.NoError(t, runRecovery(h, &RecoveryInfo{MPPErr: memLimitErr, NodeCnt: 1}))
+		}
+		if i%20 == 0 {
+			h.PopFrontChk()
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	stats := h.Stats()
+	require.Equal(t, h.NumHoldChk(), stats.HeldChunks)
+	require.Equal(t, h.NumHoldRows(), stats.HeldRows)
+	require.Equal(t, uint64(500), stats.OfferedRows)
+	require.Equal(t, uint32(5), stats.RecoveryCnt)
+	require.Equal(t, uint64(5), stats.LifetimeRecoveryCnt)
+
+	h.ResetAll()
+	stats = h.Stats()
+	require.Zero(t, stats.HeldChunks)
+	require.Zero(t, stats.RecoveryCnt)
+	require.Zero(t, stats.LifetimeRecoveryCnt)
+}
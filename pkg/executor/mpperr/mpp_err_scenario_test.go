@@ -0,0 +1,500 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type scenarioOp int
+
+const (
+	opHold scenarioOp = iota
+	opPop
+	opRecovery
+	opResetHolder
+	opResetRecoveryCnt
+	opResetAll
+	opDisableHolding
+	opMarkStreamed
+	opAdvanceClock
+)
+
+// String implements fmt.Stringer interface.
+func (op scenarioOp) String() string {
+	switch op {
+	case opHold:
+		return "hold"
+	case opPop:
+		return "pop"
+	case opRecovery:
+		return "recovery"
+	case opResetHolder:
+		return "resetHolder"
+	case opResetRecoveryCnt:
+		return "resetRecoveryCnt"
+	case opResetAll:
+		return "resetAll"
+	case opDisableHolding:
+		return "disableHolding"
+	case opMarkStreamed:
+		return "markStreamed"
+	case opAdvanceClock:
+		return "advanceClock"
+	default:
+		return "unknown"
+	}
+}
+
+type scenarioStep struct {
+	op scenarioOp
+	// rows is the row count of chunk to hold if chk is nil.
+	rows int
+	chk  *chunk.Chunk
+	// mppErr is the error to recovery.
+	mppErr  error
+	advance time.Duration
+
+	// wantOK is the expected result of hold, pop and recovery.
+	wantOK bool
+	// wantErr is checked by ErrorIs if recovery fails.
+	wantErr error
+	// wantCanHold is checked after the step if it's not nil.
+	wantCanHold *bool
+}
+
+type scenario struct {
+	name      string
+	holderCap uint64
+	// disabled is true if recovery is not enabled.
+	disabled bool
+	setup    func(h *RecoveryHandler, clock *mockClock)
+	steps    []scenarioStep
+	// check is called after all steps if it's not nil.
+	check func(t *testing.T, h *RecoveryHandler)
+}
+
+// scenarioSnapshot is the state of RecoveryHandler before a step, used to check state transitions.
+type scenarioSnapshot struct {
+	cannotHold bool
+	reason     cannotHoldReason
+	stats      RecoveryStats
+}
+
+func takeScenarioSnapshot(h *RecoveryHandler) scenarioSnapshot {
+	return scenarioSnapshot{
+		cannotHold: h.holder.cannotHold,
+		reason:     h.holder.reason,
+		stats:      h.Stats(),
+	}
+}
+
+var (
+	scenarioMemErr     = errors.New("Memory limit exceeded")
+	scenarioRecvErr    = errors.New("Exchange receiver meet error")
+	scenarioUnknownErr = errors.New("mock unknown err")
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func runScenario(t *testing.T, s scenario) {
+	h := NewRecoveryHandler(true, s.holderCap, !s.disabled, memory.NewTracker(-1, -1))
+	setTestTopoFetcher(h, newMockTopoFetcher())
+	clock := newMockClock()
+	h.nowFunc = clock.Now
+	h.afterFunc = clock.After
+	if s.setup != nil {
+		s.setup(h, clock)
+	}
+	checkScenarioInvariants(t, h, takeScenarioSnapshot(h), opResetAll, "initial")
+	for i, step := range s.steps {
+		msg := fmt.Sprintf("step %d: %v", i, step.op)
+		prev := takeScenarioSnapshot(h)
+		switch step.op {
+		case opHold:
+			chk := step.chk
+			if chk == nil {
+				chk = newTestChunk(step.rows)
+			}
+			require.Equal(t, step.wantOK, h.HoldResult(chk), msg)
+		case opPop:
+			require.Equal(t, step.wantOK, h.PopFrontChk() != nil, msg)
+		case opRecovery:
+			err := runRecovery(h, &RecoveryInfo{MPPErr: step.mppErr, NodeCnt: 1})
+			if step.wantOK {
+				require.NoError(t, err, msg)
+			} else if step.wantErr != nil {
+				require.ErrorIs(t, err, step.wantErr, msg)
+			} else {
+				require.Error(t, err, msg)
+			}
+		case opResetHolder:
+			h.ResetHolder()
+		case opResetRecoveryCnt:
+			h.ResetRecoveryCnt()
+		case opResetAll:
+			h.ResetAll()
+		case opDisableHolding:
+			h.DisableHolding()
+		case opMarkStreamed:
+			h.MarkResultsStreamed()
+		case opAdvanceClock:
+			clock.Advance(step.advance)
+		}
+		if step.wantCanHold != nil {
+			require.Equal(t, *step.wantCanHold, h.CanHoldResult(), msg)
+		}
+		checkScenarioInvariants(t, h, prev, step.op, msg)
+	}
+	if s.check != nil {
+		s.check(t, h)
+	}
+	h.Close()
+	require.Zero(t, h.NumHoldBytes())
+	require.Zero(t, h.NumHoldChk())
+}
+
+// checkScenarioInvariants checks the invariants that must hold after any step.
+func checkScenarioInvariants(t *testing.T, h *RecoveryHandler, prev scenarioSnapshot, op scenarioOp, msg string) {
+	require.False(t, h.inRecovery.Load(), msg)
+	require.NoError(t, h.SelfCheck(), msg)
+
+	// Memory reconciliation.
+	require.Equal(t, h.holder.heldMemUsage(), h.NumHoldBytes(), msg)
+	require.GreaterOrEqual(t, h.NumHoldBytes(), int64(0), msg)
+	var heldRows uint64
+	var spilledChks int
+	for _, held := range h.holder.chks {
+		heldRows += uint64(held.numRows)
+		if held.chk == nil {
+			spilledChks++
+			require.Zero(t, held.memUsage, msg)
+		}
+	}
+	require.Equal(t, spilledChks, h.holder.numSpilledChks, msg)
+	// Popped chunks are still counted by curRows.
+	require.LessOrEqual(t, heldRows, h.NumHoldRows(), msg)
+	if h.NumHoldChk() > 0 {
+		require.True(t, h.HeldSchemaInfo().Established, msg)
+	}
+
+	// Counter bounds.
+	stats := h.Stats()
+	require.LessOrEqual(t, stats.RecoveryCnt, stats.MaxRecoveryCnt, msg)
+	require.GreaterOrEqual(t, stats.LifetimeRecoveryCnt, uint64(stats.RecoveryCnt), msg)
+	require.LessOrEqual(t, len(h.Events()), defaultMaxRecoveryEvents, msg)
+	var handlerRecoveryCnt uint64
+	for _, cnt := range stats.HandlerRecoveryCnt {
+		handlerRecoveryCnt += uint64(cnt)
+	}
+	require.LessOrEqual(t, handlerRecoveryCnt, stats.LifetimeRecoveryCnt, msg)
+	if op != opResetAll {
+		require.GreaterOrEqual(t, stats.LifetimeRecoveryCnt, prev.stats.LifetimeRecoveryCnt, msg)
+		require.GreaterOrEqual(t, stats.DroppedChunks, prev.stats.DroppedChunks, msg)
+		require.GreaterOrEqual(t, stats.SkippedChunks, prev.stats.SkippedChunks, msg)
+		require.GreaterOrEqual(t, stats.ExhaustedCnt, prev.stats.ExhaustedCnt, msg)
+	}
+	if op != opResetAll && op != opResetRecoveryCnt {
+		require.GreaterOrEqual(t, stats.RecoveryCnt, prev.stats.RecoveryCnt, msg)
+	}
+
+	// cannotHold transitions.
+	require.Equal(t, h.holder.cannotHold, h.holder.reason != cannotHoldReasonNone, msg)
+	if prev.cannotHold && op != opResetHolder && op != opResetAll && !h.autoResetOnRecovery {
+		// Only reset can make holder hold again, and the first reason is kept.
+		require.True(t, h.holder.cannotHold, msg)
+		require.Equal(t, prev.reason, h.holder.reason, msg)
+	}
+	if h.CanHoldResult() {
+		canHold, reason := h.HoldingStatus()
+		require.True(t, canHold, msg)
+		require.Empty(t, reason, msg)
+	} else {
+		_, reason := h.HoldingStatus()
+		require.NotEmpty(t, reason, msg)
+	}
+}
+
+func TestRecoveryScenarios(t *testing.T) {
+	scenarios := []scenario{
+		{
+			name:      "fill to capacity",
+			holderCap: 20,
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: true, wantCanHold: boolPtr(true)},
+				{op: opHold, rows: 10, wantOK: true, wantCanHold: boolPtr(false)},
+				{op: opHold, rows: 10, wantOK: false},
+				{op: opPop, wantOK: true},
+				{op: opPop, wantOK: true},
+				{op: opPop, wantOK: false},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				require.Equal(t, uint64(1), h.Stats().DroppedChunks)
+			},
+		},
+		{
+			name:      "pop stops holding",
+			holderCap: 100,
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opPop, wantOK: true, wantCanHold: boolPtr(false)},
+				{op: opHold, rows: 10, wantOK: false},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+				{op: opResetHolder, wantCanHold: boolPtr(true)},
+				{op: opHold, rows: 10, wantOK: true},
+			},
+		},
+		{
+			name:      "recovery until exhausted",
+			holderCap: 100,
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+				{op: opRecovery, mppErr: scenarioRecvErr, wantOK: true},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+				{op: opRecovery, mppErr: scenarioMemErr, wantErr: ErrRecoveryExhausted},
+				{op: opRecovery, mppErr: scenarioMemErr, wantErr: ErrRecoveryExhausted},
+				{op: opResetRecoveryCnt},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				stats := h.Stats()
+				require.Equal(t, uint64(2), stats.ExhaustedCnt)
+				require.Equal(t, uint64(4), stats.LifetimeRecoveryCnt)
+				require.Equal(t, uint32(1), stats.RecoveryCnt)
+			},
+		},
+		{
+			name:      "unknown err consumes recovery cnt",
+			holderCap: 100,
+			steps: []scenarioStep{
+				{op: opRecovery, mppErr: scenarioUnknownErr},
+				{op: opRecovery, mppErr: scenarioUnknownErr},
+				{op: opRecovery, mppErr: scenarioUnknownErr},
+				{op: opRecovery, mppErr: scenarioMemErr, wantErr: ErrRecoveryExhausted},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				require.Empty(t, h.Stats().HandlerRecoveryCnt)
+			},
+		},
+		{
+			name:      "recovery disabled",
+			holderCap: 100,
+			disabled:  true,
+			steps: []scenarioStep{
+				{op: opRecovery, mppErr: scenarioMemErr, wantErr: ErrRecoveryDisabled},
+				{op: opRecovery, mppErr: scenarioUnknownErr, wantErr: ErrRecoveryDisabled},
+				{op: opPop, wantOK: false},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				stats := h.Stats()
+				require.Equal(t, uint64(1), stats.WouldHaveRecoveredCnt)
+				require.Zero(t, stats.LifetimeRecoveryCnt)
+			},
+		},
+		{
+			name:      "results streamed",
+			holderCap: 100,
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opMarkStreamed, wantCanHold: boolPtr(false)},
+				{op: opHold, rows: 10, wantOK: false},
+				{op: opRecovery, mppErr: scenarioMemErr, wantErr: ErrResultsAlreadyStreamed},
+				{op: opResetRecoveryCnt, wantCanHold: boolPtr(false)},
+				{op: opResetHolder, wantCanHold: boolPtr(true)},
+				{op: opHold, rows: 10, wantOK: true},
+			},
+		},
+		{
+			name:      "spill and read back",
+			holderCap: 100,
+			setup: func(h *RecoveryHandler, _ *mockClock) {
+				_ = h.SetSpillBackend(newMockSpillBackend(), testFieldTypes, newTestChunk(10).MemoryUsage())
+			},
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opPop, wantOK: true},
+				{op: opPop, wantOK: true},
+				{op: opPop, wantOK: true},
+				{op: opPop, wantOK: false},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				stat := h.SpillStats()
+				require.Equal(t, 2, stat.SpilledFiles)
+				require.Equal(t, stat.SpilledBytes, stat.ReadBytes)
+			},
+		},
+		{
+			name:      "spill failure keeps chunk in memory",
+			holderCap: 100,
+			setup: func(h *RecoveryHandler, _ *mockClock) {
+				backend := newMockSpillBackend()
+				backend.writeErr = errors.New("mock write err")
+				_ = h.SetSpillBackend(backend, testFieldTypes, 1)
+			},
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opResetHolder},
+				{op: opHold, rows: 10, wantOK: true},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				require.Zero(t, h.Stats().SpilledChunks)
+				require.Equal(t, newTestChunk(10).MemoryUsage(), h.NumHoldBytes())
+			},
+		},
+		{
+			name:      "auto reset on recovery",
+			holderCap: 20,
+			setup: func(h *RecoveryHandler, _ *mockClock) {
+				h.SetAutoResetOnRecovery(true)
+			},
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opHold, rows: 10, wantOK: true, wantCanHold: boolPtr(false)},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true, wantCanHold: boolPtr(true)},
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opRecovery, mppErr: scenarioUnknownErr, wantCanHold: boolPtr(true)},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				// Failed recovery doesn't reset holder.
+				require.Equal(t, 1, h.NumHoldChk())
+			},
+		},
+		{
+			name:      "exhaust cooldown",
+			holderCap: 100,
+			setup: func(h *RecoveryHandler, _ *mockClock) {
+				h.SetExhaustCooldown(time.Minute)
+			},
+			steps: []scenarioStep{
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+				{op: opRecovery, mppErr: scenarioMemErr, wantErr: ErrRecoveryExhausted, wantCanHold: boolPtr(false)},
+				{op: opResetRecoveryCnt},
+				{op: opHold, rows: 10, wantOK: false},
+				{op: opAdvanceClock, advance: time.Minute + time.Second, wantCanHold: boolPtr(true)},
+				{op: opHold, rows: 10, wantOK: true},
+			},
+		},
+		{
+			name:      "abnormal memory",
+			holderCap: 100,
+			setup: func(h *RecoveryHandler, _ *mockClock) {
+				h.SetMaxBytesPerRow(newTestChunk(10).MemoryUsage())
+			},
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opHold, chk: chunk.NewChunkWithCapacity(testFieldTypes, 100000), wantOK: false, wantCanHold: boolPtr(false)},
+				{op: opHold, rows: 10, wantOK: false},
+				{op: opResetHolder, wantCanHold: boolPtr(true)},
+				{op: opHold, rows: 10, wantOK: true},
+			},
+		},
+		{
+			name:      "skip small chunks",
+			holderCap: 100,
+			setup: func(h *RecoveryHandler, _ *mockClock) {
+				h.SetMinChunkRowsToHold(5)
+			},
+			steps: []scenarioStep{
+				{op: opHold, rows: 1, wantOK: false, wantCanHold: boolPtr(true)},
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opHold, rows: 4, wantOK: false},
+				{op: opDisableHolding},
+				{op: opHold, rows: 1, wantOK: false},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				stats := h.Stats()
+				require.Equal(t, uint64(2), stats.SkippedChunks)
+				require.Equal(t, uint64(1), stats.DroppedChunks)
+			},
+		},
+		{
+			name:      "disable holding then reset all",
+			holderCap: 100,
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: true},
+				{op: opDisableHolding, wantCanHold: boolPtr(false)},
+				{op: opHold, rows: 10, wantOK: false},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+				{op: opResetAll, wantCanHold: boolPtr(true)},
+				{op: opHold, rows: 10, wantOK: true},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				stats := h.Stats()
+				require.Zero(t, stats.LifetimeRecoveryCnt)
+				require.Zero(t, stats.DroppedChunks)
+			},
+		},
+		{
+			name:      "context done err",
+			holderCap: 100,
+			steps: []scenarioStep{
+				{op: opRecovery, mppErr: context.Canceled, wantErr: ErrNonRecoverable},
+				{op: opRecovery, mppErr: errors.Join(scenarioMemErr, context.DeadlineExceeded), wantErr: ErrNonRecoverable},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+			},
+			check: func(t *testing.T, h *RecoveryHandler) {
+				require.Equal(t, uint32(1), h.RecoveryCnt())
+			},
+		},
+		{
+			name:      "zero capacity",
+			holderCap: 0,
+			steps: []scenarioStep{
+				{op: opHold, rows: 10, wantOK: false, wantCanHold: boolPtr(false)},
+				{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+				{op: opResetHolder, wantCanHold: boolPtr(false)},
+			},
+		},
+		{
+			name:      "many events",
+			holderCap: 100,
+			steps: func() []scenarioStep {
+				steps := make([]scenarioStep, 0, 2*defaultMaxRecoveryEvents)
+				for i := 0; i < defaultMaxRecoveryEvents; i++ {
+					steps = append(steps,
+						scenarioStep{op: opRecovery, mppErr: scenarioMemErr, wantOK: true},
+						scenarioStep{op: opResetRecoveryCnt})
+				}
+				return steps
+			}(),
+			check: func(t *testing.T, h *RecoveryHandler) {
+				require.Len(t, h.Events(), defaultMaxRecoveryEvents)
+				require.Equal(t, uint64(defaultMaxRecoveryEvents), h.LifetimeRecoveryCnt())
+			},
+		},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			runScenario(t, s)
+		})
+	}
+}
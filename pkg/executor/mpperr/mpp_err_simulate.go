@@ -0,0 +1,55 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import (
+	"context"
+
+	"github.com/pingcap/errors"
+)
+
+// ErrSimulationDisabled is returned by SimulateRecovery() if WithRecoverySimulation() is not set.
+var ErrSimulationDisabled = errors.New("recovery simulation is disabled")
+
+// simulatedErrMsgs are the synthetic mpp errs of each category, which are classified by the built-in matchers.
+var simulatedErrMsgs = map[RecoveryErrorCategory]string{
+	CategoryNetwork:            "simulated mpp err: connection refused",
+	CategoryExchangeReceiver:   "simulated mpp err: exchange receiver meets error",
+	CategoryReplicaUnavailable: "simulated mpp err: TiFlash replica is not available",
+	CategoryStaleSnapshot:      "simulated mpp err: read ts is stale",
+	CategoryMemLimit:           "simulated mpp err: Memory limit exceeded",
+}
+
+// WithRecoverySimulation allows SimulateRecovery(), it's for chaos testing in controlled test environments only.
+// Never set it in production.
+func WithRecoverySimulation() RecoveryHandlerOption {
+	return func(m *RecoveryHandler) {
+		m.simulationEnabled = true
+	}
+}
+
+// SimulateRecovery synthesizes a recoverable mpp err of category and runs the full Recovery path, including
+// calling AutoScaler through the topo fetcher, so chaos tests can verify recovery end to end. It consumes recovery
+// count like real mpp errs. It returns ErrSimulationDisabled unless WithRecoverySimulation() is set.
+func (m *RecoveryHandler) SimulateRecovery(category RecoveryErrorCategory) (RecoveryResult, error) {
+	if !m.simulationEnabled {
+		return RecoveryResult{}, ErrSimulationDisabled
+	}
+	msg, ok := simulatedErrMsgs[category]
+	if !ok {
+		return RecoveryResult{}, errors.Errorf("cannot simulate mpp err of category %v", category)
+	}
+	return m.Recovery(context.Background(), &RecoveryInfo{MPPErr: errors.New(msg), NodeCnt: max(m.defaultNodeCnt, 1)})
+}
@@ -0,0 +1,518 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/util/logutil"
+	"go.uber.org/zap"
+)
+
+// defaultMaxRecoveryEvents is the default max number of events kept by RecoveryHandler, see SetEventRetention().
+const defaultMaxRecoveryEvents = 16
+
+const (
+	// eventMemSize is the memory of a RecoveryEvent excluding its strings.
+	eventMemSize = int64(unsafe.Sizeof(RecoveryEvent{}))
+	// counterEntryMemSize is the estimated memory of an entry of counter maps excluding its key string.
+	counterEntryMemSize = 48
+)
+
+// EvictionPolicy decides which event is dropped when the number of events reaches the max.
+type EvictionPolicy int
+
+const (
+	// EvictOldest drops the oldest event, it's the default policy.
+	EvictOldest EvictionPolicy = iota
+	// EvictLeastSevere drops the event whose category is least severe, see SetCategorySeverity().
+	// The oldest one is dropped among events of the same severity, and the new event is dropped if it's less
+	// severe than all kept events.
+	EvictLeastSevere
+)
+
+// RecoveryEvent records one recovery attempt.
+type RecoveryEvent struct {
+	Time     time.Time
+	Attempt  uint32
+	Category RecoveryErrorCategory
+	// Handler is the name of handler that recoveries the mpp err, empty if no handler is chosen.
+	Handler string
+	// StoreAddr is the address of TiFlash store that fails, empty if unknown.
+	StoreAddr string
+	// FragmentID is the ID of plan fragment that fails, 0 if unknown.
+	FragmentID uint64
+	// NodeCnt is the node cnt requested from AutoScaler, 0 if AutoScaler isn't called.
+	NodeCnt int
+	// InnerRetries is the number of retried AutoScaler calls in this recovery, see SetAutoScalerRetry().
+	InnerRetries int
+	// ErrMsg is the error returned by recovery, empty if recovery succeeds.
+	ErrMsg string
+	// Exhausted is true if the recovery is refused because maxRecoveryCnt is reached.
+	Exhausted bool
+	// Labels are set by SetEventLabels(). They are shared by events and must not be modified.
+	Labels map[string]string
+	// CorrelationID is set by SetCorrelationID(), empty if not set.
+	CorrelationID string
+}
+
+// RecoveryStats is a snapshot of the state of RecoveryHandler.
+type RecoveryStats struct {
+	Enabled       bool
+	UseAutoScaler bool
+	// InRecovery is true if Recovery is running, see InRecovery(). Other states changed by Recovery, like RecoveryCnt,
+	// are published when it finishes, so it's safe to observe them from another goroutine while it's running.
+	InRecovery bool
+
+	RecoveryCnt    uint32
+	MaxRecoveryCnt uint32
+	// InnerRetryCnt is the number of AutoScaler calls retried inside recoveries in this statement,
+	// which are not counted by RecoveryCnt.
+	InnerRetryCnt uint64
+	// LifetimeRecoveryCnt is the recovery count across statements.
+	LifetimeRecoveryCnt uint64
+
+	HeldChunks int
+	HeldRows   uint64
+	// OfferedRows is the rows passed to HoldResult() in this statement, including the ones that are not held.
+	OfferedRows uint64
+	// SpilledChunks is the number of held chunks that are spilled to SpillBackend.
+	SpilledChunks int
+	// DroppedChunks is the number of chunks that are not held because holder cannot hold anymore.
+	DroppedChunks uint64
+	// SkippedChunks is the number of chunks that are not held because they have less rows than minChunkRowsToHold,
+	// or holding is not started by the predicate of SetShouldStartHolding(), or estimated result rows are too large.
+	SkippedChunks uint64
+
+	// ExhaustedCnt is the number of recoveries refused because maxRecoveryCnt is reached.
+	ExhaustedCnt uint64
+	// WouldHaveRecoveredCnt is the number of mpp errs that have a handler to recovery them when recovery is disabled,
+	// which helps to justify enabling recovery.
+	WouldHaveRecoveredCnt uint64
+
+	// HandlerRecoveryCnt is the recovery count of each handler.
+	HandlerRecoveryCnt map[string]uint32
+	// StoreRecoveryCnt is the recovery count of each TiFlash store, only recoveries with StoreAddr are counted.
+	StoreRecoveryCnt map[string]uint32
+	// FragmentRecoveryCnt is the recovery count of each plan fragment, only recoveries with FragmentID are counted.
+	FragmentRecoveryCnt map[uint64]uint32
+}
+
+// Stats returns a snapshot of the state of RecoveryHandler. It's safe for concurrent use, like a metrics exporter
+// polling while the executor holds results or recovers. The states owned by the executor, like recovery count and
+// held chunks, are the ones published after the last call of HoldResult(), PopFrontChk(), Recovery() or resets.
+func (m *RecoveryHandler) Stats() RecoveryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.statsLocked()
+}
+
+// DrainStats returns the stats like Stats(), and resets the cumulative counters in the same locked operation,
+// so metrics exporters that poll periodically get the delta since last drain.
+// Other states like held chunks and recovery count are not touched.
+func (m *RecoveryHandler) DrainStats() RecoveryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.statsLocked()
+	m.resetCountersLocked()
+	return stats
+}
+
+// publishStats refreshes the snapshot read by Stats() from the states owned by the executor goroutine,
+// it must be called by the executor goroutine after these states are changed.
+func (m *RecoveryHandler) publishStats() {
+	holderStats := m.resultHolder.Stats()
+	m.published.recoveryCnt.Store(m.curRecoveryCnt)
+	m.published.innerRetryCnt.Store(m.innerRetryCnt)
+	m.published.lifetimeRecoveryCnt.Store(m.lifetimeRecoveryCnt)
+	m.published.heldChunks.Store(int64(holderStats.NumChks))
+	m.published.heldRows.Store(holderStats.NumRows)
+	m.published.offeredRows.Store(m.offeredRows)
+	m.published.spilledChunks.Store(int64(m.holder.numSpilledChks))
+}
+
+func (m *RecoveryHandler) statsLocked() RecoveryStats {
+	handlerRecoveryCnt := make(map[string]uint32, len(m.mu.handlerRecoveryCnt))
+	for name, cnt := range m.mu.handlerRecoveryCnt {
+		handlerRecoveryCnt[name] = cnt
+	}
+	storeRecoveryCnt := make(map[string]uint32, len(m.mu.storeRecoveryCnt))
+	for addr, cnt := range m.mu.storeRecoveryCnt {
+		storeRecoveryCnt[addr] = cnt
+	}
+	fragmentRecoveryCnt := make(map[uint64]uint32, len(m.mu.fragmentRecoveryCnt))
+	for id, cnt := range m.mu.fragmentRecoveryCnt {
+		fragmentRecoveryCnt[id] = cnt
+	}
+	return RecoveryStats{
+		Enabled:               m.enable,
+		UseAutoScaler:         m.useAutoScaler,
+		InRecovery:            m.inRecovery.Load(),
+		RecoveryCnt:           m.published.recoveryCnt.Load(),
+		InnerRetryCnt:         m.published.innerRetryCnt.Load(),
+		MaxRecoveryCnt:        m.maxRecoveryCnt,
+		LifetimeRecoveryCnt:   m.published.lifetimeRecoveryCnt.Load(),
+		HeldChunks:            int(m.published.heldChunks.Load()),
+		HeldRows:              m.published.heldRows.Load(),
+		OfferedRows:           m.published.offeredRows.Load(),
+		SpilledChunks:         int(m.published.spilledChunks.Load()),
+		DroppedChunks:         m.mu.droppedChkCnt,
+		SkippedChunks:         m.mu.skippedChkCnt,
+		ExhaustedCnt:          m.mu.exhaustedCnt,
+		WouldHaveRecoveredCnt: m.mu.wouldHaveRecoveredCnt,
+		HandlerRecoveryCnt:    handlerRecoveryCnt,
+		StoreRecoveryCnt:      storeRecoveryCnt,
+		FragmentRecoveryCnt:   fragmentRecoveryCnt,
+	}
+}
+
+// RecoveryState is the state of RecoveryHandler marshaled by MarshalState().
+type RecoveryState struct {
+	Stats  RecoveryStats     `json:"stats"`
+	Events []RecoveryEvent   `json:"events"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Truncated is true if some events or labels are dropped to stay within maxStateSize.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// MarshalState returns the stats, recent events and labels of RecoveryHandler encoded in JSON,
+// which can be attached to diagnostics like slow log. If the output exceeds maxStateSize, the oldest events
+// and then labels are dropped. Stats are always kept, so the output may still exceed maxStateSize.
+func (m *RecoveryHandler) MarshalState() ([]byte, error) {
+	state := RecoveryState{
+		Stats:  m.Stats(),
+		Events: m.Events(),
+		Labels: m.eventLabels,
+	}
+	for {
+		data, err := json.Marshal(state)
+		if err != nil || m.maxStateSize <= 0 || len(data) <= m.maxStateSize {
+			return data, errors.Trace(err)
+		}
+		switch {
+		case len(state.Events) > 0:
+			state.Events = state.Events[1:]
+		case len(state.Labels) > 0:
+			state.Labels = nil
+		default:
+			return data, nil
+		}
+		state.Truncated = true
+	}
+}
+
+// SetObservabilityEnabled sets whether events, cumulative counters of Stats() and decision sink are enabled,
+// which is true by default. Latency-sensitive deployments can disable them to make these code paths no-ops.
+// Stats() still reports the state like recovery count and held chunks.
+func (m *RecoveryHandler) SetObservabilityEnabled(enabled bool) {
+	m.observabilityDisabled = !enabled
+}
+
+// recoveryDecision is written to decisionSink as a JSON line for each Recovery call.
+type recoveryDecision struct {
+	Attempt  uint32 `json:"attempt"`
+	Category string `json:"category"`
+	// Handler is empty if no handler is chosen.
+	Handler string `json:"handler,omitempty"`
+	// Outcome is one of decisionRecovered, decisionFailed and decisionRefused.
+	Outcome  string `json:"outcome"`
+	ErrMsg   string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	NodeCnt  int    `json:"node_cnt"`
+	// CorrelationID is empty if not set.
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+const (
+	decisionRecovered = "recovered"
+	// decisionFailed means the handler is called but fails.
+	decisionFailed = "failed"
+	// decisionRefused means the handler is not called, like exceeding maxRecoveryCnt or err is not recoverable.
+	decisionRefused = "refused"
+)
+
+// SetDecisionSink sets the writer that each Recovery call writes one JSON line of the decision to, like stderr,
+// which helps lightweight debugging without metrics. Writes are best-effort, errors are ignored.
+// It's not synchronized, so the caller should synchronize w if it's shared by multiple RecoveryHandlers.
+// nil means no sink, which is the default.
+func (m *RecoveryHandler) SetDecisionSink(w io.Writer) {
+	m.decisionSink = w
+}
+
+func (m *RecoveryHandler) writeDecision(start time.Time, h handlerImpl, res RecoveryResult, err error) {
+	decision := recoveryDecision{
+		Attempt:       m.curRecoveryCnt,
+		Category:      m.lastClassification.category.String(),
+		Outcome:       decisionRecovered,
+		Duration:      m.nowFunc().Sub(start).String(),
+		NodeCnt:       res.RequestedNodeCnt,
+		CorrelationID: m.correlationID,
+	}
+	if h != nil {
+		decision.Handler = h.name()
+	}
+	if err != nil {
+		decision.ErrMsg = err.Error()
+		decision.Outcome = decisionRefused
+		if m.lastClassification.attempted {
+			decision.Outcome = decisionFailed
+		}
+	}
+	data, marshalErr := json.Marshal(decision)
+	if marshalErr != nil {
+		return
+	}
+	// Ignore error, the sink is for debugging only.
+	_, _ = m.decisionSink.Write(append(data, '\n'))
+}
+
+// SetMaxStateSize sets the max bytes of MarshalState() output to avoid bloating trace payloads, 0 means no limit.
+func (m *RecoveryHandler) SetMaxStateSize(maxSize int) {
+	m.maxStateSize = maxSize
+}
+
+// SetCorrelationID sets the ID to correlate recoveries with distributed traces, like the request ID. It's attached to
+// events, logs and decision sink output, and is passed to AutoScaler if the fetcher implements CorrelatedTopoFetcher.
+// Empty means no correlation ID, which is the default.
+func (m *RecoveryHandler) SetCorrelationID(id string) {
+	m.correlationID = id
+	m.autoScaler.correlationID = id
+}
+
+// SetEventLabels sets the labels attached to recorded events and marshaled state, like connection ID and user.
+// labels are copied, so the caller can modify it after set. Events recorded before are not touched.
+func (m *RecoveryHandler) SetEventLabels(labels map[string]string) {
+	if len(labels) == 0 {
+		m.eventLabels = nil
+		return
+	}
+	m.eventLabels = maps.Clone(labels)
+}
+
+// Events returns the recent recovery events, the oldest one comes first.
+func (m *RecoveryHandler) Events() []RecoveryEvent {
+	events := make([]RecoveryEvent, len(m.events))
+	copy(events, m.events)
+	return events
+}
+
+func (m *RecoveryHandler) recordEvent(event RecoveryEvent, err error) {
+	if m.observabilityDisabled {
+		return
+	}
+	if err != nil {
+		event.ErrMsg = err.Error()
+	}
+	event.Labels = m.eventLabels
+	event.CorrelationID = m.correlationID
+	if len(m.events) >= m.maxEvents {
+		i := m.eventToEvict()
+		if m.evictionPolicy == EvictLeastSevere && m.categorySeverity[event.Category] < m.categorySeverity[m.events[i].Category] {
+			return
+		}
+		m.events = append(m.events[:i], m.events[i+1:]...)
+	}
+	m.events = append(m.events, event)
+	m.trackEventsMem()
+	m.mu.Lock()
+	m.trackCountersMemLocked()
+	m.mu.Unlock()
+}
+
+// trackEventsMem consumes the memory change of events from obsMemTracker. Labels and correlation ID are shared,
+// so not counted.
+func (m *RecoveryHandler) trackEventsMem() {
+	var memUsage int64
+	for i := range m.events {
+		event := &m.events[i]
+		memUsage += eventMemSize + int64(len(event.Handler)+len(event.StoreAddr)+len(event.ErrMsg))
+	}
+	m.obsMemTracker.Consume(memUsage - m.eventsMemUsage)
+	m.eventsMemUsage = memUsage
+}
+
+// trackCountersMemLocked consumes the memory change of counter maps from obsMemTracker.
+func (m *RecoveryHandler) trackCountersMemLocked() {
+	entries := len(m.mu.handlerRecoveryCnt) + len(m.mu.storeRecoveryCnt) + len(m.mu.fragmentRecoveryCnt)
+	memUsage := int64(entries) * counterEntryMemSize
+	for name := range m.mu.handlerRecoveryCnt {
+		memUsage += int64(len(name))
+	}
+	for addr := range m.mu.storeRecoveryCnt {
+		memUsage += int64(len(addr))
+	}
+	m.obsMemTracker.Consume(memUsage - m.mu.countersMemUsage)
+	m.mu.countersMemUsage = memUsage
+}
+
+// SetEventRetention sets the max number of kept events and how events are dropped once the max is reached.
+// maxEvents <= 0 means defaultMaxRecoveryEvents. Kept events beyond the new max are dropped by policy.
+func (m *RecoveryHandler) SetEventRetention(maxEvents int, policy EvictionPolicy) {
+	if maxEvents <= 0 {
+		maxEvents = defaultMaxRecoveryEvents
+	}
+	m.maxEvents = maxEvents
+	m.evictionPolicy = policy
+	for len(m.events) > m.maxEvents {
+		i := m.eventToEvict()
+		m.events = append(m.events[:i], m.events[i+1:]...)
+	}
+	m.trackEventsMem()
+}
+
+// eventToEvict returns the index of kept event that should be dropped by evictionPolicy.
+func (m *RecoveryHandler) eventToEvict() int {
+	if m.evictionPolicy != EvictLeastSevere {
+		return 0
+	}
+	evict := 0
+	for i := 1; i < len(m.events); i++ {
+		if m.categorySeverity[m.events[i].Category] < m.categorySeverity[m.events[evict].Category] {
+			evict = i
+		}
+	}
+	return evict
+}
+
+// RecoveryMetricsAggregator accumulates the activity of handlers that share it, like the handlers cloned from the
+// same template by CloneForNewStmt(), so operators get cumulative counters across statements. It's safe for
+// concurrent use, and is not reset by ResetAll() or DrainStats() of handlers.
+type RecoveryMetricsAggregator struct {
+	recoveryCnt           atomic.Uint64
+	exhaustedCnt          atomic.Uint64
+	wouldHaveRecoveredCnt atomic.Uint64
+	droppedChkCnt         atomic.Uint64
+	skippedChkCnt         atomic.Uint64
+}
+
+// AggregatedRecoveryStats is a snapshot of RecoveryMetricsAggregator, fields have the same meaning as the ones
+// of RecoveryStats, but are summed over all handlers.
+type AggregatedRecoveryStats struct {
+	RecoveryCnt           uint64
+	ExhaustedCnt          uint64
+	WouldHaveRecoveredCnt uint64
+	DroppedChunks         uint64
+	SkippedChunks         uint64
+}
+
+// NewRecoveryMetricsAggregator creates a RecoveryMetricsAggregator.
+func NewRecoveryMetricsAggregator() *RecoveryMetricsAggregator {
+	return &RecoveryMetricsAggregator{}
+}
+
+// Stats returns a snapshot of the aggregated counters.
+func (a *RecoveryMetricsAggregator) Stats() AggregatedRecoveryStats {
+	return AggregatedRecoveryStats{
+		RecoveryCnt:           a.recoveryCnt.Load(),
+		ExhaustedCnt:          a.exhaustedCnt.Load(),
+		WouldHaveRecoveredCnt: a.wouldHaveRecoveredCnt.Load(),
+		DroppedChunks:         a.droppedChkCnt.Load(),
+		SkippedChunks:         a.skippedChkCnt.Load(),
+	}
+}
+
+// SetMetricsAggregator sets the aggregator that the activity of handler contributes to, it's inherited by the
+// handlers cloned by CloneForNewStmt(). nil means no aggregation, which is the default.
+// Stats() of the handler is not affected.
+func (m *RecoveryHandler) SetMetricsAggregator(agg *RecoveryMetricsAggregator) {
+	m.aggregator = agg
+}
+
+// onRecoveryExhausted records the recovery refused because maxRecoveryCnt is reached or the shared budget is used up.
+func (m *RecoveryHandler) onRecoveryExhausted(info *RecoveryInfo, err error) {
+	m.exhaustedTime = m.nowFunc()
+	m.stmtExhausted = true
+	m.trackRecoveryOutcome(m.lastClassification.category, false)
+	if m.observabilityDisabled {
+		return
+	}
+	m.mu.Lock()
+	m.mu.exhaustedCnt++
+	m.mu.Unlock()
+	if m.aggregator != nil {
+		m.aggregator.exhaustedCnt.Add(1)
+	}
+	category := classifyErr(info.MPPErr, m.categorySeverity)[0].category
+	logutil.BgLogger().Warn("mpp err recovery exhausted", zap.Uint32("maxRecoveryCnt", m.maxRecoveryCnt),
+		zap.Stringer("category", category), zap.String("correlationID", m.correlationID), zap.Error(info.MPPErr))
+	m.recordEvent(RecoveryEvent{
+		Time:      m.nowFunc(),
+		Attempt:   m.curRecoveryCnt,
+		Category:  category,
+		Exhausted: true,
+	}, err)
+}
+
+// onRecoveryDisabled counts the mpp err that would have been recovered if recovery is enabled.
+func (m *RecoveryHandler) onRecoveryDisabled(info *RecoveryInfo) {
+	if m.observabilityDisabled || info == nil || info.MPPErr == nil {
+		return
+	}
+	if h, _, fatal := m.chooseHandler(info.MPPErr); h != nil && !fatal {
+		m.mu.Lock()
+		m.mu.wouldHaveRecoveredCnt++
+		m.mu.Unlock()
+		if m.aggregator != nil {
+			m.aggregator.wouldHaveRecoveredCnt.Add(1)
+		}
+	}
+}
+
+func (m *RecoveryHandler) incDroppedChkCnt() {
+	if m.observabilityDisabled {
+		return
+	}
+	m.mu.Lock()
+	m.mu.droppedChkCnt++
+	m.mu.Unlock()
+	if m.aggregator != nil {
+		m.aggregator.droppedChkCnt.Add(1)
+	}
+}
+
+func (m *RecoveryHandler) incSkippedChkCnt() {
+	if m.observabilityDisabled {
+		return
+	}
+	m.mu.Lock()
+	m.mu.skippedChkCnt++
+	m.mu.Unlock()
+	if m.aggregator != nil {
+		m.aggregator.skippedChkCnt.Add(1)
+	}
+}
+
+func (m *RecoveryHandler) resetCounters() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resetCountersLocked()
+}
+
+func (m *RecoveryHandler) resetCountersLocked() {
+	m.mu.exhaustedCnt = 0
+	m.mu.wouldHaveRecoveredCnt = 0
+	m.mu.droppedChkCnt = 0
+	m.mu.skippedChkCnt = 0
+	m.mu.handlerRecoveryCnt = make(map[string]uint32)
+	m.mu.storeRecoveryCnt = make(map[string]uint32)
+	m.mu.fragmentRecoveryCnt = make(map[uint64]uint32)
+	m.trackCountersMemLocked()
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import "sync"
+
+// MaintenancePool runs background maintenance tasks of holders, like spilling held chunks, so the hot path of
+// HoldResult isn't blocked. The number of goroutines is bounded by size of pool, which can be shared by all holders.
+// The owner must call Close() to stop the goroutines.
+type MaintenancePool struct {
+	tasks chan func()
+	wg    sync.WaitGroup
+	mu    struct {
+		sync.RWMutex
+		closed bool
+	}
+}
+
+// NewMaintenancePool creates a MaintenancePool with size goroutines, size is at least 1.
+func NewMaintenancePool(size int) *MaintenancePool {
+	size = max(size, 1)
+	p := &MaintenancePool{tasks: make(chan func())}
+	p.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *MaintenancePool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		task()
+	}
+}
+
+// trySubmit runs task in background if there is an idle goroutine, it returns false if all goroutines are busy or
+// pool is closed, then the caller should run task by itself.
+func (p *MaintenancePool) trySubmit(task func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.mu.closed {
+		return false
+	}
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the goroutines after the submitted tasks complete, it's safe to call more than once.
+func (p *MaintenancePool) Close() {
+	p.mu.Lock()
+	if p.mu.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.mu.closed = true
+	close(p.tasks)
+	p.mu.Unlock()
+	p.wg.Wait()
+}
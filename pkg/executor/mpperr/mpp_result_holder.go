@@ -0,0 +1,764 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpperr
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util"
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/intest"
+	"github.com/pingcap/tidb/pkg/util/logutil"
+	"github.com/pingcap/tidb/pkg/util/memory"
+	"github.com/pingcap/tidb/pkg/util/sqlkiller"
+	"go.uber.org/zap"
+)
+
+// SpillBackend stores spilled chunks of holder, like local disk or remote storage.
+type SpillBackend interface {
+	// Write stores the serialized chunk with seq.
+	Write(seq uint64, data []byte) error
+	// Read returns the serialized chunk of seq.
+	Read(seq uint64) ([]byte, error)
+	// Delete removes the serialized chunk of seq.
+	Delete(seq uint64) error
+}
+
+type holderSpill struct {
+	backend SpillBackend
+	codec   *chunk.Codec
+	// Chunks are spilled when memory usage of holder exceeds threshold.
+	threshold int64
+	nextSeq   uint64
+	stat      SpillStat
+}
+
+// SpillStat is the statistics of spill activity of holder.
+type SpillStat struct {
+	// SpilledFiles is the number of chunks written to SpillBackend.
+	SpilledFiles int
+	// SpilledBytes is the number of bytes written to SpillBackend.
+	SpilledBytes int64
+	// ReadBytes is the number of bytes read back from SpillBackend.
+	ReadBytes int64
+}
+
+// ResultHolder holds mpp results before they're returned to client, so they can be discarded and re-computed
+// when mpp err is recovered. The default implementation holds chunks in memory and spills them optionally.
+// It's not required to be safe for concurrent use.
+type ResultHolder interface {
+	// Insert holds chk inserted at now, returns false and does nothing if it cannot hold anymore.
+	Insert(chk *chunk.Chunk, now time.Time) bool
+	// CanHold returns whether more chunks can be held.
+	CanHold() bool
+	// StopHolding makes CanHold return false until Reset is called.
+	StopHolding()
+	// PopFront consumes the first held chunk in insert order, and it cannot hold anymore.
+	PopFront() (*chunk.Chunk, error)
+	// Reset clears all held chunks, so it can hold again.
+	Reset() error
+	// Stats returns the statistics of held chunks.
+	Stats() ResultHolderStats
+}
+
+// ResultHolderStats is the statistics of held chunks of ResultHolder.
+type ResultHolderStats struct {
+	NumChks int
+	// NumRows is the number of rows held since reset, including popped chunks.
+	NumRows uint64
+	// MemUsage is the memory usage of held chunks.
+	MemUsage int64
+	// Capacity is the max number of rows to hold.
+	Capacity uint64
+}
+
+// cannotHoldReason tells why holder cannot hold anymore.
+type cannotHoldReason int
+
+const (
+	cannotHoldReasonNone cannotHoldReason = iota
+	cannotHoldReasonZeroCapacity
+	cannotHoldReasonCapacityReached
+	cannotHoldReasonChunkPopped
+	cannotHoldReasonDisabled
+	cannotHoldReasonResultsStreamed
+	cannotHoldReasonExhaustCooldown
+	cannotHoldReasonAbnormalMemory
+	cannotHoldReasonHoldAgeExceeded
+	cannotHoldReasonCustomHolder
+	cannotHoldReasonNotStarted
+	// cannotHoldReasonKilled is fatal, it's kept after reset until the kill signal is cleared.
+	cannotHoldReasonKilled
+	cannotHoldReasonEstimateTooLarge
+	cannotHoldReasonTooFewRows
+)
+
+// String implements fmt.Stringer interface.
+func (r cannotHoldReason) String() string {
+	switch r {
+	case cannotHoldReasonZeroCapacity:
+		return "zero capacity"
+	case cannotHoldReasonCapacityReached:
+		return "capacity reached"
+	case cannotHoldReasonChunkPopped:
+		return "chunk popped"
+	case cannotHoldReasonDisabled:
+		return "disabled"
+	case cannotHoldReasonResultsStreamed:
+		return "results streamed"
+	case cannotHoldReasonExhaustCooldown:
+		return "cooldown after recovery exhausted"
+	case cannotHoldReasonAbnormalMemory:
+		return "abnormal memory usage"
+	case cannotHoldReasonHoldAgeExceeded:
+		return "max hold age exceeded"
+	case cannotHoldReasonCustomHolder:
+		return "custom holder cannot hold"
+	case cannotHoldReasonNotStarted:
+		return "holding not started"
+	case cannotHoldReasonKilled:
+		return "session killed"
+	case cannotHoldReasonEstimateTooLarge:
+		return "estimated rows too large"
+	case cannotHoldReasonTooFewRows:
+		return "chunk rows below min"
+	default:
+		return ""
+	}
+}
+
+type heldChunk struct {
+	// chk is nil if it's spilled.
+	chk *chunk.Chunk
+	// pending is not nil if chk is being spilled in background, chk is still held in memory until it's applied.
+	pending    *pendingSpill
+	spillSeq   uint64
+	numRows    int
+	memUsage   int64
+	insertTime time.Time
+}
+
+// pendingSpill is the outcome of a background spill, which is set before done is closed.
+type pendingSpill struct {
+	done chan struct{}
+	size int
+	err  error
+}
+
+// HeldSchemaInfo is the schema of held chunks, established by the first held chunk.
+type HeldSchemaInfo struct {
+	// Established is false if no chunk is held.
+	Established bool
+	NumCols     int
+}
+
+type mppResultHolder struct {
+	capacity uint64
+	// True when holder is full or begin to return result.
+	cannotHold bool
+	// reason is set when cannotHold is set.
+	reason  cannotHoldReason
+	curRows uint64
+	// poppedRows is the rows of popped chunks, which are still counted by curRows.
+	poppedRows uint64
+	// chks are held chunks in insert order, some of them may be spilled.
+	chks           []heldChunk
+	numSpilledChks int
+	memTracker     *memory.Tracker
+	// spill is nil if spill is not enabled.
+	spill *holderSpill
+	// pool runs spills in background if it's not nil.
+	pool *MaintenancePool
+	// numPendingSpills is the number of held chunks being spilled in background.
+	numPendingSpills int
+	// checkAccounting is true if memory accounting is checked when reset.
+	checkAccounting bool
+	// checkDuplicate is true if insert checks whether the chunk is already held.
+	checkDuplicate bool
+
+	// maxBytesPerRow is the sane max of accounted bytes per held row, 0 means no check.
+	maxBytesPerRow int64
+	// schema is established by the first held chunk, it's zero value if no chunk is held since reset.
+	schema HeldSchemaInfo
+
+	parent *memory.Tracker
+	// adaptive is true if capacity is recomputed on each insert from memory headroom of parent.
+	adaptive bool
+	// maxCapacity is the configured capacity, which is the upper bound of adaptive capacity.
+	maxCapacity uint64
+	// streaming is true in streaming window mode after results begin streaming. Capacity doesn't stop holding and
+	// popping chunks keeps holding, because held rows are bounded by the streaming window of handler.
+	streaming bool
+	// killer is checked on insert, held chunks are dropped once the session is killed. nil means no check.
+	killer *sqlkiller.SQLKiller
+	// sizer returns the accounted bytes of a chunk, chk.MemoryUsage() is used if it's nil.
+	sizer func(chk *chunk.Chunk) int64
+}
+
+func newMPPResultHolder(holderCap uint64, parent *memory.Tracker) *mppResultHolder {
+	return &mppResultHolder{
+		capacity:    holderCap,
+		maxCapacity: holderCap,
+		chks:        []heldChunk{},
+		memTracker:  memory.NewTracker(parent.Label(), 0),
+		// Only check in test to avoid overhead.
+		checkAccounting: intest.InTest,
+		checkDuplicate:  intest.InTest,
+		parent:          parent,
+	}
+}
+
+// memHeadroom returns the memory that can be used by holder before parent exceeds its limit.
+func (h *mppResultHolder) memHeadroom() int64 {
+	limit := h.parent.GetBytesLimit()
+	if limit <= 0 {
+		return math.MaxInt64
+	}
+	return limit - h.parent.BytesConsumed() - h.memTracker.BytesConsumed()
+}
+
+// adaptCapacity recomputes capacity from memory headroom, estimated by memory usage per row of chk.
+func (h *mppResultHolder) adaptCapacity(chk *chunk.Chunk) {
+	h.capacity = h.adaptedCapacity(chk)
+}
+
+// adaptedCapacity returns the capacity that adaptCapacity would set, without modifying holder.
+func (h *mppResultHolder) adaptedCapacity(chk *chunk.Chunk) uint64 {
+	if !h.adaptive || chk.NumRows() == 0 {
+		return h.capacity
+	}
+	bytesPerRow := max(h.chkSize(chk)/int64(chk.NumRows()), 1)
+	headroomRows := uint64(max(h.memHeadroom()/bytesPerRow, 0))
+	if headroomRows >= h.maxCapacity-min(h.curRows, h.maxCapacity) {
+		return h.maxCapacity
+	}
+	return h.curRows + headroomRows
+}
+
+// wouldExceedCapacity returns true if Insert(chk) would refuse chk, or holder would stop holding after chk is
+// held because of capacity, without modifying holder.
+func (h *mppResultHolder) wouldExceedCapacity(chk *chunk.Chunk) bool {
+	if !h.CanHold() {
+		return true
+	}
+	if abnormal, _, _ := h.checkMemAbnormal(chk); abnormal {
+		return true
+	}
+	return !h.streaming && h.curRows+uint64(chk.NumRows()) >= h.adaptedCapacity(chk)
+}
+
+// CanHold implements ResultHolder interface.
+func (h *mppResultHolder) CanHold() bool {
+	return h.capacity > 0 && !h.cannotHold
+}
+
+// status returns cannotHoldReasonNone if holder can hold.
+func (h *mppResultHolder) status() cannotHoldReason {
+	if h.cannotHold {
+		return h.reason
+	}
+	if h.capacity == 0 {
+		return cannotHoldReasonZeroCapacity
+	}
+	return cannotHoldReasonNone
+}
+
+func (h *mppResultHolder) stopHolding(reason cannotHoldReason) {
+	if h.cannotHold {
+		// Keep the first reason.
+		return
+	}
+	h.cannotHold = true
+	h.reason = reason
+}
+
+// StopHolding implements ResultHolder interface.
+func (h *mppResultHolder) StopHolding() {
+	h.stopHolding(cannotHoldReasonDisabled)
+}
+
+// Stats implements ResultHolder interface.
+func (h *mppResultHolder) Stats() ResultHolderStats {
+	return ResultHolderStats{
+		NumChks:  h.numChks(),
+		NumRows:  h.curRows,
+		MemUsage: h.memTracker.BytesConsumed(),
+		Capacity: h.capacity,
+	}
+}
+
+func (h *mppResultHolder) numChks() int {
+	return len(h.chks)
+}
+
+// chkSize returns the accounted bytes of chk. The accounted bytes are kept in heldChunk, so the same bytes are
+// released when it's popped or dropped, even if sizer is changed in between.
+func (h *mppResultHolder) chkSize(chk *chunk.Chunk) int64 {
+	if h.sizer != nil {
+		return h.sizer(chk)
+	}
+	return chk.MemoryUsage()
+}
+
+// isKilled returns true if the kill signal of session is set.
+func (h *mppResultHolder) isKilled() bool {
+	return h.killer != nil && atomic.LoadUint32(&h.killer.Signal) != 0
+}
+
+// dropOnKilled drops all held chunks and stops holding, because buffering for a killed session is useless.
+func (h *mppResultHolder) dropOnKilled() {
+	if h.reason == cannotHoldReasonKilled {
+		return
+	}
+	logutil.BgLogger().Warn("session is killed, drop held chunks of mpp result holder",
+		zap.Uint64("heldRows", h.curRows), zap.Int64("heldBytes", h.memTracker.BytesConsumed()))
+	h.releaseChks()
+	h.curRows = 0
+	h.poppedRows = 0
+	// It overrides other reasons, because it's fatal.
+	h.cannotHold = true
+	h.reason = cannotHoldReasonKilled
+}
+
+// Insert implements ResultHolder interface.
+func (h *mppResultHolder) Insert(chk *chunk.Chunk, now time.Time) bool {
+	if h.isKilled() {
+		h.dropOnKilled()
+		return false
+	}
+	if !h.CanHold() {
+		return false
+	}
+	h.adaptCapacity(chk)
+	if h.isMemAbnormal(chk) {
+		return false
+	}
+	if !h.schema.Established {
+		h.schema = HeldSchemaInfo{Established: true, NumCols: chk.NumCols()}
+	}
+	h.applyDoneSpills()
+	held := heldChunk{chk: chk, numRows: chk.NumRows(), insertTime: now}
+	memUsage := h.chkSize(chk)
+	if h.spill != nil && h.memTracker.BytesConsumed()+memUsage > h.spill.threshold && h.trySpillAsync(&held) {
+		// Memory is released when the spill is applied.
+		held.memUsage = memUsage
+		h.memTracker.Consume(memUsage)
+		h.numPendingSpills++
+	} else if h.spill != nil && h.memTracker.BytesConsumed()+memUsage > h.spill.threshold && h.trySpill(&held) {
+		h.numSpilledChks++
+	} else {
+		held.memUsage = memUsage
+		h.memTracker.Consume(memUsage)
+	}
+	h.chks = append(h.chks, held)
+	h.curRows += uint64(held.numRows)
+
+	if !h.streaming && h.curRows >= h.capacity {
+		h.stopHolding(cannotHoldReasonCapacityReached)
+	}
+	return true
+}
+
+// startStreaming keeps holding after results begin streaming, see streaming.
+func (h *mppResultHolder) startStreaming() {
+	h.streaming = true
+	if h.reason == cannotHoldReasonCapacityReached || h.reason == cannotHoldReasonChunkPopped {
+		h.cannotHold = false
+		h.reason = cannotHoldReasonNone
+	}
+}
+
+// heldRows returns the rows of held chunks, excluding the popped ones.
+func (h *mppResultHolder) heldRows() uint64 {
+	return h.curRows - h.poppedRows
+}
+
+// isMemAbnormal returns true and stops holding if accounted bytes per row exceeds maxBytesPerRow after chk is held,
+// which is a sign of accounting bug or chunk with huge hidden allocations. Holding it risks OOM.
+func (h *mppResultHolder) isMemAbnormal(chk *chunk.Chunk) bool {
+	abnormal, totalBytes, totalRows := h.checkMemAbnormal(chk)
+	if !abnormal {
+		return false
+	}
+	logutil.BgLogger().Warn("abnormal memory usage of mpp result holder, stop holding",
+		zap.Int64("bytes", totalBytes), zap.Int64("rows", totalRows), zap.Int64("maxBytesPerRow", h.maxBytesPerRow))
+	h.stopHolding(cannotHoldReasonAbnormalMemory)
+	return true
+}
+
+// checkMemAbnormal returns whether accounted bytes per row would exceed maxBytesPerRow after chk is held.
+func (h *mppResultHolder) checkMemAbnormal(chk *chunk.Chunk) (abnormal bool, totalBytes, totalRows int64) {
+	if h.maxBytesPerRow <= 0 {
+		return false, 0, 0
+	}
+	totalRows = int64(h.curRows) + int64(chk.NumRows())
+	totalBytes = h.memTracker.BytesConsumed() + h.chkSize(chk)
+	return totalRows <= 0 || totalBytes/totalRows > h.maxBytesPerRow, totalBytes, totalRows
+}
+
+// isHeld returns true if chk is held in memory. Spilled chunks cannot be detected.
+func (h *mppResultHolder) isHeld(chk *chunk.Chunk) bool {
+	for i := range h.chks {
+		if h.chks[i].chk == chk {
+			return true
+		}
+	}
+	return false
+}
+
+// selfCheck returns error if the states of holder are inconsistent.
+func (h *mppResultHolder) selfCheck() error {
+	var heldRows uint64
+	var spilledChks int
+	for _, held := range h.chks {
+		heldRows += uint64(held.numRows)
+		if held.chk == nil {
+			spilledChks++
+		}
+	}
+	if heldRows+h.poppedRows != h.curRows {
+		return errors.Errorf("held rows mismatch, curRows: %v, rows of held chunks: %v, popped rows: %v",
+			h.curRows, heldRows, h.poppedRows)
+	}
+	if spilledChks != h.numSpilledChks {
+		return errors.Errorf("spilled chunks mismatch, numSpilledChks: %v, spilled held chunks: %v", h.numSpilledChks, spilledChks)
+	}
+	if tracked, accounted := h.memTracker.BytesConsumed(), h.heldMemUsage(); tracked != accounted {
+		return errors.Errorf("memory accounting mismatch, tracked bytes: %v, accounted bytes: %v", tracked, accounted)
+	}
+	if h.cannotHold != (h.reason != cannotHoldReasonNone) {
+		return errors.Errorf("cannotHold mismatches reason, cannotHold: %v, reason: %q", h.cannotHold, h.reason)
+	}
+	if !h.cannotHold && !h.streaming && h.capacity > 0 && h.curRows >= h.capacity {
+		return errors.Errorf("holder can hold after capacity reached, curRows: %v, capacity: %v", h.curRows, h.capacity)
+	}
+	if len(h.chks) > 0 && !h.schema.Established {
+		return errors.Errorf("schema is not established with %v held chunks", len(h.chks))
+	}
+	return nil
+}
+
+// chkLenSize is the size of length prefix of each serialized chunk.
+const chkLenSize = 8
+
+// writeChks serializes held chunks to w, each chunk is encoded by codec with a length prefix.
+func (h *mppResultHolder) writeChks(w io.Writer, codec *chunk.Codec) (written int64, err error) {
+	var lenBuf [chkLenSize]byte
+	err = h.forEachChk(func(chk *chunk.Chunk) error {
+		data := codec.Encode(chk)
+		binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(data)))
+		n, err := w.Write(lenBuf[:])
+		written += int64(n)
+		if err != nil {
+			return err
+		}
+		n, err = w.Write(data)
+		written += int64(n)
+		return err
+	})
+	return written, err
+}
+
+// maxSerializedChkSize is the max size of a chunk serialized by writeChks, a larger length prefix means the data
+// is corrupted.
+const maxSerializedChkSize = 1 << 30
+
+// readChk reads a chunk of fieldTypes serialized by writeChks from r, it returns io.EOF if r has no more chunk.
+func readChk(r io.Reader, codec *chunk.Codec, fieldTypes []*types.FieldType) (chk *chunk.Chunk, err error) {
+	var lenBuf [chkLenSize]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.Trace(err)
+	}
+	size := binary.LittleEndian.Uint64(lenBuf[:])
+	if size > maxSerializedChkSize {
+		return nil, errors.Errorf("size of serialized chunk %v exceeds max %v, data is corrupted", size, maxSerializedChkSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer func() {
+		// Codec panics if data is truncated.
+		if recovered := recover(); recovered != nil {
+			chk, err = nil, errors.Annotate(util.GetRecoverError(recovered), "decode serialized chunk, data is corrupted")
+		}
+	}()
+	chk = chunk.NewChunkWithCapacity(fieldTypes, 0)
+	if remained := codec.DecodeToChunk(data, chk); len(remained) != 0 {
+		return nil, errors.Errorf("%v bytes remain after decoding serialized chunk, data is corrupted", len(remained))
+	}
+	return chk, nil
+}
+
+// trySpill writes the chunk to spill backend. The chunk is kept in memory if failed.
+func (h *mppResultHolder) trySpill(held *heldChunk) bool {
+	seq := h.spill.nextSeq
+	data := h.spill.codec.Encode(held.chk)
+	if err := h.spill.backend.Write(seq, data); err != nil {
+		return false
+	}
+	h.spill.nextSeq++
+	h.spill.stat.SpilledFiles++
+	h.spill.stat.SpilledBytes += int64(len(data))
+	held.chk = nil
+	held.spillSeq = seq
+	return true
+}
+
+// trySpillAsync submits the spill of held to pool, it returns false if pool is not set or busy.
+func (h *mppResultHolder) trySpillAsync(held *heldChunk) bool {
+	if h.pool == nil {
+		return false
+	}
+	seq, chk := h.spill.nextSeq, held.chk
+	codec, backend := h.spill.codec, h.spill.backend
+	pending := &pendingSpill{done: make(chan struct{})}
+	if !h.pool.trySubmit(func() {
+		defer close(pending.done)
+		data := codec.Encode(chk)
+		pending.size, pending.err = len(data), backend.Write(seq, data)
+	}) {
+		return false
+	}
+	h.spill.nextSeq++
+	held.spillSeq = seq
+	held.pending = pending
+	return true
+}
+
+// waitSpill waits for the background spill of held and applies it.
+func (h *mppResultHolder) waitSpill(held *heldChunk) {
+	if held.pending == nil {
+		return
+	}
+	<-held.pending.done
+	h.applySpill(held)
+}
+
+// waitSpills waits for all background spills and applies them.
+func (h *mppResultHolder) waitSpills() {
+	for i := 0; h.numPendingSpills > 0 && i < len(h.chks); i++ {
+		h.waitSpill(&h.chks[i])
+	}
+}
+
+// applyDoneSpills applies the finished background spills without waiting.
+func (h *mppResultHolder) applyDoneSpills() {
+	if h.numPendingSpills == 0 {
+		return
+	}
+	for i := range h.chks {
+		if pending := h.chks[i].pending; pending != nil {
+			select {
+			case <-pending.done:
+				h.applySpill(&h.chks[i])
+			default:
+			}
+		}
+	}
+}
+
+// applySpill releases the memory of held if its background spill succeeds, otherwise it's kept in memory.
+func (h *mppResultHolder) applySpill(held *heldChunk) {
+	pending := held.pending
+	held.pending = nil
+	h.numPendingSpills--
+	if pending.err != nil {
+		return
+	}
+	h.spill.stat.SpilledFiles++
+	h.spill.stat.SpilledBytes += int64(pending.size)
+	held.chk = nil
+	h.memTracker.Consume(-held.memUsage)
+	held.memUsage = 0
+	h.numSpilledChks++
+}
+
+// getChk returns the chunk, reads it from spill backend if it's spilled.
+func (h *mppResultHolder) getChk(held *heldChunk) (*chunk.Chunk, error) {
+	h.waitSpill(held)
+	if held.chk != nil {
+		return held.chk, nil
+	}
+	data, err := h.spill.backend.Read(held.spillSeq)
+	if err != nil {
+		return nil, err
+	}
+	h.spill.stat.ReadBytes += int64(len(data))
+	chk, _ := h.spill.codec.Decode(data)
+	return chk, nil
+}
+
+// PopFront implements ResultHolder interface.
+func (h *mppResultHolder) PopFront() (*chunk.Chunk, error) {
+	chk, err := h.peekFront()
+	if err != nil {
+		return nil, err
+	}
+	if err = h.dropFront(); err != nil {
+		return nil, err
+	}
+	return chk, nil
+}
+
+// peekFront returns the first held chunk without consuming it.
+func (h *mppResultHolder) peekFront() (*chunk.Chunk, error) {
+	if len(h.chks) == 0 {
+		return nil, errors.New("no chunk is held")
+	}
+	return h.getChk(&h.chks[0])
+}
+
+// dropFront consumes the first held chunk, and holder cannot hold anymore.
+func (h *mppResultHolder) dropFront() error {
+	if len(h.chks) == 0 {
+		return errors.New("no chunk is held")
+	}
+	h.waitSpill(&h.chks[0])
+	held := h.chks[0]
+	if held.chk == nil {
+		if err := h.spill.backend.Delete(held.spillSeq); err != nil {
+			return err
+		}
+		h.numSpilledChks--
+	}
+	h.chks = h.chks[1:]
+	h.poppedRows += uint64(held.numRows)
+	h.memTracker.Consume(-held.memUsage)
+	if !h.streaming {
+		h.stopHolding(cannotHoldReasonChunkPopped)
+	}
+	return nil
+}
+
+// forEachChk calls fn for each held chunk in order, it will not consume held chunks.
+func (h *mppResultHolder) forEachChk(fn func(chk *chunk.Chunk) error) error {
+	for i := range h.chks {
+		chk, err := h.getChk(&h.chks[i])
+		if err != nil {
+			return err
+		}
+		if err = fn(chk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// heldMemUsage returns the memory usage of held chunks, which should match memTracker.
+// Spilled chunks don't consume memory.
+func (h *mppResultHolder) heldMemUsage() int64 {
+	var memUsage int64
+	for _, held := range h.chks {
+		memUsage += held.memUsage
+	}
+	return memUsage
+}
+
+// truncateHeldRows keeps the first rows of held chunks and drops the others, the boundary chunk is truncated.
+// curRows is decreased by the dropped rows, as if they are never held.
+func (h *mppResultHolder) truncateHeldRows(rows uint64) error {
+	var kept uint64
+	for i := range h.chks {
+		held := &h.chks[i]
+		if kept+uint64(held.numRows) <= rows {
+			kept += uint64(held.numRows)
+			continue
+		}
+		dropFrom := i
+		if keep := int(rows - kept); keep > 0 {
+			chk, err := h.getChk(held)
+			if err != nil {
+				return err
+			}
+			if held.chk == nil {
+				if err = h.spill.backend.Delete(held.spillSeq); err != nil {
+					return err
+				}
+				h.numSpilledChks--
+			}
+			h.memTracker.Consume(-held.memUsage)
+			h.curRows -= uint64(held.numRows - keep)
+			chk.TruncateTo(keep)
+			*held = heldChunk{chk: chk, numRows: keep, memUsage: h.chkSize(chk), insertTime: held.insertTime}
+			h.memTracker.Consume(held.memUsage)
+			dropFrom++
+		}
+		for j := dropFrom; j < len(h.chks); j++ {
+			h.waitSpill(&h.chks[j])
+			dropped := h.chks[j]
+			if dropped.chk == nil {
+				// Ignore error, the backend is responsible for cleaning up the garbage.
+				_ = h.spill.backend.Delete(dropped.spillSeq)
+				h.numSpilledChks--
+			}
+			h.memTracker.Consume(-dropped.memUsage)
+			h.curRows -= uint64(dropped.numRows)
+		}
+		h.chks = h.chks[:dropFrom]
+		return nil
+	}
+	return nil
+}
+
+// releaseChks removes all held chunks and releases their memory and spilled data.
+// Other states like curRows and cannotHold are not touched.
+func (h *mppResultHolder) releaseChks() {
+	for i := range h.chks {
+		h.waitSpill(&h.chks[i])
+		if held := h.chks[i]; held.chk == nil {
+			// Ignore error, the backend is responsible for cleaning up the garbage.
+			_ = h.spill.backend.Delete(held.spillSeq)
+		}
+	}
+	h.memTracker.Consume(-h.heldMemUsage())
+	h.chks = h.chks[:0]
+	h.numSpilledChks = 0
+}
+
+// Reset implements ResultHolder interface. If checkAccounting is true, it returns error
+// when memory tracker doesn't match memory usage of held chunks.
+func (h *mppResultHolder) Reset() (err error) {
+	h.releaseChks()
+	if remained := h.memTracker.BytesConsumed(); h.checkAccounting && remained != 0 {
+		err = errors.Errorf("memory accounting of mpp result holder is imbalanced, remained bytes: %v", remained)
+		// Fix it to avoid corrupting accounting of parent.
+		h.memTracker.Consume(-remained)
+	}
+	h.cannotHold = false
+	h.reason = cannotHoldReasonNone
+	h.curRows = 0
+	h.poppedRows = 0
+	h.streaming = false
+	h.capacity = h.maxCapacity
+	h.schema = HeldSchemaInfo{}
+	if h.spill != nil {
+		h.spill.stat = SpillStat{}
+	}
+	h.memTracker.Detach()
+	if h.isKilled() {
+		h.stopHolding(cannotHoldReasonKilled)
+	}
+	return err
+}
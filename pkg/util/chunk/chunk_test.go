@@ -580,6 +580,9 @@ func TestChunkMemoryUsage(t *testing.T) {
 	}
 	// empty chunk with initial capactiy
 	require.Equal(t, int64(expectedUsage), chk.MemoryUsage())
+	for i := range colUsage {
+		require.Equal(t, int64(colUsage[i]+int(unsafe.Sizeof(*chk.columns[i]))), chk.Column(i).MemoryUsage())
+	}
 
 	jsonObj, err := types.ParseBinaryJSONFromString("1")
 	require.NoError(t, err)
@@ -175,6 +175,11 @@ func (c *Column) reset() {
 	c.data = c.data[:0]
 }
 
+// MemoryUsage returns the memory usage of a Column in bytes.
+func (c *Column) MemoryUsage() int64 {
+	return int64(unsafe.Sizeof(*c)) + int64(cap(c.nullBitmap)) + int64(cap(c.offsets)*8) + int64(cap(c.data)) + int64(cap(c.elemBuf))
+}
+
 // IsNull returns if this row is null.
 func (c *Column) IsNull(rowIdx int) bool {
 	nullByte := c.nullBitmap[rowIdx/8]